@@ -0,0 +1,523 @@
+package mghash
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	json "github.com/gibson042/canonicaljson-go"
+	"github.com/pkg/errors"
+)
+
+// ArtifactStore saves the targets of rules,
+// keyed by the hash of the rules' inputs,
+// so they can be restored instead of rebuilt.
+// See Fn.Artifacts.
+type ArtifactStore interface {
+	// Get returns the artifact stored under key,
+	// or nil if there is none.
+	// The caller must close the result.
+	Get(ctx context.Context, key []byte) (io.ReadCloser, error)
+
+	// Put stores the content of r under key,
+	// replacing any artifact already there.
+	Put(ctx context.Context, key []byte, r io.Reader) error
+}
+
+// InputHasher is a Rule that can hash its inputs alone:
+// everything in its content hash except the contents of its targets.
+// See Fn.Artifacts.
+type InputHasher interface {
+	Rule
+	InputHash(context.Context) ([]byte, error)
+}
+
+// DirStore is an ArtifactStore keeping each artifact in a file in a directory.
+// Each file begins with a header recording how the artifact is stored
+// (see dirStoreMeta),
+// so that Get can read it regardless of the options of the DirStore that wrote it.
+type DirStore struct {
+	dir string
+
+	// Compression for new artifacts, and its level.
+	compression Compression
+	level       int
+}
+
+var _ ArtifactStore = &DirStore{}
+
+// DirStoreOption is the type of an option to NewDirStore.
+type DirStoreOption func(*DirStore)
+
+// Compression is a compression algorithm for DirStore artifacts.
+type Compression string
+
+const (
+	// NoCompression stores artifacts as is.
+	// It is the default.
+	NoCompression Compression = "none"
+
+	// Gzip stores artifacts gzip-compressed (see compress/gzip).
+	Gzip Compression = "gzip"
+)
+
+// Compress is a DirStoreOption setting the compression for new artifacts
+// and, for algorithms that have one, its level
+// (e.g. gzip.BestCompression).
+// The compression is recorded with each artifact,
+// so Get decompresses it
+// whatever the compression of the DirStore reading it.
+func Compress(c Compression, level int) DirStoreOption {
+	return func(s *DirStore) {
+		s.compression = c
+		s.level = level
+	}
+}
+
+// NewDirStore produces a DirStore keeping artifacts in dir,
+// which is created if needed.
+func NewDirStore(dir string, opts ...DirStoreOption) (*DirStore, error) {
+	s := &DirStore{dir: dir, compression: NoCompression}
+	for _, opt := range opts {
+		opt(s)
+	}
+	switch s.compression {
+	case NoCompression:
+	case Gzip:
+		if _, err := gzip.NewWriterLevel(io.Discard, s.level); err != nil {
+			return nil, errors.Wrap(err, "checking compression level")
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %q", s.compression)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating %s", dir)
+	}
+	return s, nil
+}
+
+// dirStoreMeta is the metadata at the start of each DirStore file,
+// as a line of JSON following dirStoreMagic.
+type dirStoreMeta struct {
+	Compression Compression `json:"compression"`
+}
+
+const dirStoreMagic = "mghash artifact\n"
+
+// Get implements ArtifactStore.Get.
+// It decompresses the artifact according to its recorded compression.
+func (s *DirStore) Get(_ context.Context, key []byte) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "opening artifact")
+	}
+	r, err := readArtifact(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "reading artifact %s", f.Name())
+	}
+	return artifactReadCloser{Reader: r, f: f}, nil
+}
+
+// readArtifact reads the metadata at the start of f
+// and returns a reader for the artifact that follows.
+func readArtifact(f *os.File) (io.Reader, error) {
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(dirStoreMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != dirStoreMagic {
+		return nil, errors.New("missing header")
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "reading header")
+	}
+	var meta dirStoreMeta
+	if err = json.Unmarshal(line, &meta); err != nil {
+		return nil, errors.Wrap(err, "parsing header")
+	}
+	switch meta.Compression {
+	case NoCompression:
+		return br, nil
+	case Gzip:
+		zr, err := gzip.NewReader(br)
+		return zr, errors.Wrap(err, "decompressing")
+	}
+	return nil, fmt.Errorf("unknown compression %q", meta.Compression)
+}
+
+type artifactReadCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (rc artifactReadCloser) Close() error {
+	var err error
+	if c, ok := rc.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+	if err2 := rc.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Put implements ArtifactStore.Put.
+// The artifact is written to a temporary file and then renamed,
+// so a concurrent Get sees either the old artifact or the new one.
+func (s *DirStore) Put(_ context.Context, key []byte, r io.Reader) error {
+	f, err := os.CreateTemp(s.dir, "tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(f.Name())
+
+	err = s.writeArtifact(f, r)
+	if err2 := f.Close(); err == nil {
+		err = errors.Wrap(err2, "closing artifact")
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(os.Rename(f.Name(), s.path(key)), "renaming artifact")
+}
+
+// writeArtifact writes the metadata and the content of r to w,
+// compressing the content according to s.compression.
+func (s *DirStore) writeArtifact(w io.Writer, r io.Reader) error {
+	meta, err := json.Marshal(dirStoreMeta{Compression: s.compression})
+	if err != nil {
+		return errors.Wrap(err, "in JSON marshaling")
+	}
+	if _, err = fmt.Fprintf(w, "%s%s\n", dirStoreMagic, meta); err != nil {
+		return errors.Wrap(err, "writing header")
+	}
+	if s.compression != Gzip {
+		_, err = io.Copy(w, r)
+		return errors.Wrap(err, "writing artifact")
+	}
+	zw, err := gzip.NewWriterLevel(w, s.level)
+	if err != nil {
+		return errors.Wrap(err, "compressing artifact")
+	}
+	if _, err = io.Copy(zw, r); err != nil {
+		return errors.Wrap(err, "writing artifact")
+	}
+	return errors.Wrap(zw.Close(), "compressing artifact")
+}
+
+func (s *DirStore) path(key []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(key))
+}
+
+// restore restores f.Rule's targets from f.Artifacts,
+// reporting whether there was an artifact to restore.
+func (f *Fn) restore(ctx context.Context) (bool, error) {
+	ih, ok := f.Rule.(InputHasher)
+	if !ok {
+		return false, nil
+	}
+	targeter, ok := f.Rule.(Targeter)
+	if !ok {
+		return false, nil
+	}
+	key, err := f.artifactKey(ctx, ih)
+	if err != nil {
+		return false, err
+	}
+	rc, err := f.Artifacts.Get(ctx, key)
+	if err != nil {
+		return false, errors.Wrap(err, "getting artifact")
+	}
+	if rc == nil {
+		return false, nil
+	}
+	defer rc.Close()
+
+	for _, target := range targeter.TargetFiles() {
+		if err = os.RemoveAll(target); err != nil {
+			return false, errors.Wrapf(err, "removing %s", target)
+		}
+	}
+	if err = unpackTargets(rc, allowedTargets(f.Rule), f.TempDir); err != nil {
+		return false, errors.Wrap(err, "restoring artifact")
+	}
+	return true, nil
+}
+
+// artifactKey computes the key for f.Rule's artifact in f.Artifacts.
+// It is the input hash of the rule,
+// scoped the same way as its key in f.DB:
+// f.KeyFunc, if set, is applied to a view of the rule
+// whose ContentHash is the input hash,
+// and f's epoch is mixed in.
+func (f *Fn) artifactKey(ctx context.Context, ih InputHasher) ([]byte, error) {
+	h, err := ih.InputHash(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing input hash")
+	}
+	if f.KeyFunc != nil {
+		h, err = f.KeyFunc(ctx, inputHashRule{Rule: f.Rule, h: h})
+		if err != nil {
+			return nil, errors.Wrap(err, "computing artifact key")
+		}
+	}
+	return f.withEpoch(h), nil
+}
+
+// inputHashRule is a Rule whose content hash is the input hash h of the underlying Rule.
+// It is what an Fn's KeyFunc is applied to when computing artifact keys.
+type inputHashRule struct {
+	Rule
+	h []byte
+}
+
+func (r inputHashRule) ContentHash(context.Context) ([]byte, error) {
+	return r.h, nil
+}
+
+// allowedTargets returns the targets, or glob patterns for them,
+// that an artifact for r may restore.
+// These are r's declared targets if it has them (as a JRule does),
+// since a glob pattern among them may match nothing once its targets are deleted.
+func allowedTargets(r Rule) []string {
+	if dt, ok := r.(interface{ declaredTargets() []string }); ok {
+		return dt.declaredTargets()
+	}
+	if targeter, ok := r.(Targeter); ok {
+		return targeter.TargetFiles()
+	}
+	return nil
+}
+
+// save stores f.Rule's targets in f.Artifacts.
+func (f *Fn) save(ctx context.Context) error {
+	ih, ok := f.Rule.(InputHasher)
+	if !ok {
+		return nil
+	}
+	targeter, ok := f.Rule.(Targeter)
+	if !ok {
+		return nil
+	}
+	key, err := f.artifactKey(ctx, ih)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(packTargets(pw, targeter.TargetFiles()))
+	}()
+	err = f.Artifacts.Put(ctx, key, pr)
+	pr.CloseWithError(err)
+	return errors.Wrap(err, "storing artifact")
+}
+
+// targetRecord is the PAX record naming the target
+// that an archive entry belongs to.
+// The entry's name is its slash-separated path relative to that target,
+// which is "." for the target itself.
+const targetRecord = "MGHASH.target"
+
+// packTargets writes a tar archive of the given files, symlinks, and directory trees to w.
+// Symlinks are stored as such, not followed.
+// Nonexistent targets are skipped.
+func packTargets(w io.Writer, targets []string) error {
+	tw := tar.NewWriter(w)
+	for _, target := range targets {
+		err := filepath.WalkDir(target, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == target {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return errors.Wrapf(err, "statting %s", path)
+			}
+			var link string
+			switch mode := info.Mode(); {
+			case mode&fs.ModeSymlink != 0:
+				if link, err = os.Readlink(path); err != nil {
+					return errors.Wrapf(err, "reading symlink %s", path)
+				}
+			case !mode.IsDir() && !mode.IsRegular():
+				return fmt.Errorf("cannot store %s: not a regular file, directory, or symlink", path)
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return errors.Wrapf(err, "making header for %s", path)
+			}
+			rel, err := filepath.Rel(target, path)
+			if err != nil {
+				return errors.Wrapf(err, "computing relative path of %s", path)
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			hdr.PAXRecords = map[string]string{targetRecord: target}
+			hdr.Format = tar.FormatPAX
+			if err = tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "writing header for %s", path)
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			in, err := os.Open(path)
+			if err != nil {
+				return errors.Wrapf(err, "opening %s", path)
+			}
+			defer in.Close()
+			_, err = io.Copy(tw, in)
+			return errors.Wrapf(err, "archiving %s", path)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "walking %s", target)
+		}
+	}
+	return errors.Wrap(tw.Close(), "finishing archive")
+}
+
+// unpackTargets extracts the files, directories, and symlinks in the tar archive read from r.
+// Each entry must belong to one of allowed,
+// a list of targets and glob patterns for them,
+// and must have a clean relative name inside its target
+// that is not beneath a symlink from the archive.
+// Files are written to temporary files in tempDir (see createTemp)
+// and renamed into place.
+func unpackTargets(r io.Reader, allowed []string, tempDir string) error {
+	var (
+		tr    = tar.NewReader(r)
+		links = make(map[string]bool)
+	)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading archive")
+		}
+		path, err := entryPath(hdr, allowed, links)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(path, mode.Perm()); err != nil {
+				return errors.Wrapf(err, "creating %s", path)
+			}
+			continue
+
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return errors.Wrapf(err, "creating directory for %s", path)
+			}
+			if err = os.Symlink(hdr.Linkname, path); err != nil {
+				return errors.Wrapf(err, "creating symlink %s", path)
+			}
+			links[path] = true
+			continue
+
+		case tar.TypeReg:
+			// Handled below.
+
+		default:
+			return fmt.Errorf("archive entry %s is not a regular file, directory, or symlink", hdr.Name)
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrapf(err, "creating directory for %s", path)
+		}
+		out, err := createTemp(tempDir, path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if err == nil {
+			err = out.Chmod(mode.Perm())
+		}
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(out.Name(), path)
+		}
+		if err != nil {
+			os.Remove(out.Name())
+			return errors.Wrapf(err, "writing %s", path)
+		}
+	}
+}
+
+// entryPath returns the path to which the archive entry hdr is restored,
+// or an error if it is outside the targets in allowed
+// or at or beneath one of the symlinks in links.
+func entryPath(hdr *tar.Header, allowed []string, links map[string]bool) (string, error) {
+	name := hdr.Name
+	if name == "" || name != path.Clean(name) || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("archive entry %q is not a clean relative path", name)
+	}
+	target, ok := hdr.PAXRecords[targetRecord]
+	if !ok {
+		return "", fmt.Errorf("archive entry %q has no target", name)
+	}
+	if !targetAllowed(target, allowed) {
+		return "", fmt.Errorf("archive entry %q is for %s, which is not a target", name, target)
+	}
+	result := filepath.Join(target, filepath.FromSlash(name))
+	for p := result; ; p = filepath.Dir(p) {
+		if links[p] {
+			return "", fmt.Errorf("archive entry %s is at or beneath symlink %s", name, p)
+		}
+		if p == target || p == filepath.Dir(p) {
+			break
+		}
+	}
+	return result, nil
+}
+
+// targetAllowed tells whether target is in allowed
+// or matches a glob pattern there.
+func targetAllowed(target string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == target {
+			return true
+		}
+		if isGlob(a) {
+			if ok, _ := filepath.Match(a, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BuildAndCache runs the given rules in dependency order,
+// using db to find the ones that are up to date
+// and store to restore or save their targets (see Fn.Artifacts).
+// A rule that is up to date neither runs nor has its targets restored.
+func BuildAndCache(ctx context.Context, db DB, store ArtifactStore, rules []JRule) error {
+	order, err := topoOrder(rules)
+	if err != nil {
+		return err
+	}
+	for _, i := range order {
+		f := &Fn{DB: db, Rule: rules[i], Artifacts: store}
+		if err := f.Run(ctx); err != nil {
+			return errors.Wrapf(err, "building %s", f.Rule)
+		}
+	}
+	return nil
+}
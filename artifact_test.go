@@ -0,0 +1,464 @@
+package mghash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// countingStore is an ArtifactStore counting calls to Get and Put.
+type countingStore struct {
+	ArtifactStore
+	gets, puts int
+}
+
+func (s *countingStore) Get(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	s.gets++
+	return s.ArtifactStore.Get(ctx, key)
+}
+
+func (s *countingStore) Put(ctx context.Context, key []byte, r io.Reader) error {
+	s.puts++
+	return s.ArtifactStore.Put(ctx, key, r)
+}
+
+func TestBuildAndCache(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		mid    = filepath.Join(dir, "mid")
+		out    = filepath.Join(dir, "out")
+		outDir = filepath.Join(dir, "outdir")
+		runs   = filepath.Join(dir, "runs")
+		db     = NewMemDB()
+	)
+	ds, err := NewDirStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{ArtifactStore: ds}
+
+	// The rules are out of order, so BuildAndCache must order them.
+	rules := []JRule{{
+		Sources: []string{mid},
+		Targets: []string{out, outDir},
+		Command: []string{"sh", "-c", "cp " + mid + " " + out + " && mkdir -p " + outDir + "/sub && echo y > " + outDir + "/sub/f && echo out >> " + runs},
+	}, {
+		Sources: []string{src},
+		Targets: []string{mid},
+		Command: []string{"sh", "-c", "cp " + src + " " + mid + " && echo mid >> " + runs},
+	}}
+	build := func() {
+		t.Helper()
+		if err := BuildAndCache(ctx, db, store, rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRuns := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(runs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got runs %q, want %q", got, want)
+		}
+	}
+
+	// A miss runs the rules and stores their targets.
+	writeFile(t, src, "x")
+	build()
+	checkRuns("mid\nout\n")
+	if store.puts != 2 {
+		t.Errorf("got %d artifacts stored, want 2", store.puts)
+	}
+
+	// Current targets are neither rebuilt nor restored.
+	store.gets, store.puts = 0, 0
+	build()
+	checkRuns("mid\nout\n")
+	if store.gets != 0 || store.puts != 0 {
+		t.Errorf("got %d gets and %d puts for up-to-date rules, want none", store.gets, store.puts)
+	}
+
+	// Missing targets are restored instead of rebuilt.
+	for _, target := range []string{out, outDir} {
+		if err = os.RemoveAll(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build()
+	checkRuns("mid\nout\n")
+	checkFile(t, out, "x")
+	checkFile(t, filepath.Join(outDir, "sub", "f"), "y\n")
+
+	// A changed source is a miss again.
+	writeFile(t, src, "z")
+	build()
+	checkRuns("mid\nout\nmid\nout\n")
+	checkFile(t, out, "z")
+}
+
+func TestDirStoreTempDir(t *testing.T) {
+	ctx := context.Background()
+
+	// An unusable OS temp dir stands in for one on another filesystem,
+	// where a temp file could not be renamed into place.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "nonexistent"))
+
+	dir := filepath.Join(t.TempDir(), "store")
+	s, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(ctx, []byte("key"), strings.NewReader("artifact")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := s.Get(ctx, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "artifact" {
+		t.Errorf("got artifact %q, want %q", got, "artifact")
+	}
+
+	// No temp file is left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the store, want 1", len(entries))
+	}
+}
+
+func TestDirStoreCompress(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		content = strings.Repeat("compressible text\r\n", 10000) + "\xff\x00"
+		path    = filepath.Join(dir, hex.EncodeToString([]byte("key")))
+	)
+	compressed, err := NewDirStore(dir, Compress(Gzip, gzip.BestCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewDirStore(dir, Compress(NoCompression, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(s *DirStore, key string) string {
+		t.Helper()
+		rc, err := s.Get(ctx, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc == nil {
+			t.Fatalf("no artifact for %s", key)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err = compressed.Put(ctx, []byte("key"), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(len(content))/10 {
+		t.Errorf("got compressed size %d for %d bytes, want much smaller", info.Size(), len(content))
+	}
+
+	// The compression is read from the artifact's metadata,
+	// whatever the compression of the reading DirStore.
+	for _, s := range []*DirStore{compressed, plain} {
+		if got := get(s, "key"); got != content {
+			t.Errorf("got %d bytes back, want the %d stored", len(got), len(content))
+		}
+	}
+
+	// Replacing a compressed artifact with an uncompressed one, and back.
+	if err = plain.Put(ctx, []byte("key"), strings.NewReader("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(compressed, "key"); got != "plain" {
+		t.Errorf("got %q, want %q", got, "plain")
+	}
+	if err = compressed.Put(ctx, []byte("key"), strings.NewReader("compressed")); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(plain, "key"); got != "compressed" {
+		t.Errorf("got %q, want %q", got, "compressed")
+	}
+
+	// An artifact with unknown metadata is an error.
+	writeFile(t, path, dirStoreMagic+`{"compression": "zstd"}`+"\n")
+	if _, err = plain.Get(ctx, []byte("key")); err == nil {
+		t.Error("no error for an unknown compression")
+	}
+	writeFile(t, path, "compressed")
+	if _, err = plain.Get(ctx, []byte("key")); err == nil {
+		t.Error("no error for an artifact without metadata")
+	}
+
+	if _, err = NewDirStore(dir, Compress(Gzip, 100)); err == nil {
+		t.Error("no error for an invalid compression level")
+	}
+	if _, err = NewDirStore(dir, Compress("zstd", 0)); err == nil {
+		t.Error("no error for an unknown compression")
+	}
+}
+
+func TestPackTargets(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		file = filepath.Join(dir, "file")
+		tree = filepath.Join(dir, "tree")
+		link = filepath.Join(dir, "link")
+		none = filepath.Join(dir, "none")
+	)
+	writeFile(t, file, "file")
+	writeFile(t, filepath.Join(tree, "sub", "f"), "f")
+	if err := os.Symlink("f", filepath.Join(tree, "sub", "g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	targets := []string{file, tree, link, none}
+
+	var buf bytes.Buffer
+	if err := packTargets(&buf, targets); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		if err := os.RemoveAll(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unpackTargets(&buf, targets, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFile(t, file, "file")
+	checkFile(t, filepath.Join(tree, "sub", "f"), "f")
+	for _, l := range []struct{ path, want string }{{link, "file"}, {filepath.Join(tree, "sub", "g"), "f"}} {
+		got, err := os.Readlink(l.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != l.want {
+			t.Errorf("got link %s -> %s, want -> %s", l.path, got, l.want)
+		}
+	}
+	if _, err := os.Lstat(none); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v for a nonexistent target, want not-exist", err)
+	}
+
+	// A glob pattern allows the targets it matches.
+	buf.Reset()
+	if err := packTargets(&buf, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackTargets(&buf, []string{filepath.Join(dir, "f*")}, ""); err != nil {
+		t.Error(err)
+	}
+
+	// Other kinds of files are not stored.
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skip(err)
+	}
+	if err := packTargets(io.Discard, []string{fifo}); err == nil {
+		t.Error("no error archiving a fifo")
+	}
+}
+
+func TestUnpackTargetsInvalid(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		target = filepath.Join(dir, "target")
+		other  = filepath.Join(dir, "other")
+	)
+	type entry struct {
+		name, target string
+		typ          byte
+		link         string
+	}
+	cases := []struct {
+		desc    string
+		entries []entry
+	}{
+		{desc: "absolute name", entries: []entry{{name: other, target: target}}},
+		{desc: "parent name", entries: []entry{{name: "../other", target: target}}},
+		{desc: "dot-dot name", entries: []entry{{name: "..", target: target}}},
+		{desc: "unclean name", entries: []entry{{name: "sub/../../other", target: target}}},
+		{desc: "unclean dot name", entries: []entry{{name: "./x", target: target}}},
+		{desc: "empty name", entries: []entry{{name: "", target: target}}},
+		{desc: "no target", entries: []entry{{name: "."}}},
+		{desc: "undeclared target", entries: []entry{{name: ".", target: other}}},
+		{desc: "hard link", entries: []entry{{name: ".", target: target, typ: tar.TypeLink, link: other}}},
+		{desc: "device", entries: []entry{{name: ".", target: target, typ: tar.TypeChar}}},
+		{desc: "beneath a symlink", entries: []entry{
+			{name: ".", target: target, typ: tar.TypeDir},
+			{name: "l", target: target, typ: tar.TypeSymlink, link: dir},
+			{name: "l/other", target: target},
+		}},
+		{desc: "through a symlink", entries: []entry{
+			{name: ".", target: target, typ: tar.TypeDir},
+			{name: "l", target: target, typ: tar.TypeSymlink, link: other},
+			{name: "l", target: target},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			if err := os.RemoveAll(target); err != nil {
+				t.Fatal(err)
+			}
+			var (
+				buf bytes.Buffer
+				tw  = tar.NewWriter(&buf)
+			)
+			for _, e := range c.entries {
+				hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0644, Size: int64(len("x"))}
+				if e.typ == 0 {
+					hdr.Typeflag = tar.TypeReg
+				} else {
+					hdr.Size = 0
+				}
+				if e.target != "" {
+					hdr.PAXRecords = map[string]string{targetRecord: e.target}
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Size > 0 {
+					if _, err := tw.Write([]byte("x")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := unpackTargets(&buf, []string{target}, ""); err == nil {
+				t.Error("no error")
+			}
+			if _, err := os.Lstat(other); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got %v for %s, want not-exist", err, other)
+			}
+		})
+	}
+}
+
+// failingStore is an ArtifactStore whose Put fails.
+type failingStore struct {
+	ArtifactStore
+}
+
+func (failingStore) Put(context.Context, []byte, io.Reader) error {
+	return errors.New("put failed")
+}
+
+func TestSaveBeforeAdd(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		db     = NewMemDB()
+		rule   = JRule{Sources: []string{src}, Targets: []string{target}, Command: []string{"cp", src, target}}
+	)
+	writeFile(t, src, "x")
+	ds, err := NewDirStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Fn{DB: db, Rule: rule, Artifacts: failingStore{ArtifactStore: ds}}
+	if err = f.Run(ctx); err == nil {
+		t.Fatal("no error when saving the artifact fails")
+	}
+	if stale, err := f.Stale(ctx); err != nil {
+		t.Fatal(err)
+	} else if !stale {
+		t.Error("rule recorded as up to date without its artifact")
+	}
+}
+
+func TestArtifactKeyScope(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		runs   = filepath.Join(dir, "runs")
+		rule   = JRule{
+			Sources: []string{src},
+			Targets: []string{target},
+			Command: []string{"sh", "-c", "cp " + src + " " + target + " && echo x >> " + runs},
+		}
+	)
+	writeFile(t, src, "x")
+	store, err := NewDirStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scoped := func(scope string) func(context.Context, Rule) ([]byte, error) {
+		return func(ctx context.Context, r Rule) ([]byte, error) {
+			h, err := r.ContentHash(ctx)
+			return append([]byte(scope+":"), h...), err
+		}
+	}
+
+	// Each Fn runs the rule from scratch, with a fresh DB,
+	// and so finds it up to date only by restoring its target.
+	run := func(f *Fn, wantRuns string) {
+		t.Helper()
+		if err := os.RemoveAll(target); err != nil {
+			t.Fatal(err)
+		}
+		f.DB, f.Rule, f.Artifacts = NewMemDB(), rule, store
+		if err := f.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, target, "x")
+		checkFile(t, runs, wantRuns)
+	}
+
+	run(&Fn{Epoch: "1"}, "x\n")
+	run(&Fn{Epoch: "1"}, "x\n")
+
+	// A new epoch rebuilds instead of restoring the old epoch's artifact.
+	run(&Fn{Epoch: "2"}, "x\nx\n")
+	run(&Fn{Epoch: "2"}, "x\nx\n")
+
+	// So does a KeyFunc with a new scope.
+	run(&Fn{Epoch: "2", KeyFunc: scoped("a")}, "x\nx\nx\n")
+	run(&Fn{Epoch: "2", KeyFunc: scoped("a")}, "x\nx\nx\n")
+	run(&Fn{Epoch: "2", KeyFunc: scoped("b")}, "x\nx\nx\nx\n")
+}
@@ -0,0 +1,271 @@
+// Package bolt implements mghash.DB using bbolt,
+// a pure-Go embedded key/value store.
+// Unlike the sqlite package, it does not require cgo.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/bobg/mghash"
+)
+
+// DB is an implementation of mghash.DB that uses a bbolt file for persistent storage.
+// Each hash is a key in a bucket,
+// whose value is the hash's last-access time in Unix seconds.
+// A second bucket indexes the hashes by last-access time,
+// so that eviction (see Keep) visits only expired entries.
+type DB struct {
+	db          *bbolt.DB
+	keep        time.Duration
+	now         func() time.Time
+	lockTimeout time.Duration
+}
+
+var (
+	_ mghash.DB       = &DB{}
+	_ mghash.Iterator = &DB{}
+	_ mghash.Deleter  = &DB{}
+)
+
+var (
+	bucket      = []byte("hashes")
+	timesBucket = []byte("times")
+)
+
+// Open opens the given file and returns it as a *DB.
+// The file is created if it doesn't already exist.
+// Only one process at a time may have the file open;
+// Open waits for another to close it,
+// up to a limit (see LockTimeout).
+// Callers should call Close when finished operating on the database.
+func Open(path string, opts ...Option) (*DB, error) {
+	result := &DB{
+		now:         time.Now,
+		lockTimeout: defaultLockTimeout,
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: result.lockTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening bolt db %s", path)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(timesBucket) != nil {
+			return nil
+		}
+		// A database from before the time index.
+		t, err := tx.CreateBucket(timesBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return t.Put(timeKey(v, k), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating buckets")
+	}
+	result.db = db
+	return result, nil
+}
+
+// defaultLockTimeout is how long Open waits for another process to close the file,
+// absent a LockTimeout option.
+const defaultLockTimeout = 30 * time.Second
+
+// Close releases the resources of db.
+func (db *DB) Close() error {
+	return errors.Wrap(db.db.Close(), "closing database")
+}
+
+// Option is the type of a config option that can be passed to Open.
+type Option func(*DB)
+
+// Keep is an Option that sets the amount of time to keep a database entry.
+// By default, DB keeps all entries.
+// Using Keep(d) allows DB to evict entries whose last-access time is older than d.
+func Keep(d time.Duration) Option {
+	return func(db *DB) {
+		db.keep = d
+	}
+}
+
+// LockTimeout is an Option that sets how long Open waits
+// for another process that has the file open to close it,
+// before failing.
+// The default is 30 seconds.
+// A value of zero or less means wait indefinitely.
+func LockTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.lockTimeout = d
+	}
+}
+
+// Clock is an Option that sets the function DB uses to get the current time.
+// By default this is time.Now.
+// It is mainly useful in tests of eviction behavior.
+func Clock(now func() time.Time) Option {
+	return func(db *DB) {
+		db.now = now
+	}
+}
+
+// Has tells whether db contains the given hash.
+// If found, it also updates the last-access time of the hash,
+// if that has changed.
+// Concurrent updates are combined into a single write transaction
+// (see bbolt.DB.Batch).
+func (db *DB) Has(_ context.Context, h []byte) (bool, error) {
+	var (
+		found bool
+		stamp = db.stamp()
+	)
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		old := tx.Bucket(bucket).Get(h)
+		found = old != nil
+		if bytes.Equal(old, stamp) {
+			// Nothing to update.
+			stamp = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "querying database")
+	}
+	if !found || stamp == nil {
+		return found, nil
+	}
+
+	err = db.db.Batch(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		// The entry may have been deleted since.
+		if b.Get(h) == nil {
+			return nil
+		}
+		return put(b, tx.Bucket(timesBucket), h, stamp)
+	})
+	return true, errors.Wrap(err, "updating access time")
+}
+
+// Add adds a hash to db.
+// If it is already present, its last-access time is updated.
+// If db was opened with the Keep option,
+// entries with old last-access times are evicted.
+func (db *DB) Add(_ context.Context, h []byte) error {
+	return db.db.Update(func(tx *bbolt.Tx) error {
+		var (
+			b = tx.Bucket(bucket)
+			t = tx.Bucket(timesBucket)
+		)
+		if err := put(b, t, h, db.stamp()); err != nil {
+			return errors.Wrap(err, "adding hash to database")
+		}
+		if db.keep <= 0 {
+			return nil
+		}
+
+		var (
+			cutoff = db.now().Add(-db.keep).Unix()
+			stale  [][]byte
+			c      = t.Cursor()
+		)
+		for k, _ := c.First(); k != nil && unixSecs(k[:8]) < cutoff; k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		for _, k := range stale {
+			if err := t.Delete(k); err != nil {
+				return errors.Wrap(err, "evicting expired database entry")
+			}
+			if err := b.Delete(k[8:]); err != nil {
+				return errors.Wrap(err, "evicting expired database entry")
+			}
+		}
+		return nil
+	})
+}
+
+// put sets the last-access time of h to stamp,
+// in both the hashes bucket b and the times bucket t.
+func put(b, t *bbolt.Bucket, h, stamp []byte) error {
+	if old := b.Get(h); old != nil {
+		if err := t.Delete(timeKey(old, h)); err != nil {
+			return err
+		}
+	}
+	if err := b.Put(h, stamp); err != nil {
+		return err
+	}
+	return t.Put(timeKey(stamp, h), nil)
+}
+
+// Delete removes the given hashes from db.
+// It implements mghash.Deleter.
+func (db *DB) Delete(_ context.Context, hashes ...[]byte) error {
+	err := db.db.Update(func(tx *bbolt.Tx) error {
+		var (
+			b = tx.Bucket(bucket)
+			t = tx.Bucket(timesBucket)
+		)
+		for _, h := range hashes {
+			old := b.Get(h)
+			if old == nil {
+				continue
+			}
+			if err := t.Delete(timeKey(old, h)); err != nil {
+				return err
+			}
+			if err := b.Delete(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "deleting hashes")
+}
+
+// ForEach calls f for each hash in db and its last-access time.
+// It implements mghash.Iterator.
+func (db *DB) ForEach(ctx context.Context, f func([]byte, time.Time) error) error {
+	return db.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Keys are valid only during the transaction.
+			h := append([]byte{}, k...)
+			return f(h, time.Unix(unixSecs(v), 0))
+		})
+	})
+}
+
+func (db *DB) stamp() []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(db.now().Unix()))
+	return buf[:]
+}
+
+// timeKey is the key in the times bucket for hash h with last-access time stamp.
+// Its big-endian time prefix orders the bucket by time.
+func timeKey(stamp, h []byte) []byte {
+	return append(append(make([]byte, 0, len(stamp)+len(h)), stamp...), h...)
+}
+
+func unixSecs(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
@@ -0,0 +1,237 @@
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T, path string, opts ...Option) *DB {
+	t.Helper()
+	db, err := Open(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// fakeClock is a settable clock for the Clock option.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// entries returns the entries of db and their last-access times.
+func entries(ctx context.Context, t *testing.T, db *DB) map[string]time.Time {
+	t.Helper()
+	result := make(map[string]time.Time)
+	err := db.ForEach(ctx, func(h []byte, at time.Time) error {
+		result[string(h)] = at
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDB(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		path  = filepath.Join(t.TempDir(), "test.db")
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(t, path, Clock(clock.now))
+	)
+	has := func(h string) bool {
+		t.Helper()
+		ok, err := db.Has(ctx, []byte(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	for _, h := range []string{"a", "b", "c"} {
+		if err := db.Add(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !has("a") || has("x") {
+		t.Error("wrong result from Has")
+	}
+	if err := db.Delete(ctx, []byte("b"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Has records a new access time.
+	clock.advance(time.Minute)
+	if !has("c") {
+		t.Fatal("c missing")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, path, Clock(clock.now))
+	want := map[string]time.Time{
+		"a": time.Unix(1000000, 0),
+		"c": time.Unix(1000060, 0),
+	}
+	if got := entries(ctx, t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(t, filepath.Join(t.TempDir(), "test.db"), Keep(time.Hour), Clock(clock.now))
+	)
+	add := func(h string) {
+		t.Helper()
+		if err := db.Add(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want ...string) {
+		t.Helper()
+		var got []string
+		for h := range entries(ctx, t, db) {
+			got = append(got, h)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got entries %v, want %v", got, want)
+		}
+	}
+
+	add("a")
+	clock.advance(30 * time.Minute)
+	add("b")
+
+	// Exactly Keep after a was added, it is not yet expired.
+	clock.advance(30 * time.Minute)
+	add("c")
+	check("a", "b", "c")
+
+	// A second later, it is.
+	clock.advance(time.Second)
+	add("d")
+	check("b", "c", "d")
+
+	// An access time from Has counts.
+	clock.advance(10 * time.Minute)
+	if ok, err := db.Has(ctx, []byte("b")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("b missing")
+	}
+	clock.advance(time.Hour)
+	add("e")
+	check("b", "e")
+
+	// Re-adding an entry moves it in the time index.
+	clock.advance(10 * time.Minute)
+	add("b")
+	clock.advance(time.Hour)
+	add("f")
+	check("b", "f")
+}
+
+func TestHasWritesAccessTime(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		path  = filepath.Join(t.TempDir(), "test.db")
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(t, path, Clock(clock.now))
+	)
+	if err := db.Add(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	if _, err := db.Has(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new access time is in the file before Close,
+	// so it survives a process that exits without closing db.
+	err := db.db.View(func(tx *bbolt.Tx) error {
+		if got := unixSecs(tx.Bucket(bucket).Get([]byte("a"))); got != 1000060 {
+			t.Errorf("got access time %d, want 1000060", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	openTestDB(t, path)
+
+	// The file is locked by the DB still open.
+	start := time.Now()
+	db, err := Open(path, LockTimeout(100*time.Millisecond))
+	if err == nil {
+		db.Close()
+		t.Fatal("no error opening a locked file")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Open took %s to fail", elapsed)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		path  = filepath.Join(t.TempDir(), "test.db")
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+	)
+
+	// A database with no time index.
+	bdb, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket(bucket)
+		if err != nil {
+			return err
+		}
+		old := &DB{now: clock.now}
+		if err = b.Put([]byte("old"), old.stamp()); err != nil {
+			return err
+		}
+		clock.advance(time.Hour)
+		return b.Put([]byte("new"), old.stamp())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t, path, Keep(time.Hour), Clock(clock.now))
+	clock.advance(time.Second)
+	if err = db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	got := entries(ctx, t, db)
+	if _, ok := got["old"]; ok {
+		t.Error("expired entry from before the upgrade not evicted")
+	}
+	if _, ok := got["new"]; !ok {
+		t.Error("unexpired entry from before the upgrade evicted")
+	}
+}
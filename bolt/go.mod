@@ -0,0 +1,16 @@
+module github.com/bobg/mghash/bolt
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015011847-7a2bf27b68fe
+	github.com/pkg/errors v0.9.1
+	go.etcd.io/bbolt v1.3.7
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	github.com/magefile/mage v1.13.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
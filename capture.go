@@ -0,0 +1,20 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+)
+
+// capture collects the output of a rule for Fn.RunCapture.
+type capture struct {
+	buf bytes.Buffer
+	ran bool
+}
+
+type captureKey struct{}
+
+// captured returns the capture in ctx, if any.
+func captured(ctx context.Context) *capture {
+	c, _ := ctx.Value(captureKey{}).(*capture)
+	return c
+}
@@ -0,0 +1,47 @@
+package mghash
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// cleanDir removes the contents of dir,
+// except for paths in keep and the directories containing them.
+// Dir and the paths in keep must be absolute and clean.
+// It reports whether anything in dir was kept.
+// A nonexistent dir is not an error.
+func cleanDir(dir string, keep map[string]bool) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "reading directory %s", dir)
+	}
+
+	var kept bool
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if keep[path] {
+			kept = true
+			continue
+		}
+		if entry.IsDir() {
+			subkept, err := cleanDir(path, keep)
+			if err != nil {
+				return false, err
+			}
+			if subkept {
+				kept = true
+				continue
+			}
+		}
+		if err = os.Remove(path); err != nil {
+			return false, errors.Wrapf(err, "removing %s", path)
+		}
+	}
+	return kept, nil
+}
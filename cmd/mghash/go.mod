@@ -0,0 +1,16 @@
+module github.com/bobg/mghash/cmd/mghash
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015012340-bba50101168a
+	github.com/magefile/mage v1.13.0
+	github.com/pkg/errors v0.9.1
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	github.com/mattn/go-sqlite3 v1.14.13 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
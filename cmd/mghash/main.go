@@ -0,0 +1,195 @@
+// Command mghash runs the rules in the .mghash.json files of a directory tree
+// without the need for a magefile.
+//
+// Usage:
+//
+//	mghash [-db FILE] [-dir DIR] [-force] [-n] [-v] [PATTERN ...]
+//	mghash [-db FILE] stats
+//
+// Rules are loaded from DIR (default ".") and its subdirectories with mghash.JTree,
+// and run in dependency order,
+// using the sqlite database FILE to tell which are up to date.
+// If -db is not given,
+// the database named in the project config file is used
+// (see mghash.LoadConfig).
+//
+// If PATTERNs are given,
+// only the rules with a target matching one of them are run
+// (see mghash.Select),
+// together with the rules they depend on.
+//
+// With -force, rules run even if they are up to date.
+// With -n, nothing runs;
+// instead the rules that would run are listed
+// (see mghash.Stale).
+// With -v, rules' commands and their output are shown.
+// Each rule is reported as up to date, rebuilt,
+// or skipped (for a rule whose condition fails).
+//
+// The stats subcommand reports the number and size of the database's entries
+// and the range of their last-access times
+// (see mghash.Stats).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/magefile/mage/mg"
+	"github.com/pkg/errors"
+
+	"github.com/bobg/mghash"
+	"github.com/bobg/mghash/sqlite"
+)
+
+func main() {
+	var (
+		dbPath = flag.String("db", "", "sqlite database file")
+		dir    = flag.String("dir", ".", "root of the tree of .mghash.json files")
+		force  = flag.Bool("force", false, "run rules even if they are up to date")
+		dryRun = flag.Bool("n", false, "list the rules that would run without running them")
+		v      = flag.Bool("v", false, "verbose")
+	)
+	flag.Parse()
+
+	if *v {
+		os.Setenv(mg.VerboseEnv, "1")
+	}
+
+	if flag.NArg() == 1 && flag.Arg(0) == "stats" {
+		if err := stats(context.Background(), *dbPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	r := runner{force: *force, dryRun: *dryRun, verbose: *v, done: make(map[*mghash.Fn]bool)}
+	if err := r.run(context.Background(), *dbPath, *dir, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (r runner) run(ctx context.Context, dbPath, dir string, patterns []string) error {
+	rules, err := mghash.JTree(dir)
+	if err != nil {
+		return errors.Wrapf(err, "loading rules from %s", dir)
+	}
+
+	db, err := sqlite.Open(ctx, dbPath)
+	if err != nil {
+		return errors.Wrap(err, "opening database")
+	}
+	defer db.Close()
+
+	fns, err := mghash.Fns(db, rules)
+	if err != nil {
+		return err
+	}
+
+	selected := fns
+	if len(patterns) > 0 {
+		want := make(map[string]bool)
+		for _, rule := range mghash.Select(rules, patterns...) {
+			want[rule.String()] = true
+		}
+		selected = nil
+		for _, f := range fns {
+			if want[f.Rule.String()] {
+				selected = append(selected, f)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("no rules match %v", patterns)
+		}
+	}
+
+	for _, f := range selected {
+		if err := r.visit(ctx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stats(ctx context.Context, dbPath string) error {
+	db, err := sqlite.Open(ctx, dbPath)
+	if err != nil {
+		return errors.Wrap(err, "opening database")
+	}
+	defer db.Close()
+
+	s, err := db.Stats(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting stats")
+	}
+	fmt.Printf("entries: %d\n", s.Entries)
+	fmt.Printf("bytes: %d\n", s.Bytes)
+	if s.Entries > 0 {
+		fmt.Printf("oldest: %s\n", s.Oldest.Format(time.RFC3339))
+		fmt.Printf("newest: %s\n", s.Newest.Format(time.RFC3339))
+	}
+	return nil
+}
+
+type runner struct {
+	force, dryRun, verbose bool
+	done                   map[*mghash.Fn]bool
+}
+
+// visit runs f after the Fns in its After list,
+// each at most once.
+// Running them here, rather than leaving them to f via mg.CtxDeps,
+// lets each one's outcome be reported.
+func (r runner) visit(ctx context.Context, f *mghash.Fn) error {
+	if r.done[f] {
+		return nil
+	}
+	r.done[f] = true
+
+	for _, dep := range f.After {
+		if dep, ok := dep.(*mghash.Fn); ok {
+			if err := r.visit(ctx, dep); err != nil {
+				return err
+			}
+		}
+	}
+
+	f2 := *f
+	f2.After = nil
+	f2.Force = r.force
+
+	if r.dryRun {
+		stale, err := f2.Stale(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "checking %s", f.Rule)
+		}
+		if stale {
+			fmt.Printf("would rebuild: %s\n", f.Rule)
+		}
+		return nil
+	}
+
+	var skipped bool
+	f2.OnSkipped = func(mghash.Rule) { skipped = true }
+
+	output, rebuilt, err := f2.RunCapture(ctx)
+	if r.verbose || err != nil {
+		os.Stderr.Write(output)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "running %s", f.Rule)
+	}
+	switch {
+	case skipped:
+		fmt.Printf("skipped: %s\n", f.Rule)
+	case rebuilt:
+		fmt.Printf("rebuilt: %s\n", f.Rule)
+	default:
+		fmt.Printf("up to date: %s\n", f.Rule)
+	}
+	return nil
+}
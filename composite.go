@@ -0,0 +1,226 @@
+package mghash
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	json "github.com/gibson042/canonicaljson-go"
+	"github.com/pkg/errors"
+)
+
+// CompositeRule is a Rule made of a sequence of other rules,
+// run in order as a single step.
+// Its hashes combine those of its members, in order,
+// so a change to any member's rule or content invalidates the whole.
+// They are computed with the hash algorithm named in the config file
+// (see Config.HashAlgo).
+type CompositeRule []Rule
+
+var (
+	_ Sourcer  = CompositeRule{}
+	_ Targeter = CompositeRule{}
+)
+
+func (cr CompositeRule) String() string {
+	return memberString("CompositeRule", cr)
+}
+
+// RuleHash implements Rule.RuleHash.
+func (cr CompositeRule) RuleHash() []byte {
+	return memberRuleHash(compositeRuleHashDomain, cr)
+}
+
+// ContentHash implements Rule.ContentHash.
+func (cr CompositeRule) ContentHash(ctx context.Context) ([]byte, error) {
+	return memberContentHash(ctx, compositeContentHashDomain, cr)
+}
+
+const (
+	compositeRuleHashDomain    = "mghash.CompositeRule.RuleHash"
+	compositeContentHashDomain = "mghash.CompositeRule.ContentHash"
+)
+
+// Run implements Rule.Run.
+// It runs the members in order,
+// stopping at the first error.
+func (cr CompositeRule) Run(ctx context.Context) error {
+	for _, r := range cr {
+		if err := r.Run(ctx); err != nil {
+			return errors.Wrapf(err, "running %s", r)
+		}
+	}
+	return nil
+}
+
+// SourceFiles implements Sourcer.
+// It returns the sources of the members that are Sourcers.
+func (cr CompositeRule) SourceFiles(ctx context.Context) ([]string, error) {
+	return memberSources(ctx, cr)
+}
+
+// TargetFiles implements Targeter.
+// It returns the targets of the members that are Targeters.
+func (cr CompositeRule) TargetFiles() []string {
+	return memberTargets(cr)
+}
+
+// ParallelRule is a Rule made of independent rules,
+// run concurrently as a single step,
+// at most as many at a time as the configured concurrency (see Config.Concurrency).
+// Its hashes combine those of its members, in order,
+// as for CompositeRule.
+//
+// Members that depend on one another must instead be ordered with a CompositeRule,
+// which may contain ParallelRules:
+// CompositeRule{ParallelRule{a, b}, c} runs a and b concurrently,
+// then c.
+type ParallelRule []Rule
+
+var (
+	_ Sourcer  = ParallelRule{}
+	_ Targeter = ParallelRule{}
+)
+
+func (pr ParallelRule) String() string {
+	return memberString("ParallelRule", pr)
+}
+
+// RuleHash implements Rule.RuleHash.
+func (pr ParallelRule) RuleHash() []byte {
+	return memberRuleHash(parallelRuleHashDomain, pr)
+}
+
+// ContentHash implements Rule.ContentHash.
+func (pr ParallelRule) ContentHash(ctx context.Context) ([]byte, error) {
+	return memberContentHash(ctx, parallelContentHashDomain, pr)
+}
+
+const (
+	parallelRuleHashDomain    = "mghash.ParallelRule.RuleHash"
+	parallelContentHashDomain = "mghash.ParallelRule.ContentHash"
+)
+
+// Run implements Rule.Run.
+// It runs the members concurrently and waits for all of them,
+// returning the error of the first (in order) that failed.
+// Under Fn.RunCapture,
+// each member's output is collected separately
+// and the results are joined in member order.
+func (pr ParallelRule) Run(ctx context.Context) error {
+	var (
+		errs     = make([]error, len(pr))
+		captures []*capture
+		sem      = make(chan struct{}, concurrency())
+		wg       sync.WaitGroup
+	)
+	c := captured(ctx)
+	if c != nil {
+		captures = make([]*capture, len(pr))
+	}
+	for i, r := range pr {
+		i, r := i, r
+		rctx := ctx
+		if c != nil {
+			captures[i] = new(capture)
+			rctx = context.WithValue(ctx, captureKey{}, captures[i])
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = r.Run(rctx)
+		}()
+	}
+	wg.Wait()
+
+	for _, mc := range captures {
+		c.buf.Write(mc.buf.Bytes())
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "running %s", pr[i])
+		}
+	}
+	return nil
+}
+
+// SourceFiles implements Sourcer.
+// It returns the sources of the members that are Sourcers.
+func (pr ParallelRule) SourceFiles(ctx context.Context) ([]string, error) {
+	return memberSources(ctx, pr)
+}
+
+// TargetFiles implements Targeter.
+// It returns the targets of the members that are Targeters.
+func (pr ParallelRule) TargetFiles() []string {
+	return memberTargets(pr)
+}
+
+// memberString is the String method of a rule of the given kind
+// made of other rules.
+func memberString(kind string, rules []Rule) string {
+	strs := make([]string, 0, len(rules))
+	for _, r := range rules {
+		strs = append(strs, r.String())
+	}
+	return fmt.Sprintf("%s[%s]", kind, strings.Join(strs, " "))
+}
+
+// memberRuleHash combines the rule hashes of rules, in order,
+// under the given domain-separation tag.
+func memberRuleHash(domain string, rules []Rule) []byte {
+	hashes := make([][]byte, 0, len(rules))
+	for _, r := range rules {
+		hashes = append(hashes, r.RuleHash())
+	}
+	j, _ := json.Marshal(hashes)
+	return domainHash(defaultHashAlgo(), domain, j)
+}
+
+// memberContentHash combines the content hashes of rules, in order,
+// under the given domain-separation tag.
+func memberContentHash(ctx context.Context, domain string, rules []Rule) ([]byte, error) {
+	hashes := make([][]byte, 0, len(rules))
+	for _, r := range rules {
+		h, err := r.ContentHash(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "computing content hash of %s", r)
+		}
+		hashes = append(hashes, h)
+	}
+	j, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, errors.Wrap(err, "in JSON marshaling")
+	}
+	return domainHash(defaultHashAlgo(), domain, j), nil
+}
+
+func memberSources(ctx context.Context, rules []Rule) ([]string, error) {
+	var result []string
+	for _, r := range rules {
+		if s, ok := r.(Sourcer); ok {
+			files, err := s.SourceFiles(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting sources of %s", r)
+			}
+			result = append(result, files...)
+		}
+	}
+	return result, nil
+}
+
+func memberTargets(rules []Rule) []string {
+	var result []string
+	for _, r := range rules {
+		if t, ok := r.(Targeter); ok {
+			result = append(result, t.TargetFiles()...)
+		}
+	}
+	return result
+}
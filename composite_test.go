@@ -0,0 +1,240 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// funcRule is a Rule running a function.
+type funcRule struct {
+	name string
+	run  func(context.Context) error
+}
+
+func (r funcRule) String() string   { return r.name }
+func (r funcRule) RuleHash() []byte { return []byte(r.name) }
+
+func (r funcRule) ContentHash(context.Context) ([]byte, error) {
+	return []byte(r.name), nil
+}
+
+func (r funcRule) Run(ctx context.Context) error { return r.run(ctx) }
+
+func TestParallelRule(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	if concurrency() < 2 {
+		t.Skip("configured concurrency is less than 2")
+	}
+	var (
+		ctx     = context.Background()
+		started = make(chan string, 2)
+		release = make(chan struct{})
+		mu      sync.Mutex
+		done    []string
+	)
+	independent := func(name string) funcRule {
+		return funcRule{name: name, run: func(context.Context) error {
+			started <- name
+			<-release
+			mu.Lock()
+			done = append(done, name)
+			mu.Unlock()
+			return nil
+		}}
+	}
+	var (
+		a, b      = independent("a"), independent("b")
+		dependent = funcRule{name: "c", run: func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(done) != 2 {
+				t.Errorf("c ran after %v, want after a and b", done)
+			}
+			return nil
+		}}
+		rule = CompositeRule{ParallelRule{a, b}, dependent}
+	)
+
+	errs := make(chan error)
+	go func() { errs <- rule.Run(ctx) }()
+
+	// Both independent sub-steps start before either finishes.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Fatal("independent sub-steps did not run concurrently")
+		}
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// The hash covers the members in order,
+	// and differs from that of a sequence of the same members.
+	var (
+		ab = ParallelRule{a, b}
+		ba = ParallelRule{b, a}
+	)
+	if bytes.Equal(ab.RuleHash(), ba.RuleHash()) {
+		t.Error("same rule hash for members in a different order")
+	}
+	if bytes.Equal(ab.RuleHash(), (CompositeRule{a, b}).RuleHash()) {
+		t.Error("same rule hash for a ParallelRule and a CompositeRule")
+	}
+	h1, err := ab.ContentHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := ab.ContentHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h2) {
+		t.Error("content hash not deterministic")
+	}
+}
+
+func TestCompositeRule(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		runs = filepath.Join(dir, "runs")
+		db   = NewMemDB()
+	)
+	child := func(name string) JRule {
+		src := filepath.Join(dir, name+".src")
+		writeFile(t, src, name)
+		return JRule{
+			Sources: []string{src},
+			Targets: []string{filepath.Join(dir, name+".out")},
+			Command: []string{"sh", "-c", "cp " + src + " " + filepath.Join(dir, name+".out") + " && echo " + name + " >> " + runs},
+		}
+	}
+	var (
+		a, b, c = child("a"), child("b"), child("c")
+		rule    = CompositeRule{a, b, c}
+		f       = &Fn{DB: db, Rule: rule}
+	)
+	run := func(want string) {
+		t.Helper()
+		if err := os.RemoveAll(runs); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(runs)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got runs %q, want %q", got, want)
+		}
+	}
+
+	run("a\nb\nc\n")
+	run("")
+
+	// A change in any child's source invalidates the whole composite.
+	for _, child := range rule {
+		writeFile(t, child.(JRule).Sources[0], "changed")
+		run("a\nb\nc\n")
+		run("")
+	}
+
+	sources, err := rule.SourceFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{a.Sources[0], b.Sources[0], c.Sources[0]}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %v, want %v", sources, want)
+	}
+	if bytes.Equal(rule.RuleHash(), (CompositeRule{b, a, c}).RuleHash()) {
+		t.Error("same rule hash for children in a different order")
+	}
+
+	// The first failing child stops the rest.
+	var ran []string
+	record := func(name string, err error) funcRule {
+		return funcRule{name: name, run: func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	failing := CompositeRule{record("x", nil), record("y", errors.New("failed")), record("z", nil)}
+	if err := failing.Run(ctx); err == nil {
+		t.Error("no error from a failing child")
+	}
+	if !reflect.DeepEqual(ran, []string{"x", "y"}) {
+		t.Errorf("got %v run, want [x y]", ran)
+	}
+}
+
+// Run this with -race to check that concurrent members do not share a buffer.
+func TestParallelRuleCapture(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	ctx := context.Background()
+
+	var (
+		rule ParallelRule
+		want string
+	)
+	for i := 0; i < 4; i++ {
+		line := fmt.Sprintf("member %d output", i)
+		rule = append(rule, JRule{
+			Command: []string{"sh", "-c", fmt.Sprintf("for i in 1 2 3; do echo %s; done", line)},
+		})
+		want += strings.Repeat(line+"\n", 3)
+	}
+
+	output, rebuilt, err := (&Fn{DB: NewMemDB(), Rule: rule}).RunCapture(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebuilt {
+		t.Error("got rebuilt false on a miss, want true")
+	}
+	if got := string(output); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestCompositeHashAlgo(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		a    = funcRule{name: "a"}
+		b    = funcRule{name: "b"}
+		cr   = CompositeRule{a, b}
+		pr   = ParallelRule{a, b}
+		want = SHA512.New().Size()
+	)
+	writeFile(t, filepath.Join(dir, ConfigFile), `{"hash_algo": "sha512"}`)
+	useConfig(t, filepath.Join(dir, ConfigFile))
+
+	for _, r := range []Rule{cr, pr} {
+		if got := len(r.RuleHash()); got != want {
+			t.Errorf("got %d-byte rule hash for %s, want %d", got, r, want)
+		}
+		h, err := r.ContentHash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(h); got != want {
+			t.Errorf("got %d-byte content hash for %s, want %d", got, r, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package mghash
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	json "github.com/gibson042/canonicaljson-go"
+	"github.com/magefile/mage/mg"
+	"github.com/pkg/errors"
+)
+
+// ConfigFile is the name of the file holding project-wide defaults.
+// See LoadConfig.
+//
+// Some of its settings (Epoch and HashAlgo) go into the keys under which rules are recorded,
+// so editing the file, or adding or removing it, can make every rule run once.
+const ConfigFile = ".mghashrc"
+
+// Config holds project-wide defaults.
+// Settings made in code take precedence over these.
+type Config struct {
+	// DB is the path of the database that sqlite.Open uses
+	// when not given one explicitly.
+	DB string `json:"db"`
+
+	// Verbose turns on verbose logging,
+	// unless the MAGEFILE_VERBOSE environment variable
+	// (set by mage -v) says otherwise.
+	Verbose bool `json:"verbose"`
+
+	// Epoch is the default for Fn.Epoch.
+	// Changing it changes the key of every Fn relying on the default,
+	// so all of their rules run once.
+	Epoch string `json:"epoch"`
+
+	// Concurrency, if positive, is how many files may be hashed at once,
+	// and how many members of a ParallelRule may run at once.
+	// The default is GOMAXPROCS.
+	Concurrency int `json:"concurrency"`
+
+	// HashAlgo names the default hash algorithm
+	// for JRule.HashAlgo and Fn.HashAlgo:
+	// "sha256" (the default) or "sha512".
+	// Changing it changes the hashes of the rules relying on the default,
+	// so they all run once.
+	HashAlgo string `json:"hash_algo"`
+}
+
+type configResult struct {
+	c   Config
+	err error
+}
+
+var (
+	configMu sync.Mutex
+	configs  = make(map[string]configResult) // by current directory or ConfigEnv setting
+
+	// The defaults for this package, resolved on first use.
+	// See defaults.
+	defaultsOnce   sync.Once
+	defaultsConfig Config
+)
+
+// ConfigEnv is the environment variable that,
+// if set and not empty,
+// names the config file for LoadConfig to read instead of searching for one.
+// The value ConfigOff means to use no config file.
+const ConfigEnv = "MGHASH_CONFIG"
+
+// ConfigOff is the value of ConfigEnv that disables the config file.
+const ConfigOff = "off"
+
+// LoadConfig returns the project-wide defaults,
+// parsed from a JSON object in a file named by ConfigFile.
+// The file is the one named by the ConfigEnv environment variable, if it is set;
+// otherwise it is in the current directory or the nearest ancestor directory having one,
+// searching no higher than the root of the enclosing Go module
+// (the nearest directory with a go.mod file),
+// so that files elsewhere in the filesystem (e.g. the home directory) are not found.
+// As with JDir, the file may contain comments and trailing commas.
+// Relative paths in the file are relative to the file's directory.
+// If there is no such file, the result is the zero Config.
+//
+// The file is read only once for a given current directory and setting of ConfigEnv;
+// later calls return the same result.
+// The defaults that this package applies come from the first such lookup in the process
+// (which happens on first use),
+// so changing the current directory or ConfigEnv afterward does not change them.
+func LoadConfig() (Config, error) {
+	if path := os.Getenv(ConfigEnv); path != "" {
+		if path == ConfigOff {
+			return Config{}, nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "getting absolute path of %s", path)
+		}
+		return cachedConfig(ConfigEnv+"="+abs, func() (Config, error) {
+			return readConfig(abs)
+		})
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return Config{}, errors.Wrap(err, "getting current directory")
+	}
+	return cachedConfig(dir, func() (Config, error) {
+		return loadConfig(dir)
+	})
+}
+
+// cachedConfig returns the result of load,
+// calling it only the first time for the given key.
+func cachedConfig(key string, load func() (Config, error)) (Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	r, ok := configs[key]
+	if !ok {
+		r.c, r.err = load()
+		configs[key] = r
+	}
+	return r.c, r.err
+}
+
+// loadConfig searches dir and its ancestors for a config file,
+// stopping at the module root.
+// See LoadConfig.
+func loadConfig(dir string) (Config, error) {
+	for {
+		path := filepath.Join(dir, ConfigFile)
+		c, err := readConfig(path)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return c, err
+		}
+		if _, err = os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return Config{}, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return Config{}, nil
+		}
+		dir = parent
+	}
+}
+
+// readConfig parses the config file at path.
+// An error for a nonexistent file satisfies errors.Is(err, fs.ErrNotExist).
+func readConfig(path string) (Config, error) {
+	var c Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, errors.Wrapf(err, "reading %s", path)
+	}
+	if data, err = standardizeJSON(data); err != nil {
+		return c, errors.Wrapf(err, "parsing %s", path)
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return c, errors.Wrapf(err, "parsing %s", path)
+	}
+	if c.DB != "" && !filepath.IsAbs(c.DB) {
+		c.DB = filepath.Join(filepath.Dir(path), c.DB)
+	}
+	if _, err = c.hashAlgo(); err != nil {
+		return c, errors.Wrapf(err, "in %s", path)
+	}
+	return c, nil
+}
+
+// hashAlgo returns the HashAlgo named by c.HashAlgo,
+// or nil if it is empty.
+func (c Config) hashAlgo() (*HashAlgo, error) {
+	switch c.HashAlgo {
+	case "":
+		return nil, nil
+	case SHA256.Name:
+		return SHA256, nil
+	case SHA512.Name:
+		return SHA512, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", c.HashAlgo)
+}
+
+// defaults returns the project-wide defaults for use in this package.
+// They are loaded on the first call,
+// so that looking them up,
+// which happens for every hash computed,
+// does not need the current directory or a lock.
+// An error loading them is logged
+// and leaves the zero Config in effect.
+func defaults() Config {
+	defaultsOnce.Do(func() {
+		c, err := LoadConfig()
+		if err != nil {
+			log.Printf("Warning: ignoring config file: %s", err)
+			return
+		}
+		defaultsConfig = c
+	})
+	return defaultsConfig
+}
+
+// defaultHashAlgo returns the HashAlgo named in the config file,
+// or nil (meaning SHA256) if there is none.
+func defaultHashAlgo() *HashAlgo {
+	a, _ := defaults().hashAlgo()
+	return a
+}
+
+// concurrency returns the number of files to hash at once.
+func concurrency() int {
+	if n := defaults().Concurrency; n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// verbose tells whether to log verbosely.
+// The MAGEFILE_VERBOSE environment variable takes precedence over the config file.
+func verbose() bool {
+	if _, ok := os.LookupEnv(mg.VerboseEnv); ok {
+		return mg.Verbose()
+	}
+	return defaults().Verbose
+}
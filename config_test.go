@@ -0,0 +1,171 @@
+package mghash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestMain keeps config files outside the test's control
+// (e.g. in the user's home directory)
+// from affecting the tests.
+// Tests wanting a config file set ConfigEnv to it.
+func TestMain(m *testing.M) {
+	os.Setenv(ConfigEnv, ConfigOff)
+	os.Exit(m.Run())
+}
+
+// useConfig makes the package defaults come from the config file at path
+// for the rest of the test.
+func useConfig(t *testing.T, path string) {
+	t.Helper()
+	t.Setenv(ConfigEnv, path)
+	resetDefaults()
+	t.Cleanup(resetDefaults)
+}
+
+// resetDefaults makes the next call to defaults load them again.
+func resetDefaults() {
+	defaultsOnce = sync.Once{}
+	defaultsConfig = Config{}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		t.Helper()
+		writeFile(t, filepath.Join(dir, ConfigFile), content)
+	}
+
+	write(`{
+		// Comments and trailing commas are allowed.
+		"db": "cache.db",
+		"verbose": true,
+		"epoch": "2",
+		"concurrency": 3,
+		"hash_algo": "sha512",
+	}`)
+	sub := filepath.Join(dir, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{DB: filepath.Join(dir, "cache.db"), Verbose: true, Epoch: "2", Concurrency: 3, HashAlgo: "sha512"}
+	if c != want {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	if a, err := c.hashAlgo(); err != nil {
+		t.Fatal(err)
+	} else if a != SHA512 {
+		t.Errorf("got hash algorithm %v, want SHA512", a)
+	}
+
+	write(`{"hash_algo": "md5"}`)
+	if _, err = loadConfig(dir); err == nil {
+		t.Error("no error for an unknown hash algorithm")
+	}
+
+	write(`{"db": `)
+	if _, err = loadConfig(dir); err == nil {
+		t.Error("no error for malformed JSON")
+	}
+}
+
+func TestLoadConfigLookup(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		module = filepath.Join(dir, "module")
+		sub    = filepath.Join(module, "sub")
+	)
+	writeFile(t, filepath.Join(dir, ConfigFile), `{"epoch": "outside"}`)
+	writeFile(t, filepath.Join(module, "go.mod"), "module example.com/m\n")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The search stops at the module root.
+	c, err := loadConfig(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != (Config{}) {
+		t.Errorf("got %+v from outside the module, want the zero Config", c)
+	}
+
+	writeFile(t, filepath.Join(module, ConfigFile), `{"epoch": "module", "db": "cache.db"}`)
+	if c, err = loadConfig(sub); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Config{Epoch: "module", DB: filepath.Join(module, "cache.db")}); c != want {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	// ConfigEnv names the file explicitly,
+	// or disables it.
+	chdir(t, sub)
+	t.Setenv(ConfigEnv, filepath.Join(dir, ConfigFile))
+	if c, err = LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Epoch != "outside" {
+		t.Errorf("got epoch %q with %s set, want %q", c.Epoch, ConfigEnv, "outside")
+	}
+	t.Setenv(ConfigEnv, ConfigOff)
+	if c, err = LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c != (Config{}) {
+		t.Errorf("got %+v with %s=%s, want the zero Config", c, ConfigEnv, ConfigOff)
+	}
+	t.Setenv(ConfigEnv, filepath.Join(dir, "nonexistent"))
+	if _, err = LoadConfig(); err == nil {
+		t.Errorf("no error for a nonexistent file named by %s", ConfigEnv)
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		db   = NewMemDB()
+		rule = newTestRule("rule", "v1")
+	)
+	run := func(epoch string, wantRuns int) {
+		t.Helper()
+		if err := (&Fn{DB: db, Rule: rule, Epoch: epoch}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if *rule.runs != wantRuns {
+			t.Errorf("got %d runs with epoch %q, want %d", *rule.runs, epoch, wantRuns)
+		}
+	}
+	run("", 1)
+	run("", 1)
+	run("1", 2)
+	run("1", 2)
+	run("2", 3)
+	run("", 3)
+}
+
+func TestDefaultsOnce(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, ConfigFile)
+	)
+	writeFile(t, path, `{"epoch": "1"}`)
+	useConfig(t, path)
+	if got := defaults().Epoch; got != "1" {
+		t.Fatalf("got epoch %q, want %q", got, "1")
+	}
+
+	// Later changes to the file or to ConfigEnv have no effect.
+	writeFile(t, path, `{"epoch": "2"}`)
+	t.Setenv(ConfigEnv, ConfigOff)
+	if got := defaults().Epoch; got != "1" {
+		t.Errorf("got epoch %q after changes, want %q", got, "1")
+	}
+}
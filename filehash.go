@@ -0,0 +1,463 @@
+package mghash
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	json "github.com/gibson042/canonicaljson-go"
+	"github.com/pkg/errors"
+)
+
+// FileHashCache remembers the hashes of files,
+// so that files whose size and modification time are unchanged need not be reread.
+// This trusts that a file's content does not change
+// without changing its size or modification time.
+// (Files modified within the last couple of seconds are not cached,
+// since their modification times may not yet reflect later changes.)
+// See JRule.FileHashCache.
+type FileHashCache interface {
+	// FileHash returns the hash recorded for the file version described by key,
+	// or nil if there is none.
+	FileHash(context.Context, FileKey) ([]byte, error)
+
+	// SetFileHash records the hash of the file version described by key.
+	SetFileHash(context.Context, FileKey, []byte) error
+}
+
+// FileKey describes a version of a file for FileHashCache.
+type FileKey struct {
+	// Path is the absolute path of the file.
+	Path string
+
+	// Mode distinguishes different ways of hashing the same file,
+	// e.g. in text mode (see JRule.TextFiles).
+	Mode string
+
+	Size    int64
+	ModTime time.Time
+}
+
+// Limiter limits the rate of some operation.
+// See JRule.Limiter.
+type Limiter interface {
+	// Wait blocks until the operation may proceed,
+	// or until ctx is canceled.
+	Wait(ctx context.Context) error
+}
+
+// fileHasher computes the hashes of files.
+type fileHasher struct {
+	mmapThreshold int64
+
+	// Files whose base names match one of these patterns
+	// are hashed in text mode.
+	// See JRule.TextFiles.
+	textFiles          []string
+	ignoreFinalNewline bool
+
+	// If set, files that look binary are never hashed in text mode.
+	// See JRule.DetectText.
+	detectText bool
+
+	// If set, dirHasher hashes directories
+	// in place of fileHasher.hashDir.
+	dirHasher func(context.Context, string) ([]byte, error)
+
+	// If set, cache remembers file hashes across runs.
+	cache FileHashCache
+
+	// If set, limiter is waited on before each file is read.
+	limiter Limiter
+
+	// The hash algorithm, or nil for SHA256.
+	algo *HashAlgo
+
+	// If set, files it ignores are skipped by hashDir.
+	// See JRule.Ignore.
+	ignore *ignorer
+
+	// If set, hashDir also honors .gitignore files.
+	// See JRule.GitIgnore.
+	gitIgnore bool
+
+	// This fetches and hashes URL sources.
+	fetcher urlFetcher
+
+	// How to hash symbolic links.
+	// See JRule.Symlinks.
+	symlinks SymlinkMode
+
+	// The real paths of the directories hashDir is already hashing,
+	// for detecting symbolic link cycles.
+	walking []string
+}
+
+// fill places the hashes of files in hashes.
+// It hashes files concurrently
+// (as many at once as Config.Concurrency allows),
+// so that reading one file can overlap with hashing another.
+// The resulting map does not depend on the order in which the hashes finish.
+func (fh fileHasher) fill(ctx context.Context, files []string, hashes map[string][]byte) error {
+	var (
+		results = make([][]byte, len(files))
+		errs    = make([]error, len(files))
+		sem     = make(chan struct{}, concurrency())
+		wg      sync.WaitGroup
+	)
+	for i, file := range files {
+		i, file := i, file
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = fh.hashPath(ctx, file)
+		}()
+	}
+	wg.Wait()
+
+	for i, file := range files {
+		h, err := results[i], errs[i]
+		if errors.Is(err, fs.ErrNotExist) {
+			h = nil
+		} else if err != nil {
+			return errors.Wrapf(err, "computing hash of %s", file)
+		}
+		hashes[file] = h
+	}
+	return nil
+}
+
+// hashPath hashes the file or directory at path,
+// or the resource at path if it is a URL.
+func (fh fileHasher) hashPath(ctx context.Context, path string) ([]byte, error) {
+	if isURL(path) {
+		return fh.fetcher.hash(ctx, path)
+	}
+	if fh.symlinks != SymlinksFollow {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return fh.hashSymlink(ctx, path, fh.hashFollowed)
+		}
+	}
+	return fh.hashFollowed(ctx, path)
+}
+
+// hashFollowed hashes the file or directory at path,
+// following symbolic links.
+func (fh fileHasher) hashFollowed(ctx context.Context, path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "statting %s", path)
+	}
+	if !info.IsDir() {
+		return fh.hashFile(ctx, path)
+	}
+	if fh.dirHasher != nil {
+		return fh.dirHasher(ctx, path)
+	}
+	return fh.hashDir(ctx, path)
+}
+
+// hashDir hashes the tree rooted at dir.
+// The hash covers the relative path and content hash of each file in the tree,
+// so adding, removing, renaming, or changing any file changes the hash.
+// Files and subdirectories that fh.ignore ignores are skipped,
+// as are those ignored by .gitignore files if fh.gitIgnore is set.
+// A symbolic link to a directory within the tree
+// is hashed like the directory it points to
+// (subject to fh.symlinks).
+func (fh fileHasher) hashDir(ctx context.Context, dir string) ([]byte, error) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", dir)
+	}
+	for _, w := range fh.walking {
+		if w == real {
+			return nil, fmt.Errorf("symbolic link cycle at %s", dir)
+		}
+	}
+	fh.walking = append(fh.walking[:len(fh.walking):len(fh.walking)], real)
+
+	var (
+		hashes = make(map[string][]byte)
+		ig     = fh.ignore
+	)
+	if fh.gitIgnore {
+		ig = ig.clone()
+	}
+	// Walk the resolved directory,
+	// since WalkDir does not descend into a root that is a symbolic link.
+	err = filepath.WalkDir(real, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(real, path)
+		if err != nil {
+			return errors.Wrapf(err, "computing relative path of %s", path)
+		}
+		rel = filepath.ToSlash(rel)
+		if path != real && ig.ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if fh.gitIgnore {
+				base := rel
+				if path == real {
+					base = ""
+				}
+				err := ig.addFile(base, filepath.Join(path, ".gitignore"))
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+			}
+			return nil
+		}
+		var h []byte
+		switch {
+		case d.Type()&fs.ModeSymlink == 0:
+			h, err = fh.hashFile(ctx, path)
+		case fh.symlinks == SymlinksFollow:
+			h, err = fh.hashFollowed(ctx, path)
+		default:
+			h, err = fh.hashSymlink(ctx, path, fh.hashFollowed)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// E.g. a dangling symlink.
+			h = nil
+		} else if err != nil {
+			return err
+		}
+		hashes[rel] = h
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walking %s", dir)
+	}
+	j, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, errors.Wrap(err, "in JSON marshaling")
+	}
+	return domainHash(fh.algo, dirHashDomain, j), nil
+}
+
+const dirHashDomain = "mghash.dir"
+
+// SymlinkMode is the type of JRule.Symlinks.
+type SymlinkMode string
+
+const (
+	// SymlinksFollow hashes what a symbolic link points to,
+	// as if it were not a link (the default).
+	// A dangling link is hashed like a missing file.
+	SymlinksFollow SymlinkMode = ""
+
+	// SymlinksLink hashes the destination path of a symbolic link
+	// (as returned by os.Readlink)
+	// instead of what it points to.
+	// The link need not point to anything that exists.
+	SymlinksLink SymlinkMode = "link"
+
+	// SymlinksBoth hashes the destination path of a symbolic link
+	// together with what it points to.
+	SymlinksBoth SymlinkMode = "both"
+)
+
+// hashSymlink hashes the symbolic link at path,
+// according to fh.symlinks,
+// using content to hash what it points to if needed.
+func (fh fileHasher) hashSymlink(ctx context.Context, path string, content func(context.Context, string) ([]byte, error)) ([]byte, error) {
+	dest, err := os.Readlink(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading link %s", path)
+	}
+	s := struct {
+		Link    string `json:"link"`
+		Content []byte `json:"content,omitempty"`
+	}{
+		Link: dest,
+	}
+	if fh.symlinks == SymlinksBoth {
+		s.Content, err = content(ctx, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.Content = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	j, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "in JSON marshaling")
+	}
+	return domainHash(fh.algo, symlinkHashDomain, j), nil
+}
+
+const symlinkHashDomain = "mghash.symlink"
+
+// hashFile hashes the file at path,
+// consulting and updating fh.cache if there is one.
+// Files modified within racyWindow of now are not cached.
+func (fh fileHasher) hashFile(ctx context.Context, path string) ([]byte, error) {
+	if fh.cache == nil {
+		return fh.readFile(ctx, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "statting %s", path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting absolute path of %s", path)
+	}
+	key := FileKey{
+		Path:    abs,
+		Mode:    fh.mode(path),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	h, err := fh.cache.FileHash(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "consulting file hash cache for %s", path)
+	}
+	if h != nil {
+		return h, nil
+	}
+	if h, err = fh.readFile(ctx, path); err != nil {
+		return nil, err
+	}
+	if time.Since(key.ModTime) < racyWindow {
+		// The file may change again without changing its modification time
+		// (see racyWindow),
+		// so its hash cannot be trusted to describe key later.
+		return h, nil
+	}
+	if err = fh.cache.SetFileHash(ctx, key, h); err != nil {
+		return nil, errors.Wrapf(err, "updating file hash cache for %s", path)
+	}
+	return h, nil
+}
+
+// racyWindow is how old a file's modification time must be
+// for hashFile to cache its hash.
+// A file modified more recently than this
+// could be modified again within the same timestamp granularity
+// (as coarse as two seconds on some filesystems)
+// with no change to its size or modification time,
+// which would make the cached hash wrong.
+// This is the "racy clean" problem described in git's documentation.
+const racyWindow = 2 * time.Second
+
+// mode describes how fh hashes the file at path,
+// for use in a FileKey.
+func (fh fileHasher) mode(path string) string {
+	var mode string
+	if fh.isText(path) {
+		mode = "text"
+		if fh.detectText {
+			mode = "autotext"
+		}
+		if fh.ignoreFinalNewline {
+			mode += "-nofinalnl"
+		}
+	}
+	if tag := fh.algo.tag(); tag != "" {
+		if mode == "" {
+			return tag
+		}
+		mode += "-" + tag
+	}
+	return mode
+}
+
+// readFile reads the file at path and computes its hash.
+func (fh fileHasher) readFile(ctx context.Context, path string) ([]byte, error) {
+	if fh.limiter != nil {
+		if err := fh.limiter.Wait(ctx); err != nil {
+			return nil, errors.Wrapf(err, "waiting to read %s", path)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+
+	text := fh.isText(path)
+	if text && fh.detectText {
+		if text, err = looksLikeText(f); err != nil {
+			return nil, errors.Wrapf(err, "examining %s", path)
+		}
+	}
+
+	var (
+		hasher           = fh.algo.newHash()
+		w      io.Writer = hasher
+	)
+	if text {
+		w = &textNormalizer{w: hasher, ignoreFinalNewline: fh.ignoreFinalNewline}
+	}
+
+	if fh.mmapThreshold > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, errors.Wrapf(err, "statting %s", path)
+		}
+		if size := info.Size(); size > 0 && size >= fh.mmapThreshold {
+			ok, err := hashMapped(w, f, size)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hashing %s", path)
+			}
+			if ok {
+				return fh.sum(hasher, w), nil
+			}
+		}
+	}
+
+	// A larger buffer than io.Copy's default does not help here:
+	// hashing, not reading, is the bottleneck for a single file.
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "hashing %s", path)
+	}
+	return fh.sum(hasher, w), nil
+}
+
+// sum flushes w, if needed, and returns the sum of hasher.
+func (fh fileHasher) sum(hasher hash.Hash, w io.Writer) []byte {
+	if tn, ok := w.(*textNormalizer); ok {
+		tn.Close()
+	}
+	return hasher.Sum(nil)
+}
+
+// isText tells whether path is a candidate for hashing in text mode.
+// With fh.detectText,
+// the file's content must also pass looksLikeText.
+func (fh fileHasher) isText(path string) bool {
+	if fh.detectText && len(fh.textFiles) == 0 {
+		return true
+	}
+	base := filepath.Base(path)
+	for _, pattern := range fh.textFiles {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,546 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFill(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		files = writeRandomFiles(t, dir, 20, 100000)
+	)
+	files = append(files, filepath.Join(dir, "nonexistent"))
+
+	hashes := make(map[string][]byte)
+	if err := (fileHasher{}).fill(ctx, files, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(files) {
+		t.Fatalf("got %d hashes, want %d", len(hashes), len(files))
+	}
+
+	// Concurrent hashing must produce the same bytes
+	// as reading and digesting each file in turn.
+	for _, file := range files {
+		var want []byte
+		if data, err := os.ReadFile(file); err == nil {
+			sum := sha256.Sum256(data)
+			want = sum[:]
+		} else if !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if got := hashes[file]; !bytes.Equal(got, want) {
+			t.Errorf("hash of %s is %x, want %x", file, got, want)
+		}
+	}
+}
+
+// BenchmarkFill compares hashing a rule's files one at a time
+// (as before fill hashed them concurrently)
+// with fill.
+func BenchmarkFill(b *testing.B) {
+	var (
+		ctx   = context.Background()
+		files = writeRandomFiles(b, b.TempDir(), 16, 4<<20)
+		fh    fileHasher
+	)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hashes := make(map[string][]byte)
+			for _, file := range files {
+				h, err := fh.hashPath(ctx, file)
+				if err != nil {
+					b.Fatal(err)
+				}
+				hashes[file] = h
+			}
+		}
+	})
+
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := fh.fill(ctx, files, make(map[string][]byte)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// writeRandomFiles writes n files of random content of the given size in dir,
+// returning their paths.
+func writeRandomFiles(tb testing.TB, dir string, n, size int) []string {
+	tb.Helper()
+	var (
+		rnd    = rand.New(rand.NewSource(1))
+		buf    = make([]byte, size)
+		result []string
+	)
+	for i := 0; i < n; i++ {
+		rnd.Read(buf)
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(path, buf, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		result = append(result, path)
+	}
+	return result
+}
+
+func TestMmap(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		size      int
+		threshold int64
+	}{
+		{size: 0, threshold: 1},
+		{size: 100, threshold: 1},
+		{size: 100, threshold: 1000},
+		{size: 3<<20 + 7, threshold: 1},
+		{size: 3<<20 + 7, threshold: 1 << 20},
+	}
+	for _, c := range cases {
+		path := writeRandomFiles(t, t.TempDir(), 1, c.size)[0]
+		want, err := fileHasher{}.hashFile(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fileHasher{mmapThreshold: c.threshold}.hashFile(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got hash %x for a %d-byte file with threshold %d, want %x", got, c.size, c.threshold, want)
+		}
+	}
+}
+
+// BenchmarkMmap compares streaming a file into the hash
+// with memory-mapping it,
+// for a range of file sizes.
+func BenchmarkMmap(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range []int{64 << 10, 1 << 20, 64 << 20} {
+		path := writeRandomFiles(b, b.TempDir(), 1, size)[0]
+		for _, c := range []struct {
+			name string
+			fh   fileHasher
+		}{
+			{name: "stream", fh: fileHasher{}},
+			{name: "mmap", fh: fileHasher{mmapThreshold: 1}},
+		} {
+			b.Run(fmt.Sprintf("%s-%dKiB", c.name, size>>10), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, err := c.fh.hashFile(ctx, path); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTextMode(t *testing.T) {
+	var (
+		ctx = context.Background()
+		txt = fileHasher{textFiles: []string{"*.txt"}}
+		nl  = fileHasher{textFiles: []string{"*.txt"}, ignoreFinalNewline: true}
+	)
+	cases := []struct {
+		fh        fileHasher
+		name      string
+		a, b      string
+		wantEqual bool
+	}{
+		{fh: txt, name: "x.txt", a: "x\ny\n", b: "x\r\ny\r\n", wantEqual: true},
+		{fh: txt, name: "x.txt", a: "x\ny\n", b: "x\r\ny\n", wantEqual: true},
+		{fh: txt, name: "x.txt", a: "x\n\ry\n", b: "x\r\n\ry\r\n", wantEqual: true},
+		{fh: txt, name: "x.txt", a: "x\ny", b: "x\ry", wantEqual: false},
+		{fh: txt, name: "x.txt", a: "x\ny\n", b: "x\ny", wantEqual: false},
+		{fh: nl, name: "x.txt", a: "x\ny\n", b: "x\ny", wantEqual: true},
+		{fh: nl, name: "x.txt", a: "x\r\ny\r\n", b: "x\ny", wantEqual: true},
+		{fh: nl, name: "x.txt", a: "x\ny\n\n", b: "x\ny", wantEqual: false},
+		{fh: txt, name: "x.bin", a: "x\ny\n", b: "x\r\ny\r\n", wantEqual: false},
+		{fh: fileHasher{}, name: "x.txt", a: "x\ny\n", b: "x\r\ny\r\n", wantEqual: false},
+	}
+	for _, c := range cases {
+		for _, threshold := range []int64{0, 1} {
+			var (
+				fh = c.fh
+				a  = filepath.Join(t.TempDir(), c.name)
+				b  = filepath.Join(t.TempDir(), c.name)
+			)
+			fh.mmapThreshold = threshold
+			writeFile(t, a, c.a)
+			writeFile(t, b, c.b)
+			ha, err := fh.hashFile(ctx, a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hb, err := fh.hashFile(ctx, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Equal(ha, hb); got != c.wantEqual {
+				t.Errorf("%+v: hashes of %q and %q equal is %v, want %v", fh, c.a, c.b, got, c.wantEqual)
+			}
+		}
+	}
+
+	// Text mode is the same as binary mode for LF-only files,
+	// so enabling it does not change existing hashes.
+	path := filepath.Join(t.TempDir(), "x.txt")
+	writeFile(t, path, "x\ny\n")
+	raw, err := fileHasher{}.hashFile(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := txt.hashFile(ctx, path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(h, raw) {
+		t.Error("text mode changed the hash of an LF-only file")
+	}
+}
+
+// countingLimiter is a Limiter counting its Waits.
+type countingLimiter struct {
+	mu    sync.Mutex
+	waits int
+	err   error
+}
+
+func (l *countingLimiter) Wait(context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waits++
+	return l.err
+}
+
+func TestLimiter(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		files = writeRandomFiles(t, dir, 5, 100)
+		sub   = filepath.Join(dir, "sub")
+	)
+	writeFile(t, filepath.Join(sub, "x"), "x")
+	writeFile(t, filepath.Join(sub, "y"), "y")
+
+	l := &countingLimiter{}
+	rule := JRule{Sources: append(files, sub), Command: []string{"true"}, Limiter: l}
+	h := contentHash(ctx, t, rule)
+
+	// Each file is read once, including those in directories.
+	if l.waits != 7 {
+		t.Errorf("got %d waits, want 7", l.waits)
+	}
+
+	// The limiter does not affect the hash.
+	rule.Limiter = nil
+	if got := contentHash(ctx, t, rule); !bytes.Equal(got, h) {
+		t.Error("content hash changed by the limiter")
+	}
+
+	// A limiter's error stops hashing.
+	rule.Limiter = &countingLimiter{err: context.DeadlineExceeded}
+	if _, err := rule.ContentHash(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDetectText(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		detect = fileHasher{detectText: true}
+		txt    = fileHasher{textFiles: []string{"*.txt"}, detectText: true}
+		// Following 6 bytes of text, these put a NUL byte
+		// at the end of the examined prefix and just past it.
+		early = strings.Repeat("x", 7993) + "\x00"
+		late  = strings.Repeat("x", 8000) + "\x00"
+	)
+	cases := []struct {
+		fh         fileHasher
+		name       string
+		content    string
+		wantNormal bool
+	}{
+		{fh: detect, name: "x.bin", content: "x\r\ny\r\n", wantNormal: true},
+		{fh: detect, name: "x.bin", content: "\x00x\r\ny\r\n", wantNormal: false},
+		{fh: txt, name: "x.txt", content: "x\r\ny\r\n", wantNormal: true},
+		{fh: txt, name: "x.txt", content: "x\r\n\x00y\r\n", wantNormal: false},
+		{fh: txt, name: "x.bin", content: "x\r\ny\r\n", wantNormal: false},
+
+		// Only a prefix of the file is examined.
+		{fh: detect, name: "x.bin", content: "x\r\ny\r\n" + early, wantNormal: false},
+		{fh: detect, name: "x.bin", content: "x\r\ny\r\n" + late[6:], wantNormal: true},
+	}
+	for i, c := range cases {
+		for _, threshold := range []int64{0, 1} {
+			fh := c.fh
+			fh.mmapThreshold = threshold
+
+			path := filepath.Join(t.TempDir(), c.name)
+			writeFile(t, path, c.content)
+			got, err := fh.hashFile(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Compare with the raw hash of the content, normalized or not.
+			want := c.content
+			if c.wantNormal {
+				want = strings.ReplaceAll(want, "\r\n", "\n")
+			}
+			wantPath := filepath.Join(t.TempDir(), c.name)
+			writeFile(t, wantPath, want)
+			wantHash, err := fileHasher{}.hashFile(ctx, wantPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, wantHash) {
+				t.Errorf("case %d, mmap threshold %d: got normalized %v, want %v", i, threshold, !c.wantNormal, c.wantNormal)
+			}
+		}
+	}
+}
+
+// memFileHashCache is a FileHashCache in memory.
+type memFileHashCache map[FileKey][]byte
+
+func (c memFileHashCache) FileHash(_ context.Context, key FileKey) ([]byte, error) {
+	return c[key], nil
+}
+
+func (c memFileHashCache) SetFileHash(_ context.Context, key FileKey, h []byte) error {
+	c[key] = h
+	return nil
+}
+
+func TestFileHashCache(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		src   = filepath.Join(t.TempDir(), "src.txt")
+		mtime = time.Unix(1600000000, 0)
+		cache = make(memFileHashCache)
+	)
+	write := func(content string, mtime time.Time) {
+		t.Helper()
+		writeFile(t, src, content)
+		if err := os.Chtimes(src, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// hash reports the hash of src and whether it was read to compute it.
+	// The limiter counts reads.
+	hash := func(textFiles ...string) ([]byte, bool) {
+		t.Helper()
+		l := &countingLimiter{}
+		rule := JRule{Sources: []string{src}, Command: []string{"gen"}, FileHashCache: cache, Limiter: l, TextFiles: textFiles}
+		return contentHash(ctx, t, rule), l.waits > 0
+	}
+
+	write("aaaa", mtime)
+	h1, read := hash()
+	if !read {
+		t.Error("file not read with an empty cache")
+	}
+
+	// Different content with the same size and modification time
+	// is not seen.
+	write("bbbb", mtime)
+	if h, read := hash(); read || !bytes.Equal(h, h1) {
+		t.Errorf("got read %v, same hash %v for unchanged stats, want false and true", read, bytes.Equal(h, h1))
+	}
+
+	cases := []struct {
+		content   string
+		mtime     time.Time
+		textFiles []string
+	}{
+		{content: "bbbb", mtime: mtime.Add(time.Nanosecond)},
+		{content: "bbbbb", mtime: mtime.Add(time.Nanosecond)},
+		{content: "bbbbb", mtime: mtime.Add(time.Nanosecond), textFiles: []string{"*.txt"}},
+	}
+	for i, c := range cases {
+		write(c.content, c.mtime)
+		if _, read := hash(c.textFiles...); !read {
+			t.Errorf("case %d: file not reread", i)
+		}
+		if _, read := hash(c.textFiles...); read {
+			t.Errorf("case %d: file reread despite a fresh cache entry", i)
+		}
+	}
+}
+
+func TestFileHashCacheRacy(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		src   = filepath.Join(t.TempDir(), "src")
+		cache = make(memFileHashCache)
+		rule  = JRule{Sources: []string{src}, Command: []string{"gen"}, FileHashCache: cache}
+	)
+	// A file just written may be rewritten with the same size
+	// before its modification time changes.
+	writeFile(t, src, "aaaa")
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1 := contentHash(ctx, t, rule)
+	if len(cache) != 0 {
+		t.Errorf("got %d cache entries for a recently modified file, want 0", len(cache))
+	}
+	writeFile(t, src, "bbbb")
+	if err = os.Chtimes(src, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if h2 := contentHash(ctx, t, rule); bytes.Equal(h1, h2) {
+		t.Error("content hash unchanged after rewriting a recently modified file")
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	ctx := context.Background()
+
+	// Each step changes the files,
+	// and changed tells whether each mode's hash changes as a result.
+	type step struct {
+		desc    string
+		do      func(t *testing.T, dir string)
+		changed map[SymlinkMode]bool
+	}
+	relink := func(dest string) func(*testing.T, string) {
+		return func(t *testing.T, dir string) {
+			link := filepath.Join(dir, "tree", "link")
+			if err := os.Remove(link); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(dest, link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	steps := []step{{
+		desc:    "pointing the link at an identical file",
+		do:      relink("../b"),
+		changed: map[SymlinkMode]bool{SymlinksFollow: false, SymlinksLink: true, SymlinksBoth: true},
+	}, {
+		desc: "changing the link's destination file",
+		do: func(t *testing.T, dir string) {
+			writeFile(t, filepath.Join(dir, "b"), "changed")
+		},
+		changed: map[SymlinkMode]bool{SymlinksFollow: true, SymlinksLink: false, SymlinksBoth: true},
+	}, {
+		desc:    "making the link dangle",
+		do:      relink("../nonexistent"),
+		changed: map[SymlinkMode]bool{SymlinksFollow: true, SymlinksLink: true, SymlinksBoth: true},
+	}, {
+		desc:    "pointing the dangling link elsewhere",
+		do:      relink("../nonexistent2"),
+		changed: map[SymlinkMode]bool{SymlinksFollow: false, SymlinksLink: true, SymlinksBoth: true},
+	}, {
+		desc: "creating the dangling link's destination",
+		do: func(t *testing.T, dir string) {
+			writeFile(t, filepath.Join(dir, "nonexistent2"), "changed")
+		},
+		changed: map[SymlinkMode]bool{SymlinksFollow: true, SymlinksLink: false, SymlinksBoth: true},
+	}}
+
+	for _, mode := range []SymlinkMode{SymlinksFollow, SymlinksLink, SymlinksBoth} {
+		// The link is a source by itself and within a directory source,
+		// which contains only the link.
+		for _, inDir := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%q/inDir=%v", mode, inDir), func(t *testing.T) {
+				dir := t.TempDir()
+				writeFile(t, filepath.Join(dir, "a"), "same")
+				writeFile(t, filepath.Join(dir, "b"), "same")
+				if err := os.MkdirAll(filepath.Join(dir, "tree"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				src := filepath.Join(dir, "tree", "link")
+				if err := os.Symlink("../a", src); err != nil {
+					t.Fatal(err)
+				}
+				if inDir {
+					src = filepath.Dir(src)
+				}
+				var (
+					rule   = JRule{Sources: []string{src}, Command: []string{"gen"}, Symlinks: mode}
+					before = contentHash(ctx, t, rule)
+				)
+				for _, s := range steps {
+					s.do(t, dir)
+					after := contentHash(ctx, t, rule)
+					if changed := !bytes.Equal(before, after); changed != s.changed[mode] {
+						t.Errorf("%s: got changed %v, want %v", s.desc, changed, s.changed[mode])
+					}
+					before = after
+				}
+			})
+		}
+	}
+
+	// The mode is part of the rule hash.
+	var (
+		follow = JRule{Sources: []string{"link"}, Command: []string{"gen"}}
+		link   = JRule{Sources: []string{"link"}, Command: []string{"gen"}, Symlinks: SymlinksLink}
+	)
+	if bytes.Equal(follow.RuleHash(), link.RuleHash()) {
+		t.Error("same rule hash for different symlink modes")
+	}
+
+	bad := JRule{Sources: []string{"link"}, Command: []string{"gen"}, Symlinks: "bogus"}
+	if _, err := bad.ContentHash(ctx); err == nil {
+		t.Error("no error for an unknown symlink mode")
+	}
+}
+
+func TestSymlinkToDir(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "tree", "sub", "file"), "content")
+	if err := os.Symlink("sub", filepath.Join(dir, "tree", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []SymlinkMode{SymlinksFollow, SymlinksLink, SymlinksBoth} {
+		t.Run(string(mode), func(t *testing.T) {
+			rule := JRule{Sources: []string{filepath.Join(dir, "tree")}, Command: []string{"gen"}, Symlinks: mode}
+			before := contentHash(ctx, t, rule)
+
+			// Every mode sees the change in sub itself,
+			// and Follow and Both also see it through the link.
+			writeFile(t, filepath.Join(dir, "tree", "sub", "file"), "changed "+string(mode))
+			if after := contentHash(ctx, t, rule); bytes.Equal(before, after) {
+				t.Error("hash unchanged after changing the linked directory")
+			}
+		})
+	}
+
+	// A link to an enclosing directory is an error when followed.
+	if err := os.Symlink("..", filepath.Join(dir, "tree", "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+	rule := JRule{Sources: []string{filepath.Join(dir, "tree")}, Command: []string{"gen"}}
+	if _, err := rule.ContentHash(ctx); err == nil {
+		t.Error("no error for a symbolic link cycle")
+	}
+	rule.Symlinks = SymlinksLink
+	if _, err := rule.ContentHash(ctx); err != nil {
+		t.Errorf("error for a symbolic link cycle that is not followed: %s", err)
+	}
+}
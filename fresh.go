@@ -0,0 +1,24 @@
+package mghash
+
+import "context"
+
+// FreshRule is a Freshener that wraps another Rule.
+// Its up-to-dateness is decided by FreshnessFunc
+// rather than by the content hash of the wrapped rule.
+type FreshRule struct {
+	Rule
+
+	// FreshnessFunc reports whether Rule is up to date.
+	// If it is nil, Rule is never up to date.
+	FreshnessFunc func(context.Context) (bool, error)
+}
+
+var _ Freshener = FreshRule{}
+
+// Fresh implements Freshener.
+func (fr FreshRule) Fresh(ctx context.Context) (bool, error) {
+	if fr.FreshnessFunc == nil {
+		return false, nil
+	}
+	return fr.FreshnessFunc(ctx)
+}
@@ -0,0 +1,103 @@
+package mghash
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isGlob tells whether path contains glob metacharacters.
+// A URL is never a glob pattern,
+// since ? may begin its query string.
+func isGlob(path string) bool {
+	return !isURL(path) && strings.ContainsAny(path, "*?[")
+}
+
+// globs returns the glob patterns in paths, sorted.
+func globs(paths []string) []string {
+	var result []string
+	for _, path := range paths {
+		if isGlob(path) {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// expandGlobs returns paths with each glob pattern
+// replaced by the files matching it, in sorted order.
+// A pattern matching nothing contributes nothing.
+// Each file appears in the result once.
+// Matches that ig ignores, if ig is not nil, are omitted
+// (see filterIgnored).
+func expandGlobs(paths []string, ig *ignorer) ([]string, error) {
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			result = append(result, path)
+		}
+	}
+	for _, path := range paths {
+		if !isGlob(path) {
+			add(path)
+			continue
+		}
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "expanding %s", path)
+		}
+		if matches, err = filterIgnored(ig, matches); err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+	return result, nil
+}
+
+// sources returns jr.Sources with glob patterns expanded,
+// omitting matches that jr.Ignore ignores.
+func (jr JRule) sources() ([]string, error) {
+	ig, err := jr.ignorer()
+	if err != nil {
+		return nil, err
+	}
+	return expandGlobs(jr.Sources, ig)
+}
+
+// targets returns jr.declaredTargets() with glob patterns expanded.
+func (jr JRule) targets() ([]string, error) {
+	return expandGlobs(jr.declaredTargets(), nil)
+}
+
+// declaredTargets returns jr.Targets
+// plus jr.StdoutFile and jr.StderrFile, if set and not already present.
+func (jr JRule) declaredTargets() []string {
+	if jr.StdoutFile == "" && jr.StderrFile == "" {
+		return jr.Targets
+	}
+	result := append([]string{}, jr.Targets...)
+	for _, file := range []string{jr.StdoutFile, jr.StderrFile} {
+		if file != "" && !hasString(result, file) {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+func hasString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	json "github.com/gibson042/canonicaljson-go"
+	"github.com/pkg/errors"
+)
+
+type goBuildCmd struct {
+	name    string
+	tags    []string
+	ldflags string
+	goos    string
+	goarch  string
+	args    []string
+}
+
+// GoBuild produces a Rule for compiling the Go package pkg
+// to the binary output.
+// The rule's sources are discovered with "go list -deps":
+// the Go files (and any cgo or embedded files) of pkg
+// and of the packages it imports from the main module
+// (or from modules replaced by local directories),
+// plus the main module's go.mod and go.sum.
+// Other dependencies are covered by go.mod and go.sum.
+// Sources inside the current directory are given relative paths,
+// so the rule's hashes do not depend on where the tree is checked out.
+//
+// The build parameters set by options
+// (tags, ldflags, GOOS, and GOARCH)
+// are part of the rule's command or environment,
+// and so of its hashes.
+func GoBuild(pkg, output string, options ...GoBuildOpt) (Rule, error) {
+	cmd := goBuildCmd{name: "go"}
+	for _, opt := range options {
+		opt(&cmd)
+	}
+	sort.Strings(cmd.tags)
+
+	var env []string
+	if cmd.goos != "" {
+		env = append(env, "GOOS="+cmd.goos)
+	}
+	if cmd.goarch != "" {
+		env = append(env, "GOARCH="+cmd.goarch)
+	}
+
+	var flags []string
+	if len(cmd.tags) > 0 {
+		flags = append(flags, "-tags", strings.Join(cmd.tags, ","))
+	}
+	if cmd.ldflags != "" {
+		flags = append(flags, "-ldflags", cmd.ldflags)
+	}
+
+	sources, err := cmd.sources(context.Background(), pkg, flags, env)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding sources of %s", pkg)
+	}
+
+	command := []string{cmd.name, "build", "-o", output}
+	command = append(command, flags...)
+	command = append(command, cmd.args...)
+	command = append(command, pkg)
+
+	return JRule{
+		Sources: sources,
+		Targets: []string{output},
+		Command: command,
+		Env:     env,
+	}, nil
+}
+
+// goListPackage is the subset of the output of "go list -json" that GoBuild uses.
+type goListPackage struct {
+	Dir        string
+	Standard   bool
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	HFiles     []string
+	EmbedFiles []string
+	Module     *struct {
+		Main    bool
+		GoMod   string
+		Replace *struct {
+			Version string
+		}
+	}
+}
+
+func (cmd goBuildCmd) sources(ctx context.Context, pkg string, flags, env []string) ([]string, error) {
+	args := append([]string{"list", "-deps", "-json"}, flags...)
+	args = append(args, pkg)
+
+	list := exec.CommandContext(ctx, cmd.name, args...)
+	if len(env) > 0 {
+		list.Env = append(os.Environ(), env...)
+	}
+	var stderr bytes.Buffer
+	list.Stderr = &stderr
+	out, err := list.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "running go list: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting current directory")
+	}
+	var (
+		result []string
+		seen   = make(map[string]bool)
+		dec    = json.NewDecoder(bytes.NewReader(out))
+	)
+	add := func(path string) {
+		if rel, err := filepath.Rel(cwd, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			path = rel
+		}
+		if !seen[path] {
+			seen[path] = true
+			result = append(result, path)
+		}
+	}
+	for dec.More() {
+		var p goListPackage
+		if err = dec.Decode(&p); err != nil {
+			return nil, errors.Wrap(err, "parsing go list output")
+		}
+		if p.Standard || p.Module == nil {
+			continue
+		}
+		local := p.Module.Main || (p.Module.Replace != nil && p.Module.Replace.Version == "")
+		if !local {
+			continue
+		}
+		if p.Module.Main && p.Module.GoMod != "" {
+			add(p.Module.GoMod)
+			gosum := filepath.Join(filepath.Dir(p.Module.GoMod), "go.sum")
+			if _, err := os.Stat(gosum); err == nil {
+				add(gosum)
+			}
+		}
+		for _, files := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.HFiles, p.EmbedFiles} {
+			for _, file := range files {
+				add(filepath.Join(p.Dir, file))
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// GoBuildOpt is the type of an option that can be passed to GoBuild.
+type GoBuildOpt func(*goBuildCmd)
+
+// GoCommand is a GoBuildOpt that sets the name of the go command.
+// The default is "go".
+func GoCommand(name string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.name = name
+	}
+}
+
+// GoTags is a GoBuildOpt that adds build tags,
+// producing a -tags flag.
+func GoTags(tags ...string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.tags = append(cmdptr.tags, tags...)
+	}
+}
+
+// GoLdflags is a GoBuildOpt that sets the -ldflags flag.
+func GoLdflags(flags string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.ldflags = flags
+	}
+}
+
+// GoOS is a GoBuildOpt that sets GOOS for the build.
+func GoOS(goos string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.goos = goos
+	}
+}
+
+// GoArch is a GoBuildOpt that sets GOARCH for the build.
+func GoArch(goarch string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.goarch = goarch
+	}
+}
+
+// GoBuildArgs is a GoBuildOpt that adds arbitrary arguments to the go build command,
+// placed before the package.
+func GoBuildArgs(args ...string) GoBuildOpt {
+	return func(cmdptr *goBuildCmd) {
+		cmdptr.args = append(cmdptr.args, args...)
+	}
+}
@@ -0,0 +1,70 @@
+package mghash
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGoBuild(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/m\n\ngo 1.18\n")
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n\nimport _ \"example.com/m/sub\"\n\nfunc main() {}\n")
+	writeFile(t, filepath.Join(dir, "main_test.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "extra.go"), "//go:build extra\n\npackage main\n")
+	writeFile(t, filepath.Join(dir, "win_windows.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "sub", "sub.go"), "package sub\n")
+	writeFile(t, filepath.Join(dir, "unused", "unused.go"), "package unused\n")
+	chdir(t, dir)
+
+	build := func(options ...GoBuildOpt) JRule {
+		t.Helper()
+		rule, err := GoBuild(".", "out", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule.(JRule)
+	}
+
+	// The sources are the Go files of the package and what it imports,
+	// for the build's tags and platform.
+	plain := build()
+	want := []string{"go.mod", "main.go", filepath.Join("sub", "sub.go")}
+	if got := plain.Sources; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %q, want %q", got, want)
+	}
+	want = []string{"extra.go", "go.mod", "main.go", filepath.Join("sub", "sub.go")}
+	if got := build(GoTags("extra")).Sources; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %q with tag extra, want %q", got, want)
+	}
+	want = []string{"go.mod", "main.go", filepath.Join("sub", "sub.go"), "win_windows.go"}
+	if got := build(GoOS("windows")).Sources; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %q for windows, want %q", got, want)
+	}
+
+	// Each build parameter is part of the rule hash.
+	options := map[string][]GoBuildOpt{
+		"tags":    {GoTags("extra")},
+		"ldflags": {GoLdflags("-s -w")},
+		"GOOS":    {GoOS("windows")},
+		"GOARCH":  {GoArch("arm64")},
+	}
+	for name, opts := range options {
+		if bytes.Equal(build(opts...).RuleHash(), plain.RuleHash()) {
+			t.Errorf("%s did not change the rule hash", name)
+		}
+	}
+
+	// The order of tags is not.
+	if !bytes.Equal(build(GoTags("a", "b")).RuleHash(), build(GoTags("b", "a")).RuleHash()) {
+		t.Error("the order of tags changed the rule hash")
+	}
+}
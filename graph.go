@@ -0,0 +1,367 @@
+package mghash
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Fns produces an Fn for each of the given rules, all using db.
+// The Fns are wired together according to the rules' sources and targets:
+// when one rule has a source that is a target of another,
+// the other rule's Fn appears in its After list.
+//
+// This dependency is for ordering only.
+// If a prerequisite rule runs but produces byte-identical targets,
+// the rules depending on it remain up to date,
+// since their content hashes do not change.
+//
+// If the rules depend on one another cyclically,
+// the result is an error naming the rules in the cycle.
+func Fns(db DB, rules []JRule) ([]*Fn, error) {
+	pre := prereqs(rules)
+	if err := ruleCycle(rules, pre); err != nil {
+		return nil, err
+	}
+	result := make([]*Fn, len(rules))
+	for i, rule := range rules {
+		result[i] = &Fn{DB: db, Rule: rule}
+	}
+	for i, prereqs := range pre {
+		for _, j := range prereqs {
+			result[i].After = append(result[i].After, result[j])
+		}
+	}
+	return result, nil
+}
+
+// Affected returns the rules in rules that are affected by changes to the given paths:
+// those with a source matching one of the paths,
+// plus (transitively) those with a source matching a target of an affected rule.
+// A rule's sources here include its Script, IgnoreFile, and Manifest,
+// and the files its Manifest lists.
+// Paths are compared in absolute form,
+// so a relative path (relative to the current directory) matches its absolute equivalent.
+// The result preserves the order of rules.
+func Affected(rules []JRule, changedPaths ...string) []JRule {
+	var result []JRule
+	for i, isAffected := range affected(rules, changedPaths) {
+		if isAffected {
+			result = append(result, rules[i])
+		}
+	}
+	return result
+}
+
+// Sorted returns rules in dependency order:
+// each rule comes after the rules producing its sources
+// (as determined for Fns).
+// Combined with Affected, which preserves the order of rules,
+// this tells which rules to run, and in what order, after some paths change.
+// If the rules depend on one another cyclically,
+// the result is an error naming the rules in the cycle.
+func Sorted(rules []JRule) ([]JRule, error) {
+	order, err := topoOrder(rules)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]JRule, 0, len(rules))
+	for _, i := range order {
+		result = append(result, rules[i])
+	}
+	return result, nil
+}
+
+// affected tells, for each rule in rules,
+// whether it is affected by changes to the given paths.
+// See Affected.
+func affected(rules []JRule, changedPaths []string) []bool {
+	var (
+		result     = make([]bool, len(rules))
+		dependents = make([][]int, len(rules))
+		queue      []int
+	)
+	for i, prereqs := range prereqs(rules) {
+		for _, j := range prereqs {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	for i, rule := range rules {
+		if rule.hasSource(changedPaths) {
+			result[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range dependents[i] {
+			if !result[j] {
+				result[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+	return result
+}
+
+// topoOrder returns the indexes of rules,
+// ordered so that each rule comes after the rules producing its sources.
+// If the rules depend on one another cyclically,
+// the result is an error naming the rules in the cycle.
+func topoOrder(rules []JRule) ([]int, error) {
+	var (
+		pre     = prereqs(rules)
+		visited = make([]bool, len(rules))
+		result  []int
+		visit   func(int)
+	)
+	if err := ruleCycle(rules, pre); err != nil {
+		return nil, err
+	}
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		for _, j := range pre[i] {
+			visit(j)
+		}
+		result = append(result, i)
+	}
+	for i := range rules {
+		visit(i)
+	}
+	return result, nil
+}
+
+// ruleCycle returns an error naming the rules in a dependency cycle among rules,
+// whose prerequisites are given by pre (see prereqs),
+// or nil if there is none.
+func ruleCycle(rules []JRule, pre [][]int) error {
+	cycle := findCycle(pre)
+	if cycle == nil {
+		return nil
+	}
+	names := make([]string, 0, len(cycle))
+	for _, i := range cycle {
+		names = append(names, rules[i].String())
+	}
+	return cycleError(names)
+}
+
+// afterCycle returns an error naming the Fns in a dependency cycle
+// reachable from f through the After lists of Fns,
+// or nil if there is none.
+// Members of After that are not Fns are not followed.
+func (f *Fn) afterCycle() error {
+	var (
+		nodes = []*Fn{f}
+		index = map[*Fn]int{f: 0}
+		edges [][]int
+	)
+	for i := 0; i < len(nodes); i++ {
+		var next []int
+		for _, dep := range nodes[i].After {
+			d, ok := dep.(*Fn)
+			if !ok {
+				continue
+			}
+			j, ok := index[d]
+			if !ok {
+				j = len(nodes)
+				index[d] = j
+				nodes = append(nodes, d)
+			}
+			next = append(next, j)
+		}
+		edges = append(edges, next)
+	}
+	cycle := findCycle(edges)
+	if cycle == nil {
+		return nil
+	}
+	names := make([]string, 0, len(cycle))
+	for _, i := range cycle {
+		names = append(names, nodes[i].Rule.String())
+	}
+	return cycleError(names)
+}
+
+func cycleError(names []string) error {
+	return fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+}
+
+// findCycle finds a cycle in the directed graph whose edges from node i are edges[i].
+// It returns the nodes along the cycle,
+// beginning and ending with the same node,
+// or nil if there is none.
+func findCycle(edges [][]int) []int {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	var (
+		state = make([]int, len(edges))
+		stack []int
+		visit func(int) []int
+	)
+	visit = func(i int) []int {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			for k, j := range stack {
+				if j == i {
+					return append(append([]int{}, stack[k:]...), i)
+				}
+			}
+		}
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, j := range edges[i] {
+			if cycle := visit(j); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+		return nil
+	}
+	for i := range edges {
+		if cycle := visit(i); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// prereqs tells, for each rule in rules,
+// the indexes of the other rules producing one of its sources.
+// A rule producing a directory
+// (or files matching a glob pattern)
+// is a prerequisite of one whose sources lie within it.
+func prereqs(rules []JRule) [][]int {
+	var (
+		result  = make([][]int, len(rules))
+		sources = make([][]string, len(rules))
+		targets = make([][]string, len(rules))
+	)
+	for i, rule := range rules {
+		sources[i] = rule.graphSources()
+		targets[i] = absPaths(rule.declaredTargets())
+	}
+	for i := range rules {
+		for j := range rules {
+			if i != j && anyTargetMatches(targets[j], sources[i]) {
+				result[i] = append(result[i], j)
+			}
+		}
+	}
+	return result
+}
+
+// hasSource tells whether any of jr's sources matches any of paths.
+// Relative paths are relative to the current directory.
+func (jr JRule) hasSource(paths []string) bool {
+	return anySourceMatches(jr.graphSources(), absPaths(paths))
+}
+
+// graphSources returns the absolute paths of jr's sources
+// for the purpose of ordering rules:
+// its declared sources,
+// its script, ignore file, and manifest,
+// and the files the manifest lists,
+// if it can be read now.
+// Glob patterns are not expanded,
+// since the files they match may not exist yet.
+func (jr JRule) graphSources() []string {
+	result := append([]string{}, jr.Sources...)
+	if jr.Script != "" {
+		result = append(result, jr.scriptPath())
+	}
+	if jr.IgnoreFile != "" {
+		result = append(result, jr.IgnoreFile)
+	}
+	if jr.Manifest != "" {
+		result = append(result, jr.Manifest)
+		resolve := jr.ResolveSources
+		if resolve == nil {
+			resolve = ManifestLines
+		}
+		// A manifest that cannot be read yet
+		// (e.g. because another rule produces it)
+		// contributes only itself.
+		if listed, err := resolve(context.Background(), jr.Manifest); err == nil {
+			result = append(result, listed...)
+		}
+	}
+	return absPaths(result)
+}
+
+// absPaths returns the absolute forms of paths,
+// leaving URLs alone.
+func absPaths(paths []string) []string {
+	result := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !isURL(path) {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+		}
+		result = append(result, path)
+	}
+	return result
+}
+
+// anySourceMatches tells whether any of paths is covered by any of the source entries in sources.
+func anySourceMatches(sources, paths []string) bool {
+	for _, src := range sources {
+		for _, path := range paths {
+			if sourceMatches(src, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// anyTargetMatches tells whether any of the target entries in targets
+// may produce any of the source entries in sources.
+func anyTargetMatches(targets, sources []string) bool {
+	for _, target := range targets {
+		for _, src := range sources {
+			if targetMatches(target, src) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetMatches tells whether the target entry target may produce the source entry src:
+// because src covers target (see sourceMatches),
+// or because target covers src,
+// being a glob pattern matching it or a directory containing it.
+func targetMatches(target, src string) bool {
+	return sourceMatches(src, target) || sourceMatches(target, src)
+}
+
+// sourceMatches tells whether path is covered by the source entry src:
+// because they are the same,
+// because src is a glob pattern matching path,
+// or because src is a directory containing path.
+func sourceMatches(src, path string) bool {
+	src, path = filepath.Clean(src), filepath.Clean(path)
+	if src == path {
+		return true
+	}
+	if isGlob(src) {
+		if ok, _ := filepath.Match(src, path); ok {
+			return true
+		}
+	}
+	return strings.HasPrefix(path, src+string(filepath.Separator))
+}
@@ -0,0 +1,259 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/magefile/mage/mg"
+)
+
+func TestFnsOrderingOnly(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		gen   = filepath.Join(dir, "gen")
+		final = filepath.Join(dir, "final")
+		log   = filepath.Join(dir, "log")
+		db    = NewMemDB()
+	)
+
+	run := func(a JRule) {
+		t.Helper()
+		b := JRule{
+			Sources: []string{gen},
+			Targets: []string{final},
+			Command: []string{"sh", "-c", "cp " + gen + " " + final + " && echo b >> " + log},
+		}
+		fns, err := Fns(db, []JRule{a, b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fns[1].After) != 1 || fns[1].After[0] != fns[0] {
+			t.Fatalf("got After %v for the dependent rule, want only its prerequisite", fns[1].After)
+		}
+		if err := fns[1].Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(JRule{
+		Targets: []string{gen},
+		Command: []string{"sh", "-c", "echo gen > " + gen + " && echo a >> " + log},
+	})
+	checkFile(t, log, "a\nb\n")
+
+	// A different prerequisite (with a different Fn ID, so mage runs it)
+	// that produces the same bytes.
+	run(JRule{
+		Targets: []string{gen},
+		Command: []string{"sh", "-c", "printf 'gen\\n' > " + gen + " && echo a >> " + log},
+	})
+	checkFile(t, log, "a\nb\na\n")
+}
+
+func checkFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q in %s, want %q", got, filepath.Base(path), want)
+	}
+}
+
+func TestAffected(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(cwd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		header   = filepath.Join(dir, "include", "shared.h")
+		manifest = filepath.Join(dir, "manifest")
+	)
+	writeFile(t, manifest, "listed.txt\n")
+
+	rules := []JRule{
+		// 0: reads the header through a glob, by a relative path.
+		{Sources: []string{filepath.Join(rel, "include", "*.h")}, Targets: []string{filepath.Join(dir, "a.o")}},
+		// 1: reads the header through its directory.
+		{Sources: []string{filepath.Join(dir, "include")}, Targets: []string{filepath.Join(dir, "b.o")}},
+		// 2: links the objects (transitively affected).
+		{Sources: []string{filepath.Join(dir, "*.o")}, Targets: []string{filepath.Join(dir, "lib.a")}},
+		// 3: packages the library (transitively affected).
+		{Sources: []string{filepath.Join(rel, "lib.a")}, Targets: []string{filepath.Join(dir, "pkg.tgz")}},
+		// 4: unrelated.
+		{Sources: []string{filepath.Join(dir, "other.c")}, Targets: []string{filepath.Join(dir, "other.bin")}},
+		// 5: has a script relative to its Dir.
+		{Dir: filepath.Join(dir, "tools"), Script: "gen.sh", Targets: []string{filepath.Join(dir, "gen.out")}},
+		// 6: has a manifest.
+		{Manifest: manifest, Targets: []string{filepath.Join(dir, "m.out")}},
+		// 7: has an ignore file.
+		{IgnoreFile: filepath.Join(dir, ".ignore"), Sources: []string{filepath.Join(dir, "tree")}, Targets: []string{filepath.Join(dir, "tree.out")}},
+	}
+
+	cases := []struct {
+		paths []string
+		want  []int
+	}{
+		{paths: []string{header}, want: []int{0, 1, 2, 3}},
+		{paths: []string{filepath.Join(rel, "include", "shared.h")}, want: []int{0, 1, 2, 3}},
+		{paths: []string{filepath.Join(dir, "include", "sub", "..", "shared.h")}, want: []int{0, 1, 2, 3}},
+		{paths: []string{filepath.Join(dir, "a.o")}, want: []int{2, 3}},
+		{paths: []string{filepath.Join(dir, "other.c")}, want: []int{4}},
+		{paths: []string{filepath.Join(dir, "tools", "gen.sh")}, want: []int{5}},
+		{paths: []string{filepath.Join(dir, "listed.txt")}, want: []int{6}},
+		{paths: []string{manifest}, want: []int{6}},
+		{paths: []string{filepath.Join(dir, ".ignore")}, want: []int{7}},
+		{paths: []string{filepath.Join(dir, "unrelated")}},
+	}
+	for _, c := range cases {
+		got := Affected(rules, c.paths...)
+		var want []JRule
+		for _, i := range c.want {
+			want = append(want, rules[i])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Affected(%q) = %v, want %v", c.paths, got, want)
+		}
+	}
+}
+
+func TestSorted(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		src  = filepath.Join(dir, "src")
+		mid  = filepath.Join(dir, "mid")
+		out  = filepath.Join(dir, "out")
+		pkg  = filepath.Join(dir, "pkg")
+		rule = func(source, target string) JRule {
+			return JRule{Sources: []string{source}, Targets: []string{target}}
+		}
+		rules = []JRule{rule(out, pkg), rule(mid, out), rule(filepath.Join(dir, "other"), filepath.Join(dir, "other.out")), rule(src, mid)}
+	)
+	got, err := Sorted(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JRule{rules[3], rules[1], rules[0], rules[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Affected keeps that order.
+	if got, want := Affected(got, src), want[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got affected rules %v, want %v", got, want)
+	}
+}
+
+func TestPrereqsCoveringTargets(t *testing.T) {
+	dir := t.TempDir()
+	rules := []JRule{
+		// 0: produces a directory.
+		{Targets: []string{filepath.Join(dir, "gen")}},
+		// 1: produces files matching a glob.
+		{Targets: []string{filepath.Join(dir, "obj", "*.o")}},
+		// 2: reads a file in the generated directory.
+		{Sources: []string{filepath.Join(dir, "gen", "sub", "x.go")}},
+		// 3: reads one of the globbed files.
+		{Sources: []string{filepath.Join(dir, "obj", "a.o")}},
+		// 4: reads a file next to, but not in, the generated directory.
+		{Sources: []string{filepath.Join(dir, "generated.go"), filepath.Join(dir, "obj", "sub", "a.o")}},
+	}
+	want := [][]int{nil, nil, {0}, {1}, nil}
+	if got := prereqs(rules); !reflect.DeepEqual(got, want) {
+		t.Errorf("got prerequisites %v, want %v", got, want)
+	}
+}
+
+func TestCrossDirectory(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		root   = t.TempDir()
+		shared = filepath.Join(root, "shared")
+		app    = filepath.Join(root, "app")
+		db     = NewMemDB()
+	)
+	writeFile(t, filepath.Join(shared, ".mghash.json"), `{"base": "file"} {"sources": ["x.in"], "targets": ["x"], "command": ["cp", "x.in", "x"]}`)
+	writeFile(t, filepath.Join(shared, "x.in"), "1")
+	writeFile(t, filepath.Join(app, ".mghash.json"), `{"sources": ["../shared/x"], "targets": ["out"], "command": ["cp", "{{.Source}}", "{{.Target}}"], "template": true} {"base": "file"}`)
+
+	var rules []JRule
+	for _, dir := range []string{app, shared} {
+		r, err := JDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r...)
+	}
+	if want := filepath.Join(shared, "x"); !reflect.DeepEqual(rules[0].Sources, []string{want}) {
+		t.Errorf("got sources %q, want %q", rules[0].Sources, want)
+	}
+
+	// The rule consuming ../shared/x depends on the one producing it.
+	fns, err := Fns(db, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns[0].After) != 1 || fns[0].After[0] != fns[1] {
+		t.Fatalf("got prerequisites %v for %s, want %s", fns[0].After, rules[0], rules[1])
+	}
+
+	// The template expands relative to the rule's directory, where it runs.
+	if err := fns[0].Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(app, "out"), "1")
+
+	// The shared file's content is part of the consuming rule's hash.
+	h1 := contentHash(ctx, t, rules[0])
+	writeFile(t, filepath.Join(shared, "x"), "changed")
+	if h2 := contentHash(ctx, t, rules[0]); bytes.Equal(h1, h2) {
+		t.Error("content hash unchanged after changing a source in another directory")
+	}
+}
+
+func TestCycle(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		a   = filepath.Join(dir, "a")
+		b   = filepath.Join(dir, "b")
+		db  = NewMemDB()
+	)
+	rules := []JRule{
+		{Sources: []string{filepath.Join(dir, "in")}, Targets: []string{filepath.Join(dir, "in.out")}},
+		{Sources: []string{a}, Targets: []string{b}},
+		// Depends on the previous rule through a generated source in its directory.
+		{Sources: []string{dir}, Targets: []string{a}},
+	}
+	want := "dependency cycle: " + rules[1].String() + " -> " + rules[2].String() + " -> " + rules[1].String()
+
+	if _, err := Fns(db, rules); err == nil || err.Error() != want {
+		t.Errorf("got error %v from Fns, want %q", err, want)
+	}
+	if _, err := Sorted(rules); err == nil || err.Error() != want {
+		t.Errorf("got error %v from Sorted, want %q", err, want)
+	}
+
+	// A cycle made directly with After.
+	var (
+		f1 = &Fn{DB: db, Rule: newTestRule("f1", "v1")}
+		f2 = &Fn{DB: db, Rule: newTestRule("f2", "v1"), After: []mg.Fn{f1}}
+		f3 = &Fn{DB: db, Rule: newTestRule("f3", "v1"), After: []mg.Fn{f2}}
+	)
+	f1.After = []mg.Fn{f2}
+	want = "dependency cycle: f2 -> f1 -> f2"
+	if err := f3.Run(ctx); err == nil || err.Error() != want {
+		t.Errorf("got error %v from Run, want %q", err, want)
+	}
+}
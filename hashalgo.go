@@ -0,0 +1,67 @@
+package mghash
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+// HashAlgo is a hash algorithm for computing rule and file hashes.
+// See JRule.HashAlgo.
+type HashAlgo struct {
+	// Name identifies the algorithm.
+	// It is mixed into every hash computed with it
+	// (except for SHA256, for compatibility),
+	// so that hashes computed with different algorithms never collide.
+	// It must not be empty:
+	// computing a content hash or running an Fn
+	// with such an algorithm is an error.
+	Name string
+
+	// New produces a new hash.Hash for the algorithm.
+	New func() hash.Hash
+}
+
+var (
+	// SHA256 is the default HashAlgo.
+	SHA256 = &HashAlgo{Name: "sha256", New: sha256.New}
+
+	// SHA512 is a HashAlgo using SHA-512.
+	SHA512 = &HashAlgo{Name: "sha512", New: sha512.New}
+)
+
+// newHash produces a new hash.Hash for a,
+// which may be nil, meaning SHA256.
+func (a *HashAlgo) newHash() hash.Hash {
+	if a == nil {
+		return sha256.New()
+	}
+	return a.New()
+}
+
+// tag returns the identifier to mix into hashes computed with a,
+// which is empty for SHA256 itself
+// (but not for other algorithms that reuse its name).
+// An algorithm with no Name gets a placeholder tag;
+// check refuses such algorithms before their hashes are used.
+func (a *HashAlgo) tag() string {
+	if a == nil || a == SHA256 {
+		return ""
+	}
+	if a.Name == "" {
+		return "unnamed"
+	}
+	return a.Name
+}
+
+// check returns an error if a,
+// which may be nil,
+// has no Name.
+func (a *HashAlgo) check() error {
+	if a != nil && a.Name == "" {
+		return errors.New("HashAlgo has an empty Name")
+	}
+	return nil
+}
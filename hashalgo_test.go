@@ -0,0 +1,60 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashAlgoName(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		src  = filepath.Join(t.TempDir(), "src")
+		rule = JRule{Sources: []string{src}, Command: []string{"gen"}}
+	)
+	writeFile(t, src, "source")
+
+	// A custom algorithm is tagged in its hashes,
+	// even when it computes SHA-256.
+	custom := rule
+	custom.HashAlgo = &HashAlgo{Name: "custom", New: sha256.New}
+	if bytes.Equal(contentHash(ctx, t, custom), contentHash(ctx, t, rule)) {
+		t.Error("same content hash for a custom algorithm and SHA256")
+	}
+	if bytes.Equal(custom.RuleHash(), rule.RuleHash()) {
+		t.Error("same rule hash for a custom algorithm and SHA256")
+	}
+
+	// So is one that reuses SHA256's name.
+	renamed := rule
+	renamed.HashAlgo = &HashAlgo{Name: SHA256.Name, New: sha256.New}
+	if bytes.Equal(contentHash(ctx, t, renamed), contentHash(ctx, t, rule)) {
+		t.Error("same content hash for a custom algorithm named sha256 and SHA256")
+	}
+	if bytes.Equal(renamed.RuleHash(), rule.RuleHash()) {
+		t.Error("same rule hash for a custom algorithm named sha256 and SHA256")
+	}
+
+	// One with no name is refused.
+	unnamed := rule
+	unnamed.HashAlgo = &HashAlgo{New: sha256.New}
+	if _, err := unnamed.ContentHash(ctx); err == nil {
+		t.Error("no error from ContentHash with an unnamed HashAlgo")
+	}
+	if bytes.Equal(unnamed.RuleHash(), rule.RuleHash()) {
+		t.Error("same rule hash for an unnamed algorithm and SHA256")
+	}
+
+	f := &Fn{Rule: newTestRule("r", "content"), HashAlgo: &HashAlgo{New: sha256.New}}
+	if f.ID() == (&Fn{Rule: f.Rule}).ID() {
+		t.Error("same ID for an Fn with an unnamed algorithm and one with SHA256")
+	}
+	if err := f.Run(ctx); err == nil {
+		t.Error("no error from Run with an unnamed HashAlgo")
+	}
+	if _, err := f.Stale(ctx); err == nil {
+		t.Error("no error from Stale with an unnamed HashAlgo")
+	}
+}
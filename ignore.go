@@ -0,0 +1,221 @@
+package mghash
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignorer decides which files to skip
+// using gitignore-style patterns.
+// See JRule.Ignore.
+type ignorer struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	// The slash-separated directory, relative to the root,
+	// that the pattern is relative to.
+	// It is empty for patterns relative to the root.
+	base string
+
+	segs     []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// add parses lines in gitignore format
+// and adds the resulting patterns,
+// relative to the directory base, to ig.
+// Patterns added later take precedence.
+func (ig *ignorer) add(base string, lines []string) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// E.g. \#foo or \!foo.
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.segs = strings.Split(line, "/")
+		ig.patterns = append(ig.patterns, p)
+	}
+}
+
+// addFile adds the patterns in the gitignore-format file at filename,
+// relative to the directory base.
+func (ig *ignorer) addFile(base, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", filename)
+	}
+	defer f.Close()
+
+	var (
+		lines []string
+		sc    = bufio.NewScanner(f)
+	)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err = sc.Err(); err != nil {
+		return errors.Wrapf(err, "reading %s", filename)
+	}
+	ig.add(base, lines)
+	return nil
+}
+
+// clone returns a copy of ig that can be added to
+// without affecting ig.
+func (ig *ignorer) clone() *ignorer {
+	if ig == nil {
+		return &ignorer{}
+	}
+	return &ignorer{patterns: append([]ignorePattern{}, ig.patterns...)}
+}
+
+// ignored tells whether the file or directory at rel,
+// a slash-separated path relative to the root,
+// is ignored.
+// As in git, the last matching pattern wins,
+// and a negated pattern re-includes what an earlier one excluded.
+// It does not consider whether a parent of rel is ignored;
+// see ignoredPath for that.
+func (ig *ignorer) ignored(rel string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	var result bool
+	for _, p := range ig.patterns {
+		if p.matches(rel, isDir) {
+			result = !p.negate
+		}
+	}
+	return result
+}
+
+// ignoredPath is like ignored,
+// but also reports true if any parent directory of rel is ignored.
+func (ig *ignorer) ignoredPath(rel string, isDir bool) bool {
+	if ig == nil || len(ig.patterns) == 0 {
+		return false
+	}
+	segs := strings.Split(rel, "/")
+	for i := 1; i < len(segs); i++ {
+		if ig.ignored(strings.Join(segs[:i], "/"), true) {
+			return true
+		}
+	}
+	return ig.ignored(rel, isDir)
+}
+
+func (p ignorePattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.segs[0], path.Base(rel))
+		return ok
+	}
+	return matchSegs(p.segs, strings.Split(rel, "/"))
+}
+
+// matchSegs matches the segments of a path against the segments of a pattern,
+// where a ** segment matches any number of path segments.
+func matchSegs(pat, segs []string) bool {
+	if len(pat) == 0 {
+		return len(segs) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegs(pat[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], segs[0]); !ok {
+		return false
+	}
+	return matchSegs(pat[1:], segs[1:])
+}
+
+// ignorer returns the ignorer for jr.Ignore and jr.IgnoreFile,
+// or nil if there are none.
+func (jr JRule) ignorer() (*ignorer, error) {
+	if len(jr.Ignore) == 0 && jr.IgnoreFile == "" {
+		return nil, nil
+	}
+	ig := &ignorer{}
+	if jr.IgnoreFile != "" {
+		if err := ig.addFile("", jr.IgnoreFile); err != nil {
+			return nil, err
+		}
+	}
+	ig.add("", jr.Ignore)
+	return ig, nil
+}
+
+// filterIgnored removes from paths the ones that ig ignores.
+// Paths are matched relative to the current directory.
+// A path outside the current directory is matched by its base name only.
+func filterIgnored(ig *ignorer, paths []string) ([]string, error) {
+	if ig == nil {
+		return paths, nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting current directory")
+	}
+	var result []string
+	for _, p := range paths {
+		rel := p
+		if filepath.IsAbs(p) {
+			if rel, err = filepath.Rel(cwd, p); err != nil {
+				rel = p
+			}
+		}
+		rel = filepath.ToSlash(filepath.Clean(rel))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			rel = path.Base(rel)
+		}
+		var isDir bool
+		if info, err := os.Stat(p); err == nil {
+			isDir = info.IsDir()
+		}
+		if !ig.ignoredPath(rel, isDir) {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,151 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorer(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		rel      string
+		isDir    bool
+		want     bool
+	}{
+		{patterns: []string{"*.o"}, rel: "a.o", want: true},
+		{patterns: []string{"*.o"}, rel: "x/y/a.o", want: true},
+		{patterns: []string{"*.o"}, rel: "a.c", want: false},
+		{patterns: []string{"# *.o"}, rel: "a.o", want: false},
+		{patterns: []string{`\#a`}, rel: "#a", want: true},
+
+		// Negation.
+		{patterns: []string{"*.o", "!keep.o"}, rel: "keep.o", want: false},
+		{patterns: []string{"*.o", "!keep.o"}, rel: "x/keep.o", want: false},
+		{patterns: []string{"*.o", "!keep.o"}, rel: "other.o", want: true},
+		{patterns: []string{"!keep.o", "*.o"}, rel: "keep.o", want: true},
+		{patterns: []string{`\!a`}, rel: "!a", want: true},
+
+		// A negated pattern does not reach into an excluded directory.
+		{patterns: []string{"build/", "!build/keep"}, rel: "build/keep", want: true},
+		{patterns: []string{"build/*", "!build/keep"}, rel: "build/keep", want: false},
+		{patterns: []string{"build/*", "!build/keep"}, rel: "build/other", want: true},
+
+		// Directory-only patterns.
+		{patterns: []string{"out/"}, rel: "out", isDir: true, want: true},
+		{patterns: []string{"out/"}, rel: "out", want: false},
+		{patterns: []string{"out/"}, rel: "out/a", want: true},
+		{patterns: []string{"out/"}, rel: "x/out/a", want: true},
+
+		// Anchored and nested patterns.
+		{patterns: []string{"/top"}, rel: "top", want: true},
+		{patterns: []string{"/top"}, rel: "x/top", want: false},
+		{patterns: []string{"x/*.o"}, rel: "x/a.o", want: true},
+		{patterns: []string{"x/*.o"}, rel: "y/x/a.o", want: false},
+		{patterns: []string{"x/*.o"}, rel: "x/y/a.o", want: false},
+		{patterns: []string{"**/gen/*.go"}, rel: "gen/a.go", want: true},
+		{patterns: []string{"**/gen/*.go"}, rel: "x/y/gen/a.go", want: true},
+		{patterns: []string{"x/**/*.o"}, rel: "x/a.o", want: true},
+		{patterns: []string{"x/**/*.o"}, rel: "x/y/z/a.o", want: true},
+		{patterns: []string{"x/**/*.o"}, rel: "y/a.o", want: false},
+	}
+	for i, c := range cases {
+		ig := &ignorer{}
+		ig.add("", c.patterns)
+		if got := ig.ignoredPath(c.rel, c.isDir); got != c.want {
+			t.Errorf("case %d: got %v for %s with %q, want %v", i, got, c.rel, c.patterns, c.want)
+		}
+	}
+}
+
+func TestIgnorerBase(t *testing.T) {
+	// Patterns from a nested .gitignore apply only beneath it,
+	// after those from its parents.
+	ig := &ignorer{}
+	ig.add("", []string{"*.log"})
+	ig.add("sub", []string{"!keep.log", "/local"})
+
+	cases := []struct {
+		rel  string
+		want bool
+	}{
+		{rel: "a.log", want: true},
+		{rel: "keep.log", want: true},
+		{rel: "sub/keep.log", want: false},
+		{rel: "sub/x/keep.log", want: false},
+		{rel: "sub/a.log", want: true},
+		{rel: "local", want: false},
+		{rel: "sub/local", want: true},
+		{rel: "sub/x/local", want: false},
+	}
+	for _, c := range cases {
+		if got := ig.ignoredPath(c.rel, false); got != c.want {
+			t.Errorf("got %v for %s, want %v", got, c.rel, c.want)
+		}
+	}
+
+	// A clone does not see later additions.
+	cl := ig.clone()
+	cl.add("", []string{"a.log", "!a.log"})
+	if !ig.ignored("a.log", false) {
+		t.Error("adding to a clone changed the original")
+	}
+}
+
+func TestIgnoreDir(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		tree = filepath.Join(dir, "tree")
+	)
+	writeFile(t, filepath.Join(tree, "a.go"), "a")
+	writeFile(t, filepath.Join(tree, "a.o"), "a")
+	writeFile(t, filepath.Join(tree, "keep.o"), "keep")
+	writeFile(t, filepath.Join(tree, "sub", "b.go"), "b")
+	writeFile(t, filepath.Join(tree, "sub", "b.log"), "b")
+	writeFile(t, filepath.Join(tree, "sub", "keep.log"), "keep")
+	writeFile(t, filepath.Join(tree, "sub", ".gitignore"), "*.log\n!keep.log\n")
+
+	var (
+		rule  = JRule{Sources: []string{tree}, Command: []string{"gen"}, Ignore: []string{"*.o", "!keep.o"}, GitIgnore: true}
+		plain = JRule{Sources: []string{tree}, Command: []string{"gen"}}
+	)
+	if bytes.Equal(rule.RuleHash(), plain.RuleHash()) {
+		t.Error("same rule hash with and without Ignore")
+	}
+	other := rule
+	other.Ignore = []string{"*.o"}
+	if bytes.Equal(rule.RuleHash(), other.RuleHash()) {
+		t.Error("same rule hash with different Ignore patterns")
+	}
+
+	before := contentHash(ctx, t, rule)
+
+	cases := []struct {
+		file    string
+		changes bool
+	}{
+		{file: "a.o", changes: false},
+		{file: "sub/b.log", changes: false},
+		{file: "keep.o", changes: true},
+		{file: "sub/keep.log", changes: true},
+		{file: "sub/b.go", changes: true},
+	}
+	for _, c := range cases {
+		writeFile(t, filepath.Join(tree, filepath.FromSlash(c.file)), "changed "+c.file)
+		after := contentHash(ctx, t, rule)
+		if changed := !bytes.Equal(before, after); changed != c.changes {
+			t.Errorf("got content hash changed %v after changing %s, want %v", changed, c.file, c.changes)
+		}
+		before = after
+	}
+
+	// Without GitIgnore, the nested .gitignore has no effect.
+	rule.GitIgnore = false
+	before = contentHash(ctx, t, rule)
+	writeFile(t, filepath.Join(tree, "sub", "b.log"), "changed again")
+	if bytes.Equal(before, contentHash(ctx, t, rule)) {
+		t.Error("content hash unchanged after changing a file that only a .gitignore ignores, without GitIgnore")
+	}
+}
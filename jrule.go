@@ -1,54 +1,552 @@
 package mghash
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"time"
 
 	json "github.com/gibson042/canonicaljson-go"
-	"github.com/magefile/mage/mg"
 	"github.com/pkg/errors"
 )
 
 // JRule is a Rule that lists a set of source files and a set of target files,
 // and includes a command for producing targets from sources.
+//
+// If Template is set,
+// elements of Command are text/template templates
+// using {{.Sources}}, {{.Targets}},
+// {{.Source}} (the first source), and {{.Target}} (the first target).
+// An element consisting solely of {{.Sources}} or {{.Targets}}
+// expands to one argument per file;
+// elsewhere those expand to the files separated by spaces.
+// Relative paths are expanded relative to Dir,
+// where the command runs.
+// Templates are expanded just before the command runs.
+// The rule's hashes cover Command unexpanded
+// (alongside the sources and targets themselves).
+//
+// Entries in Sources and Targets may be filepath.Match patterns.
+// These are expanded with filepath.Glob,
+// relative to the current directory (not Dir),
+// each time the rule is hashed or run.
+// The matching files, in sorted order,
+// take the place of the pattern both in the content hash
+// and in a command template.
+// A pattern matching nothing contributes only itself to the content hash.
+// The ** syntax of some shells is not supported.
+//
+// An entry in Sources or Targets may also be a directory.
+// Its hash covers the relative paths and contents
+// of all the files beneath it (apart from those matching Ignore),
+// so adding, removing, renaming, or editing any of them changes the content hash.
+// The directory itself, not the files in it,
+// appears in a command template.
+//
+// An entry in Sources may also be an http or https URL.
+// Its hash covers the content of the resource it names,
+// fetched each time the rule is hashed
+// (see HTTPClient and DownloadDir).
+// It is never hashed in text mode.
+// A resource that is not found (status 404 or 410)
+// is treated like a missing file;
+// any other failure to fetch it is an error.
 type JRule struct {
 	Sources []string `json:"sources"`
 	Targets []string `json:"targets"`
 	Command []string `json:"command"`
 	Dir     string   `json:"dir"`
+
+	// Template causes the elements of Command to be expanded as templates
+	// (see above).
+	Template bool `json:"template,omitempty"`
+
+	// Submodules lists paths of git submodules,
+	// or of directories containing them,
+	// whose checked-out commits are part of the rule's content hash.
+	// Checking out a different commit in a submodule invalidates the rule
+	// even if that leaves the files it uses unchanged.
+	// A submodule that is not checked out contributes the commit its superproject records.
+	// Like Sources, relative paths are relative to the current directory, not Dir.
+	// A path with no submodules contributes nothing but its name.
+	Submodules []string `json:"submodules,omitempty"`
+
+	// CleanDirs lists directories whose contents are removed
+	// before Command runs,
+	// so that stale outputs from earlier runs do not linger.
+	// Declared sources are never removed.
+	// This does not affect the rule's hashes.
+	CleanDirs []string `json:"clean_dirs,omitempty"`
+
+	// Script, if set, names an executable file to run instead of Command,
+	// in which case Command (which may be empty) supplies its arguments.
+	// A relative Script path is relative to Dir.
+	// The script is hashed as a source,
+	// so editing it invalidates the rule.
+	Script string `json:"script,omitempty"`
+
+	// MmapThreshold, if positive, is the size in bytes
+	// at or above which a file is memory-mapped for hashing,
+	// where the platform supports it,
+	// rather than read in chunks.
+	// This produces the same hashes and so does not affect the rule's hashes.
+	// In BenchmarkMmap on Linux,
+	// mapping made no measurable difference for a 64KiB file,
+	// was a few percent faster for a 1MiB file,
+	// and about 15% faster for a 64MiB file.
+	MmapThreshold int64 `json:"mmap_threshold,omitempty"`
+
+	// TextFiles lists filepath.Match patterns
+	// for the base names of files (sources or targets) to hash in text mode,
+	// e.g. "*.go".
+	// In text mode, CRLF line endings are hashed as if they were LF,
+	// so that checkouts on different platforms produce the same hash.
+	// Never list binary files here,
+	// unless DetectText is set.
+	TextFiles []string `json:"text_files,omitempty"`
+
+	// IgnoreFinalNewline causes a single trailing newline
+	// to be ignored when hashing a file in text mode.
+	IgnoreFinalNewline bool `json:"ignore_final_newline,omitempty"`
+
+	// DetectText causes each file to be checked for binary content
+	// before hashing it in text mode.
+	// A file is taken to be binary,
+	// and hashed as is,
+	// if there is a NUL byte in its first 8000 bytes
+	// (the same heuristic Git uses).
+	// With DetectText, an empty TextFiles means all files are candidates for text mode.
+	// The heuristic misjudges UTF-16 text as binary,
+	// and binary formats that avoid NUL bytes as text.
+	DetectText bool `json:"detect_text,omitempty"`
+
+	// CommandTransform, if set, rewrites the command line just before it runs,
+	// e.g. to wrap it in time or strace.
+	// It does not affect the rule's hashes,
+	// which are computed from the untransformed Command.
+	CommandTransform func([]string) []string `json:"-"`
+
+	// HashPath causes the value of the PATH environment variable
+	// to be part of the rule's content hash,
+	// so that changing which tools the command finds invalidates the rule.
+	// This makes cache entries specific to a machine's configuration;
+	// rules sharing a cache across machines should leave it off.
+	HashPath bool `json:"hash_path,omitempty"`
+
+	// Condition, if set, is a command that runs each time the rule is considered.
+	// If it exits with a nonzero status,
+	// the rule is skipped:
+	// it neither runs nor has its hash recorded.
+	// It runs in Dir and does not affect the rule's hashes.
+	Condition []string `json:"condition,omitempty"`
+
+	// BufferOutput causes the command's standard output and standard error
+	// to be collected in memory
+	// and written to os.Stderr only if the command fails.
+	// Only the last 64KiB of output is kept.
+	// In verbose mode, output is shown as it is produced regardless.
+	BufferOutput bool `json:"buffer_output,omitempty"`
+
+	// DirHasher, if set, computes the hash of any source or target that is a directory.
+	// By default, a directory's hash covers the names and contents
+	// of all the files beneath it.
+	DirHasher func(ctx context.Context, root string) ([]byte, error) `json:"-"`
+
+	// FileHashCache, if set, is consulted for file hashes
+	// before reading files,
+	// and updated after.
+	// A cached hash is used only when the file's size and modification time
+	// match what was recorded.
+	// This is faster, especially in a fresh process,
+	// but less strict than rehashing every file every time.
+	// The sqlite package provides an implementation.
+	FileHashCache FileHashCache `json:"-"`
+
+	// MinTargets, if positive, is the minimum number of targets
+	// that must exist after the command runs.
+	// If fewer do, Run returns an error
+	// (and so Fn.Run does not record the rule as up to date).
+	// This catches commands that silently produce nothing,
+	// and is mainly useful with AllowMissingTargets or glob patterns in Targets.
+	// It does not affect the rule's hashes.
+	MinTargets int `json:"min_targets,omitempty"`
+
+	// Verify causes Run to check the targets rather than update them.
+	// Copies of the targets are saved in a temporary directory,
+	// then the command runs as usual,
+	// the targets are compared with the copies,
+	// and they are restored from the copies.
+	// If any target differs from what the command produced,
+	// Run returns an error.
+	// If restoring the targets fails,
+	// the copies are kept
+	// and the error names the directory holding them.
+	// This is useful in CI for checking that committed generated files are up to date.
+	// It does not affect the rule's hashes.
+	Verify bool `json:"verify,omitempty"`
+
+	// Manifest, if set, names a file listing more of the rule's sources.
+	// It is parsed with ResolveSources each time the content hash is computed,
+	// so adding a file to the manifest adds it to the rule.
+	// The manifest itself is hashed as a source too.
+	Manifest string `json:"manifest,omitempty"`
+
+	// ResolveSources, if set, parses Manifest.
+	// The default is ManifestLines.
+	ResolveSources func(ctx context.Context, manifest string) ([]string, error) `json:"-"`
+
+	// Aliases maps targets to names they formerly had.
+	// When a target is renamed,
+	// listing its old name here lets the rule be found up to date
+	// from DB entries recorded before the rename
+	// (see Aliaser).
+	// Old names need not exist,
+	// and they do not affect the rule's hashes.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Limiter, if set, throttles the reading of files for hashing,
+	// e.g. to avoid overwhelming a network filesystem.
+	// A *rate.Limiter from golang.org/x/time/rate is a suitable value.
+	Limiter Limiter `json:"-"`
+
+	// Generation is part of the rule's hashes.
+	// Incrementing it forces the rule to run again,
+	// e.g. after fixing a bug in the tool that its command runs.
+	Generation int `json:"generation,omitempty"`
+
+	// Salt is part of the rule's hashes.
+	// Rules that are otherwise identical but have different salts
+	// never share DB entries.
+	// See JDirSalted.
+	Salt string `json:"salt,omitempty"`
+
+	// HashAlgo is the hash algorithm for the rule's hashes
+	// and the hashes of its files.
+	// The default is the one named in the config file (see Config.HashAlgo),
+	// and otherwise SHA256.
+	// Changing it changes the rule's hashes.
+	HashAlgo *HashAlgo `json:"-"`
+
+	// Env lists environment variables, in the form KEY=VALUE,
+	// to add to the environment of Command (and Condition).
+	// They are part of the rule's hashes,
+	// so changing one invalidates the rule.
+	Env []string `json:"env,omitempty"`
+
+	// AllowMissingTargets permits the command to leave some targets unproduced.
+	// Otherwise Run returns an error if any target
+	// (other than a glob pattern)
+	// does not exist after the command runs,
+	// and so Fn.Run does not record the rule as up to date.
+	// It does not affect the rule's hashes.
+	AllowMissingTargets bool `json:"allow_missing_targets,omitempty"`
+
+	// Timeout, if positive, limits how long Run may take.
+	// When it expires the command is killed
+	// and Run returns an error wrapping context.DeadlineExceeded.
+	// In JSON it is a duration string such as "90s" or "5m",
+	// or else a number of nanoseconds.
+	// It does not affect the rule's hashes.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Shell causes Command to be run through a shell,
+	// for pipes, redirection, and so on.
+	// The elements of Command (after template expansion) are joined with spaces
+	// and passed as the last argument of ShellCommand.
+	// No quoting is added.
+	Shell bool `json:"shell,omitempty"`
+
+	// ShellCommand is the shell to use when Shell is set.
+	// The default is "/bin/sh -c",
+	// or "cmd /c" on Windows.
+	// Since the shell is part of the rule's hashes,
+	// a rule relying on the default has different hashes on Windows than elsewhere,
+	// and the same command line may behave differently in the two shells.
+	ShellCommand []string `json:"shell_command,omitempty"`
+
+	// StdoutFile, if set, is a file to receive the command's standard output,
+	// in place of wherever it would otherwise go.
+	// StderrFile is the same for standard error.
+	// Each is written to a temporary file (see TempDir)
+	// that replaces it when the command finishes,
+	// and is a target of the rule in addition to Targets
+	// (though not in the command's {{.Targets}}).
+	// Relative paths are relative to the current directory, not Dir.
+	// If the command fails, the files are left holding whatever it wrote;
+	// the rule is not recorded as up to date, so it will run again.
+	StdoutFile string `json:"stdout_file,omitempty"`
+	StderrFile string `json:"stderr_file,omitempty"`
+
+	// TempDir, if set, is the directory for the temporary files
+	// that StdoutFile and StderrFile are written to
+	// before being renamed into place.
+	// It must be on the same filesystem as those files.
+	// The default is the directory of each file,
+	// which need not be on the same filesystem as the OS temp dir.
+	// It does not affect the rule's hashes.
+	TempDir string `json:"temp_dir,omitempty"`
+
+	// Ignore lists gitignore-style patterns for files to skip
+	// when hashing a source or target that is a directory,
+	// such as ".git/" or "*~".
+	// A pattern without a slash (other than a trailing one) matches a base name at any depth;
+	// one with a slash is relative to the directory being hashed,
+	// and may use ** for any number of path segments.
+	// A trailing slash matches only directories,
+	// and a leading ! re-includes what an earlier pattern excluded
+	// (though not within an excluded directory).
+	// The patterns also filter the files matched by glob patterns in Sources,
+	// relative to the current directory.
+	// They have no effect on directories hashed by DirHasher.
+	// A set of patterns can be shared among rules
+	// by using the same slice in each,
+	// or with IgnoreFile.
+	// The patterns are part of the rule's hashes.
+	Ignore []string `json:"ignore,omitempty"`
+
+	// IgnoreFile, if set, is a file of patterns in .gitignore format
+	// that apply as if they came before those in Ignore.
+	// It is a source of the rule.
+	IgnoreFile string `json:"ignore_file,omitempty"`
+
+	// GitIgnore causes the .gitignore files found in a directory being hashed
+	// to apply to that directory and its subdirectories,
+	// after Ignore and IgnoreFile,
+	// as they would in git.
+	GitIgnore bool `json:"git_ignore,omitempty"`
+
+	// HTTPClient is the client for fetching URL sources.
+	// The default is http.DefaultClient.
+	HTTPClient *http.Client `json:"-"`
+
+	// DownloadDir, if set, is a directory for keeping copies of URL sources.
+	// Each download is refreshed with a conditional request
+	// (using the ETag the server gave it)
+	// when the rule is hashed and before its command runs,
+	// so an unchanged resource is not transferred again,
+	// and a URL source in a command template
+	// expands to the path of its download.
+	// Without DownloadDir, URL sources are fetched each time the rule is hashed
+	// and appear in templates as URLs.
+	// It does not affect the rule's hashes.
+	DownloadDir string `json:"download_dir,omitempty"`
+
+	// Retries is the number of times to rerun the command after it fails,
+	// e.g. because it depends on the network.
+	// Between attempts Run waits for RetryBackoff,
+	// doubling after each attempt,
+	// or until the context is canceled.
+	// Only the outcome of the last attempt matters,
+	// and earlier failures leave no record.
+	// Timeout, if set, covers all the attempts together.
+	// RetryBackoff is written in JSON the same way as Timeout.
+	// Neither field affects the rule's hashes.
+	Retries      int           `json:"retries,omitempty"`
+	RetryBackoff time.Duration `json:"retry_backoff,omitempty"`
+
+	// Symlinks tells how to hash a source or target that is a symbolic link,
+	// including one in a directory being hashed:
+	// by what it points to (SymlinksFollow, the default),
+	// by its destination path (SymlinksLink),
+	// or by both (SymlinksBoth).
+	// The link's destination matters for links that select e.g. a toolchain version.
+	// It is part of the rule's hashes.
+	Symlinks SymlinkMode `json:"symlinks,omitempty"`
+}
+
+var (
+	_ Aliaser     = JRule{}
+	_ Rebaser     = JRule{}
+	_ Sourcer     = JRule{}
+	_ Targeter    = JRule{}
+	_ Gater       = JRule{}
+	_ InputHasher = JRule{}
+)
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It allows Timeout and RetryBackoff to be duration strings.
+func (jr *JRule) UnmarshalJSON(data []byte) error {
+	type plain JRule // without this method
+	aux := struct {
+		*plain
+		Timeout      jsonDuration `json:"timeout,omitempty"`
+		RetryBackoff jsonDuration `json:"retry_backoff,omitempty"`
+	}{
+		plain: (*plain)(jr),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	jr.Timeout = time.Duration(aux.Timeout)
+	jr.RetryBackoff = time.Duration(aux.RetryBackoff)
+	return nil
 }
 
-var _ Rule = JRule{}
+// jsonDuration is a time.Duration that unmarshals from JSON
+// either as a string understood by time.ParseDuration
+// or as a number of nanoseconds.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = jsonDuration(n)
+		return nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(dur)
+	return nil
+}
 
 func (jr JRule) String() string {
 	return fmt.Sprintf("JRule[%s]", strings.Join(jr.Targets, " "))
 }
 
+// Gate implements Gater.
+// It runs jr.Condition, if there is one,
+// and reports whether it succeeded.
+// If ctx is canceled or expires while the condition runs,
+// Gate returns ctx's error rather than treating the rule as skipped.
+func (jr JRule) Gate(ctx context.Context) (bool, error) {
+	if len(jr.Condition) == 0 {
+		return true, nil
+	}
+	cmd := exec.CommandContext(ctx, jr.Condition[0], jr.Condition[1:]...)
+	cmd.Dir = jr.Dir
+	cmd.Env = jr.environ()
+	if verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	err := cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// The condition was killed, so its exit status says nothing.
+		return false, ctxErr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "running condition %s", strings.Join(jr.Condition, " "))
+	}
+	return true, nil
+}
+
+// SourceFiles implements Sourcer.
+// The result includes jr.Script, jr.IgnoreFile, and jr.Manifest, if set,
+// and the files jr.Manifest lists.
+func (jr JRule) SourceFiles(ctx context.Context) ([]string, error) {
+	return jr.allSources(ctx)
+}
+
+// TargetFiles implements Targeter.
+// Glob patterns in jr.Targets are expanded.
+// The result includes jr.StdoutFile and jr.StderrFile, if set.
+func (jr JRule) TargetFiles() []string {
+	targets, err := jr.targets()
+	if err != nil {
+		return jr.declaredTargets()
+	}
+	return targets
+}
+
 func (jr JRule) RuleHash() []byte {
 	jr2 := JRule{
-		Sources: make([]string, len(jr.Sources)),
-		Targets: make([]string, len(jr.Targets)),
-		Command: jr.Command,
+		Sources:  make([]string, len(jr.Sources)),
+		Targets:  make([]string, len(jr.Targets)),
+		Command:  jr.Command,
+		Template: jr.Template,
+		Script:   jr.Script,
+
+		TextFiles:          jr.TextFiles,
+		IgnoreFinalNewline: jr.IgnoreFinalNewline,
+		DetectText:         jr.DetectText,
+		HashPath:           jr.HashPath,
+		Manifest:           jr.Manifest,
+		Generation:         jr.Generation,
+		Salt:               jr.Salt,
+		StdoutFile:         jr.StdoutFile,
+		StderrFile:         jr.StderrFile,
+	}
+	if len(jr.Submodules) > 0 {
+		jr2.Submodules = make([]string, len(jr.Submodules))
+		copy(jr2.Submodules, jr.Submodules)
+		sort.Strings(jr2.Submodules)
+	}
+	jr2.Env = jr.sortedEnv()
+	jr2.Ignore = jr.Ignore
+	jr2.IgnoreFile = jr.IgnoreFile
+	jr2.GitIgnore = jr.GitIgnore
+	jr2.Symlinks = jr.Symlinks
+	if jr.Shell {
+		jr2.Shell = true
+		jr2.ShellCommand = jr.shellCommand()
 	}
 	copy(jr2.Sources, jr.Sources)
 	copy(jr2.Targets, jr.Targets)
 	sort.Strings(jr2.Sources)
 	sort.Strings(jr2.Targets)
 	j, _ := json.Marshal(jr2)
-	sum := sha256.Sum256(j)
-	return sum[:]
+	return domainHash(jr.algo(), ruleHashDomain, j)
+}
+
+// ContentHash implements Rule.ContentHash.
+//
+// The set of declared targets is part of the hash,
+// independent of whether those targets exist.
+// Adding a target to a rule, or removing one,
+// therefore changes its content hash
+// (even when all sources are unchanged)
+// and causes the rule's command to run again.
+// A declared target that does not exist contributes its name but no content.
+func (jr JRule) ContentHash(ctx context.Context) ([]byte, error) {
+	return jr.contentHash(ctx, nil, true)
+}
+
+// InputHash implements InputHasher.
+// It is like ContentHash,
+// but includes only the names of jr's targets,
+// not their contents.
+func (jr JRule) InputHash(ctx context.Context) ([]byte, error) {
+	return jr.contentHash(ctx, nil, false)
+}
+
+// AliasHashes implements Aliaser.
+// It produces the content hash that jr would have
+// if its targets had their earlier names in jr.Aliases.
+func (jr JRule) AliasHashes(ctx context.Context) ([][]byte, error) {
+	if len(jr.Aliases) == 0 {
+		return nil, nil
+	}
+	h, err := jr.contentHash(ctx, jr.Aliases, true)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{h}, nil
 }
 
-func (jr JRule) ContentHash(_ context.Context) ([]byte, error) {
+// contentHash computes the content hash of jr,
+// recording each target under the name rename gives it, if any.
+// If withTargets is false,
+// it computes the input hash instead (see InputHash).
+func (jr JRule) contentHash(ctx context.Context, rename map[string]string, withTargets bool) ([]byte, error) {
 	// Theory of operation:
 	// A new struct is built out of the fields of jr,
 	// but with Sources and Targets mapped to each file's hash,
@@ -56,124 +554,813 @@ func (jr JRule) ContentHash(_ context.Context) ([]byte, error) {
 	// (and nil where it doesn't).
 	// The struct is JSON marshaled
 	// (using canonical-json for reproducibility)
-	// and hashed.
+	// and hashed,
+	// prefixed by a domain-separation tag.
 	// Any change to the set of sources or targets,
 	// the presence of absence of any file,
 	// the content of any file,
-	// or the strings in jr.Command
+	// or the strings in jr.Command (and whether they are templates)
 	// will change the hash.
+	// So will the recorded commit of any submodule in jr.Submodules,
+	// the value of PATH if jr.HashPath is set,
+	// jr.Generation, jr.Salt, jr.Env, jr.Ignore, jr.GitIgnore, jr.Symlinks,
+	// and the shell if jr.Shell is set.
+	// Sources include jr.Script, jr.IgnoreFile, and jr.Manifest, if set,
+	// and whatever files jr.Manifest lists.
 
 	s := struct {
-		Sources map[string][]byte `json:"sources"`
-		Targets map[string][]byte `json:"targets"`
-		Command []string          `json:"command"`
+		Sources    map[string][]byte `json:"sources"`
+		Targets    map[string][]byte `json:"targets"`
+		Command    []string          `json:"command"`
+		Template   bool              `json:"template,omitempty"`
+		Submodules map[string]string `json:"submodules,omitempty"`
+
+		TextFiles          []string `json:"text_files,omitempty"`
+		IgnoreFinalNewline bool     `json:"ignore_final_newline,omitempty"`
+		DetectText         bool     `json:"detect_text,omitempty"`
+		Path               []string `json:"path,omitempty"`
+		Generation         int      `json:"generation,omitempty"`
+		Salt               string   `json:"salt,omitempty"`
+
+		// Glob patterns are included
+		// so that rules differing only in patterns
+		// that match nothing
+		// have different hashes.
+		SourcePatterns []string `json:"source_patterns,omitempty"`
+		TargetPatterns []string `json:"target_patterns,omitempty"`
+
+		Env       []string `json:"env,omitempty"`
+		Shell     []string `json:"shell,omitempty"`
+		Ignore    []string `json:"ignore,omitempty"`
+		GitIgnore bool     `json:"git_ignore,omitempty"`
+
+		Symlinks SymlinkMode `json:"symlinks,omitempty"`
 	}{
-		Sources: make(map[string][]byte),
-		Targets: make(map[string][]byte),
-		Command: jr.Command,
+		Sources:  make(map[string][]byte),
+		Targets:  make(map[string][]byte),
+		Command:  jr.Command,
+		Template: jr.Template,
+
+		TextFiles:          jr.TextFiles,
+		IgnoreFinalNewline: jr.IgnoreFinalNewline,
+		DetectText:         jr.DetectText,
+		Generation:         jr.Generation,
+		Salt:               jr.Salt,
+
+		SourcePatterns: globs(jr.Sources),
+		TargetPatterns: globs(jr.Targets),
+
+		Env:       jr.sortedEnv(),
+		Ignore:    jr.Ignore,
+		GitIgnore: jr.GitIgnore,
+
+		Symlinks: jr.Symlinks,
+	}
+	if jr.Shell {
+		s.Shell = jr.shellCommand()
 	}
-	err := fillWithFileHashes(jr.Sources, s.Sources)
+	if jr.HashPath {
+		s.Path = filepath.SplitList(os.Getenv("PATH"))
+	}
+	sources, err := jr.allSources(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "computing source hash(es)")
+		return nil, err
 	}
-	err = fillWithFileHashes(jr.Targets, s.Targets)
+	fh, err := jr.fileHasher()
 	if err != nil {
-		return nil, errors.Wrap(err, "computing target hash(es)")
+		return nil, err
+	}
+	err = fh.fill(ctx, sources, s.Sources)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing source hash(es)")
+	}
+	domain := contentHashDomain
+	if withTargets {
+		targets, err := jr.targets()
+		if err != nil {
+			return nil, err
+		}
+		err = fh.fill(ctx, targets, s.Targets)
+		if err != nil {
+			return nil, errors.Wrap(err, "computing target hash(es)")
+		}
+	} else {
+		// Which targets exist is not part of the input hash,
+		// so glob patterns are left unexpanded.
+		for _, target := range jr.declaredTargets() {
+			s.Targets[target] = nil
+		}
+		domain = inputHashDomain
+	}
+	for target, old := range rename {
+		if h, ok := s.Targets[target]; ok {
+			delete(s.Targets, target)
+			s.Targets[old] = h
+		}
+	}
+	if len(jr.Submodules) > 0 {
+		s.Submodules = make(map[string]string)
+		for _, sub := range jr.Submodules {
+			commits, err := submoduleCommits(ctx, sub)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting commits of submodules in %s", sub)
+			}
+			if len(commits) == 0 {
+				s.Submodules[sub] = ""
+			}
+			for path, commit := range commits {
+				s.Submodules[path] = commit
+			}
+		}
 	}
 	j, err := json.Marshal(s)
 	if err != nil {
 		return nil, errors.Wrap(err, "in JSON marshaling")
 	}
-	sum := sha256.Sum256(j)
-	return sum[:], nil
+	return domainHash(jr.algo(), domain, j), nil
 }
 
+// Domain-separation tags for the hashes computed by JRule.
+// Within a content hash,
+// the roles of files are further separated by the "sources" and "targets" keys,
+// so a file moving from one list to the other changes the hash.
+const (
+	ruleHashDomain    = "mghash.JRule.RuleHash"
+	contentHashDomain = "mghash.JRule.ContentHash"
+	inputHashDomain   = "mghash.JRule.InputHash"
+)
+
+// algo returns jr.HashAlgo,
+// or the default from the config file if that is nil.
+func (jr JRule) algo() *HashAlgo {
+	if jr.HashAlgo != nil {
+		return jr.HashAlgo
+	}
+	return defaultHashAlgo()
+}
+
+// domainHash hashes preimage with algo
+// (which may be nil, meaning SHA256),
+// prefixed by the given domain-separation tag
+// and the algorithm's identifier.
+func domainHash(algo *HashAlgo, domain string, preimage []byte) []byte {
+	if tag := algo.tag(); tag != "" {
+		domain += "/" + tag
+	}
+	hasher := algo.newHash()
+	hasher.Write([]byte(domain))
+	hasher.Write([]byte{0})
+	hasher.Write(preimage)
+	return hasher.Sum(nil)
+}
+
+// Run implements Rule.Run.
+// If ctx is canceled while the command is running,
+// any targets the command created or modified are removed,
+// so that partial output cannot be mistaken for a finished result.
 func (jr JRule) Run(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, jr.Command[0], jr.Command[1:]...)
+	if jr.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jr.Timeout)
+		defer cancel()
+	}
+
+	var err error
+	if jr.Verify {
+		err = jr.verify(ctx)
+	} else {
+		err = jr.run(ctx)
+	}
+	if jr.Timeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return errors.Wrapf(err, "%s timed out after %s", jr, jr.Timeout)
+	}
+	return err
+}
+
+func (jr JRule) run(ctx context.Context) error {
+	if len(jr.CleanDirs) > 0 {
+		sources, err := jr.allSources(ctx)
+		if err != nil {
+			return err
+		}
+		// Compare absolute paths,
+		// so that a relative source is kept from an absolute CleanDirs entry and vice versa.
+		keep := make(map[string]bool)
+		for _, src := range sources {
+			abs, err := filepath.Abs(src)
+			if err != nil {
+				return errors.Wrapf(err, "getting absolute path of %s", src)
+			}
+			keep[abs] = true
+		}
+		for _, dir := range jr.CleanDirs {
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return errors.Wrapf(err, "getting absolute path of %s", dir)
+			}
+			if _, err := cleanDir(abs, keep); err != nil {
+				return errors.Wrapf(err, "cleaning %s", dir)
+			}
+		}
+	}
+
+	if err := jr.download(ctx, jr.Sources); err != nil {
+		return err
+	}
+
+	argv, err := jr.argv()
+	if err != nil {
+		return err
+	}
+	if jr.CommandTransform != nil {
+		argv = jr.CommandTransform(argv)
+	}
+	if len(argv) == 0 {
+		return fmt.Errorf("no command for %s", jr)
+	}
+
+	// Note the state of the targets,
+	// so that any the command touches can be removed if it is canceled.
+	targets, err := jr.targets()
+	if err != nil {
+		return err
+	}
+	before, err := takeSnapshot(targets)
+	if err != nil {
+		return errors.Wrap(err, "snapshotting targets")
+	}
+
+	err = jr.runRetrying(ctx, argv)
+
+	// Glob patterns in the targets may match new files now.
+	// If they cannot be expanded,
+	// fall back to the targets noted before the command ran.
+	after, globErr := jr.targets()
+	if globErr == nil {
+		targets = after
+	}
+
+	if err != nil && ctx.Err() != nil {
+		if err2 := removeChanged(targets, before); err2 != nil {
+			return errors.Wrapf(err2, "removing partial targets after %s", ctx.Err())
+		}
+		err = errors.Wrap(ctx.Err(), "running command")
+	}
+	if err != nil {
+		if globErr != nil {
+			return errors.Wrapf(err, "%s (also listing targets: %s)", jr, globErr)
+		}
+		return err
+	}
+	if globErr != nil {
+		return globErr
+	}
+
+	if !jr.AllowMissingTargets {
+		missing, err := missingFiles(jr.declaredTargets())
+		if err != nil {
+			return errors.Wrap(err, "checking targets")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%s did not produce target(s): %s", jr, strings.Join(missing, " "))
+		}
+	}
+
+	if jr.MinTargets > 0 {
+		n, err := countExisting(targets)
+		if err != nil {
+			return errors.Wrap(err, "counting targets")
+		}
+		if n < jr.MinTargets {
+			return fmt.Errorf("%s produced %d target(s), expected at least %d", jr, n, jr.MinTargets)
+		}
+	}
+	return nil
+}
+
+// missingFiles returns the paths in paths that do not exist,
+// ignoring glob patterns.
+func missingFiles(paths []string) ([]string, error) {
+	var result []string
+	for _, path := range paths {
+		if isGlob(path) {
+			continue
+		}
+		_, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			result = append(result, path)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "statting %s", path)
+		}
+	}
+	return result, nil
+}
+
+// countExisting tells how many of paths exist.
+func countExisting(paths []string) (int, error) {
+	var n int
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "statting %s", path)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// runRetrying runs the command,
+// retrying it as jr.Retries and jr.RetryBackoff specify.
+func (jr JRule) runRetrying(ctx context.Context, argv []string) error {
+	backoff := jr.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := jr.runCommand(ctx, argv)
+		if err == nil || attempt >= jr.Retries || ctx.Err() != nil {
+			return err
+		}
+		if verbose() {
+			log.Printf("%s failed (%s), retrying in %s", jr, err, backoff)
+		}
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Wrapf(ctx.Err(), "waiting to retry after %s", err)
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (jr JRule) runCommand(ctx context.Context, argv []string) error {
+	name, args := argv[0], argv[1:]
+
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = jr.Dir
-	if mg.Verbose() {
+	cmd.Env = jr.environ()
+	var buf *tailBuffer
+	switch c := captured(ctx); {
+	case c != nil:
+		// See Fn.RunCapture.
+		// With the same writer for both,
+		// exec.Cmd does not write to it concurrently.
+		cmd.Stdout = &c.buf
+		cmd.Stderr = &c.buf
+	case verbose():
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		log.Printf("Running %s %s", jr.Command[0], strings.Join(jr.Command[1:], " "))
+		log.Printf("Running %s %s", name, strings.Join(args, " "))
+	case jr.BufferOutput:
+		buf = &tailBuffer{max: maxBufferedOutput}
+		cmd.Stdout = buf
+		cmd.Stderr = buf
+	}
+
+	files, err := jr.openOutputFiles(cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Run()
+	if err2 := finishOutputFiles(files); err2 != nil && err == nil {
+		err = err2
 	}
-	return cmd.Run()
+	if err != nil && buf != nil {
+		os.Stderr.Write(buf.Bytes())
+	}
+	return err
 }
 
-func fillWithFileHashes(files []string, hashes map[string][]byte) error {
-	for _, file := range files {
-		h, err := hashFile(file)
-		if errors.Is(err, fs.ErrNotExist) {
-			h = nil
-		} else if err != nil {
-			return errors.Wrapf(err, "computing hash of %s", file)
+// outputFile is a temporary file for receiving command output,
+// to be renamed to path.
+type outputFile struct {
+	*os.File
+	path string
+}
+
+// openOutputFiles creates temporary files for jr.StdoutFile and jr.StderrFile, if set,
+// and directs cmd's output streams to them.
+// The caller must pass the resulting files to finishOutputFiles.
+func (jr JRule) openOutputFiles(cmd *exec.Cmd) ([]outputFile, error) {
+	var files []outputFile
+	if jr.StdoutFile != "" {
+		f, err := createTemp(jr.TempDir, jr.StdoutFile)
+		if err != nil {
+			return nil, err
 		}
-		hashes[file] = h
+		files = append(files, outputFile{File: f, path: jr.StdoutFile})
+		cmd.Stdout = f
 	}
-	return nil
+	if jr.StderrFile != "" {
+		if jr.StderrFile == jr.StdoutFile {
+			cmd.Stderr = cmd.Stdout
+			return files, nil
+		}
+		f, err := createTemp(jr.TempDir, jr.StderrFile)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+				os.Remove(f.Name())
+			}
+			return nil, err
+		}
+		files = append(files, outputFile{File: f, path: jr.StderrFile})
+		cmd.Stderr = f
+	}
+	return files, nil
 }
 
-func hashFile(path string) ([]byte, error) {
-	f, err := os.Open(path)
+// finishOutputFiles closes the files from openOutputFiles
+// and renames each into place,
+// returning the first error.
+func finishOutputFiles(files []outputFile) error {
+	var result error
+	for _, f := range files {
+		err := f.Close()
+		if err == nil {
+			err = os.Rename(f.Name(), f.path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			if result == nil {
+				result = errors.Wrapf(err, "writing %s", f.path)
+			}
+		}
+	}
+	return result
+}
+
+// environ produces the environment for jr's commands,
+// or nil (meaning the current environment) if jr.Env is empty.
+func (jr JRule) environ() []string {
+	if len(jr.Env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), jr.Env...)
+}
+
+// sortedEnv returns a sorted copy of jr.Env for hashing.
+func (jr JRule) sortedEnv() []string {
+	if len(jr.Env) == 0 {
+		return nil
+	}
+	env := make([]string, len(jr.Env))
+	copy(env, jr.Env)
+	sort.Strings(env)
+	return env
+}
+
+func (jr JRule) fileHasher() (fileHasher, error) {
+	if err := jr.algo().check(); err != nil {
+		return fileHasher{}, err
+	}
+	switch jr.Symlinks {
+	case SymlinksFollow, SymlinksLink, SymlinksBoth:
+	default:
+		return fileHasher{}, fmt.Errorf("unknown symlink mode %q", jr.Symlinks)
+	}
+	ig, err := jr.ignorer()
 	if err != nil {
-		return nil, errors.Wrapf(err, "opening %s", path)
+		return fileHasher{}, err
 	}
-	defer f.Close()
-	hasher := sha256.New()
-	_, err = io.Copy(hasher, f)
+	return fileHasher{
+		mmapThreshold:      jr.MmapThreshold,
+		textFiles:          jr.TextFiles,
+		ignoreFinalNewline: jr.IgnoreFinalNewline,
+		detectText:         jr.DetectText,
+		dirHasher:          jr.DirHasher,
+		cache:              jr.FileHashCache,
+		limiter:            jr.Limiter,
+		algo:               jr.algo(),
+		ignore:             ig,
+		gitIgnore:          jr.GitIgnore,
+		fetcher:            jr.fetcher(),
+		symlinks:           jr.Symlinks,
+	}, nil
+}
+
+// argv produces the command line to run,
+// before any CommandTransform.
+func (jr JRule) argv() ([]string, error) {
+	command, err := jr.expandCommand()
 	if err != nil {
-		return nil, errors.Wrapf(err, "hashing %s", path)
+		return nil, err
+	}
+	if jr.Script != "" {
+		script, err := filepath.Abs(jr.scriptPath())
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving script %s", jr.Script)
+		}
+		command = append([]string{script}, command...)
+	}
+	if jr.Shell && len(command) > 0 {
+		shell := jr.shellCommand()
+		command = append(append([]string{}, shell...), strings.Join(command, " "))
 	}
-	return hasher.Sum(nil), nil
+	return command, nil
+}
+
+// shellCommand returns the shell to use when jr.Shell is set.
+func (jr JRule) shellCommand() []string {
+	if len(jr.ShellCommand) > 0 {
+		return jr.ShellCommand
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c"}
+	}
+	return []string{"/bin/sh", "-c"}
+}
+
+func (jr JRule) scriptPath() string {
+	if filepath.IsAbs(jr.Script) {
+		return jr.Script
+	}
+	return filepath.Join(jr.Dir, jr.Script)
 }
 
 // JDir parses a file named .mghash.json in the given directory,
 // if there is one,
 // returning the JRules it contains.
 // The default directory for any JRules not specifying one is dir.
+// Other relative paths in the file are relative to the current directory.
+//
+// A file containing the object {"base": "file"}
+// instead has all the relative paths in its rules,
+// including Dir itself,
+// resolved against dir
+// (see JRule.Rebase).
+// They may refer outside it, e.g. to ../shared/foo.proto.
+// This allows a tree of rule files to be loaded from anywhere,
+// and the dependencies among rules in different directories
+// to be discovered (see Fns).
+// The object {"base": "cwd"} selects the default.
+//
+// The file may contain comments, in both // and /* */ styles,
+// and trailing commas in arrays and objects.
+// These do not affect the rules' hashes.
+//
+// In Sources, Targets, Command, and Dir,
+// ${NAME} is replaced with the value of the variable NAME,
+// and $$ with a literal $.
+// Variables are defined by objects in the file of the form {"vars": {"NAME": "value", ...}},
+// which apply to every rule in the file;
+// a variable not defined that way is taken from the environment.
+// A reference to a variable defined in neither place is an error.
+// The rules' hashes reflect the values substituted.
+//
+// An object of the form {"include": ["FILE", ...]}
+// adds the rules from other files in the same format,
+// after the rules of the including file.
+// Relative paths of included files are relative to the including file's directory.
+// An included file's "base" setting applies to its own rules,
+// and a "file" base resolves them against its own directory.
+// An included file sees the including file's variables,
+// which it may override for itself.
+// A file that includes itself, directly or indirectly, is an error;
+// one included more than once by different files contributes its rules each time.
 func JDir(dir string) ([]JRule, error) {
-	f, err := os.Open(filepath.Join(dir, ".mghash.json"))
-	if errors.Is(err, fs.ErrNotExist) {
+	return JDirContext(context.Background(), dir)
+}
+
+// JDirContext is like JDir,
+// but stops early with an error if ctx is canceled.
+func JDirContext(ctx context.Context, dir string) ([]JRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, ".mghash.json")
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
 		return nil, nil
 	}
+	return loadRuleFile(ctx, path, nil, nil)
+}
+
+// loadRuleFile parses the rules in the file at path,
+// including those in any files it includes,
+// resolving the relative paths in each file's rules as its "base" directive requires.
+// Variables defined in the file are added to (and override) those in inherited.
+// The stack holds the absolute paths of the files including this one,
+// for detecting cycles.
+func loadRuleFile(ctx context.Context, path string, inherited map[string]string, stack []string) ([]JRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting absolute path of %s", path)
+	}
+	for i, p := range stack {
+		if p == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack[i:], abs), " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, errors.Wrapf(err, "opening %s/.msghash.json")
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	if data, err = standardizeJSON(data); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
 	}
-	defer f.Close()
 	var (
-		result []JRule
-		dec    = json.NewDecoder(f)
+		rules    []JRule
+		includes []string
+		base     string
+		vars     = make(map[string]string)
+		dec      = json.NewDecoder(bytes.NewReader(data))
 	)
+	for k, v := range inherited {
+		vars[k] = v
+	}
 	for dec.More() {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", path)
+		}
+		var keys map[string]json.RawMessage
+		if err = json.Unmarshal(raw, &keys); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", path)
+		}
+		_, hasVars := keys["vars"]
+		_, hasInclude := keys["include"]
+		_, hasBase := keys["base"]
+		if hasVars || hasInclude || hasBase {
+			var d struct {
+				Vars    map[string]string `json:"vars"`
+				Include []string          `json:"include"`
+				Base    string            `json:"base"`
+			}
+			if err = json.Unmarshal(raw, &d); err != nil {
+				return nil, errors.Wrapf(err, "parsing directive in %s", path)
+			}
+			for k, v := range d.Vars {
+				vars[k] = v
+			}
+			includes = append(includes, d.Include...)
+			if hasBase {
+				switch d.Base {
+				case baseCwd, baseFile:
+					base = d.Base
+				default:
+					return nil, fmt.Errorf("unknown base %q in %s (want %q or %q)", d.Base, path, baseCwd, baseFile)
+				}
+			}
+			continue
+		}
 		var j JRule
-		if err = dec.Decode(&j); err != nil {
-			return errors.Wrapf(err, "parsing %s/.mghash.json")
+		if err = json.Unmarshal(raw, &j); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", path)
+		}
+		rules = append(rules, j)
+	}
+
+	var (
+		dir    = filepath.Dir(path)
+		result = make([]JRule, 0, len(rules))
+		lookup = varLookup(vars)
+	)
+	for i, j := range rules {
+		if err = j.interpolate(lookup); err != nil {
+			return nil, errors.Wrapf(err, "in rule %d of %s", i+1, path)
 		}
-		if j.Dir == "" {
+		if base == baseFile {
+			j = j.Rebase(dir).(JRule)
+		} else if j.Dir == "" {
 			j.Dir = dir
 		}
 		result = append(result, j)
 	}
+	for _, inc := range includes {
+		if inc, err = interpolate(inc, lookup); err != nil {
+			return nil, errors.Wrapf(err, "in include of %s", path)
+		}
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(dir, inc)
+		}
+		included, err := loadRuleFile(ctx, inc, vars, stack)
+		if err != nil {
+			return nil, errors.Wrapf(err, "including %s in %s", inc, path)
+		}
+		result = append(result, included...)
+	}
 	return result, nil
 }
 
+// Values of the "base" directive in rule files (see JDir).
+const (
+	baseCwd  = "cwd"
+	baseFile = "file"
+)
+
+// JDirSalted is like JDir,
+// but sets the Salt of each rule that does not have one
+// to the path of dir's rule file,
+// so that identical rules loaded from different directories never share DB entries.
+// (Rules from included files get the salt of the including file.)
+// The path is dir joined with ".mghash.json",
+// so a relative dir yields salts that are the same in every checkout,
+// while an absolute one does not.
+func JDirSalted(dir string) ([]JRule, error) {
+	rules, err := JDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	salt := filepath.Join(dir, ".mghash.json")
+	for i := range rules {
+		if rules[i].Salt == "" {
+			rules[i].Salt = salt
+		}
+	}
+	return rules, nil
+}
+
 // JTree walks the tree rooted at dir,
 // looking for .mghash.json files
 // and parsing the JRules out of them using JDir.
+// An error in any one file aborts the walk.
+// See JTreeWarn for an alternative.
 func JTree(dir string) ([]JRule, error) {
+	return JTreeContext(context.Background(), dir)
+}
+
+// JTreeContext is like JTree,
+// but stops the walk and returns ctx's error if ctx is canceled.
+func JTreeContext(ctx context.Context, dir string) ([]JRule, error) {
+	return jtree(ctx, dir, func(err error) error { return err })
+}
+
+// JTreeWarn is like JTree,
+// but an error parsing one .mghash.json file does not stop the others from being parsed.
+// Such errors are returned as warnings, one per bad file,
+// together with the rules from the good files.
+// The final error is for problems walking the tree itself.
+func JTreeWarn(dir string) ([]JRule, []error, error) {
+	var warnings []error
+	result, err := jtree(context.Background(), dir, func(err error) error {
+		warnings = append(warnings, err)
+		return nil
+	})
+	return result, warnings, err
+}
+
+// jtree walks the tree rooted at dir, calling JDirContext in each directory.
+// Errors from JDirContext are passed to onErr,
+// which may return an error to abort the walk or nil to continue.
+// Cancellation of ctx always aborts the walk.
+func jtree(ctx context.Context, dir string, onErr func(error) error) ([]JRule, error) {
 	var result []JRule
 	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		if !info.IsDir() {
 			return nil
 		}
-		j, err := JDir(path)
+		j, err := JDirContext(ctx, path)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return onErr(err)
 		}
 		result = append(result, j...)
 		return nil
 	})
 	return result, err
 }
+
+// Select returns the rules in rules having at least one target
+// that matches at least one of the given patterns.
+// Patterns use the syntax of filepath.Match
+// and must match a target's full path as written in the rule.
+// A malformed pattern matches nothing.
+func Select(rules []JRule, targetPatterns ...string) []JRule {
+	var result []JRule
+	for _, rule := range rules {
+		if rule.matchesTarget(targetPatterns) {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+func (jr JRule) matchesTarget(patterns []string) bool {
+	for _, target := range jr.declaredTargets() {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
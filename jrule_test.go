@@ -0,0 +1,900 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentHashTargetSet(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		src = filepath.Join(dir, "src")
+		a   = filepath.Join(dir, "a")
+		b   = filepath.Join(dir, "b")
+	)
+	writeFile(t, src, "source")
+	writeFile(t, a, "target a")
+
+	one := JRule{Sources: []string{src}, Targets: []string{a}, Command: []string{"true"}}
+	two := JRule{Sources: []string{src}, Targets: []string{a, b}, Command: []string{"true"}}
+
+	h1 := contentHash(ctx, t, one)
+
+	// Adding a target that does not exist yet.
+	if h2 := contentHash(ctx, t, two); bytes.Equal(h1, h2) {
+		t.Error("adding a nonexistent target did not change the content hash")
+	}
+
+	// Adding, and then removing, a target that exists.
+	writeFile(t, b, "target b")
+	h2 := contentHash(ctx, t, two)
+	if bytes.Equal(h1, h2) {
+		t.Error("adding an existing target did not change the content hash")
+	}
+	if h := contentHash(ctx, t, one); !bytes.Equal(h, h1) {
+		t.Error("removing a target did not restore the original content hash")
+	} else if bytes.Equal(h, h2) {
+		t.Error("removing a target did not change the content hash")
+	}
+}
+
+func contentHash(ctx context.Context, t *testing.T, r Rule) []byte {
+	t.Helper()
+	h, err := r.ContentHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	rules := []JRule{
+		{Targets: []string{"gen/a.pb.go"}},
+		{Targets: []string{"gen/b.pb.go", "gen/b_grpc.pb.go"}},
+		{Targets: []string{"docs/index.html"}},
+		{Targets: []string{"out.txt"}, StdoutFile: "log.txt"},
+	}
+
+	cases := []struct {
+		patterns []string
+		want     []int
+	}{
+		{patterns: []string{"gen/*.pb.go"}, want: []int{0, 1}},
+		{patterns: []string{"gen/*_grpc.pb.go"}, want: []int{1}},
+		{patterns: []string{"*.pb.go"}},
+		{patterns: []string{"docs/*", "out.txt"}, want: []int{2, 3}},
+		{patterns: []string{"log.txt"}, want: []int{3}},
+		{patterns: []string{"["}},
+		{},
+	}
+	for _, c := range cases {
+		got := Select(rules, c.patterns...)
+		var want []JRule
+		for _, i := range c.want {
+			want = append(want, rules[i])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Select(%q) = %v, want %v", c.patterns, got, want)
+		}
+	}
+}
+
+func TestCleanDirs(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		out    = filepath.Join(t.TempDir(), "out")
+		src    = filepath.Join(out, "sub", "src")
+		target = filepath.Join(out, "new")
+		stale  = filepath.Join(out, "sub", "deep", "stale")
+	)
+	writeFile(t, src, "source")
+	writeFile(t, stale, "stale")
+
+	rule := JRule{
+		Sources:   []string{src},
+		Targets:   []string{target},
+		CleanDirs: []string{out},
+		Command:   []string{"sh", "-c", "test ! -e " + stale + " && touch " + target},
+	}
+	f := &Fn{DB: NewMemDB(), Rule: rule}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{src, target} {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the stale directory, want nonexistence", err)
+	}
+
+	// Nothing is cleaned on a cache hit.
+	writeFile(t, stale, "stale")
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("stale file removed on a cache hit: %s", err)
+	}
+}
+
+func TestCleanDirsMixedPaths(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	writeFile(t, filepath.Join("gen", "src.txt"), "source")
+	writeFile(t, filepath.Join(dir, "out", "src.txt"), "source")
+	writeFile(t, filepath.Join("gen", "stale"), "stale")
+
+	rule := JRule{
+		// A relative source in an absolute CleanDirs entry,
+		// and an absolute source in a relative one.
+		Sources:   []string{filepath.Join("gen", "src.txt"), filepath.Join(dir, "out", "src.txt")},
+		CleanDirs: []string{filepath.Join(dir, "gen"), "out"},
+		Command:   []string{"true"},
+	}
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range rule.Sources {
+		if _, err := os.Stat(src); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("gen", "stale")); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the stale file, want nonexistence", err)
+	}
+}
+
+// chdir changes to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestScript(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		script = filepath.Join(dir, "gen.sh")
+		out    = filepath.Join(dir, "out")
+		db     = NewMemDB()
+		rule   = JRule{Dir: dir, Script: "gen.sh", Command: []string{"hello"}, Targets: []string{out}}
+	)
+	writeFile(t, script, "#!/bin/sh\necho \"$1\" > out\n")
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(want string) {
+		t.Helper()
+		if err := (&Fn{DB: db, Rule: rule}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, out, want)
+	}
+
+	run("hello\n")
+
+	// Editing the script does.
+	writeFile(t, script, "#!/bin/sh\necho \"$1, world\" > out\n")
+	run("hello, world\n")
+}
+
+func TestCommandTransform(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		out  = filepath.Join(dir, "out")
+		rule = JRule{Targets: []string{out}, Command: []string{"sh", "-c", "echo plain > " + out}}
+	)
+	ruleHash, content := rule.RuleHash(), contentHash(ctx, t, rule)
+
+	var got []string
+	rule.CommandTransform = func(argv []string) []string {
+		got = argv
+		return []string{"sh", "-c", "echo wrapped > " + out}
+	}
+	if h := rule.RuleHash(); !bytes.Equal(h, ruleHash) {
+		t.Error("CommandTransform changed the rule hash")
+	}
+	if h, err := rule.ContentHash(ctx); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(h, content) {
+		t.Error("CommandTransform changed the content hash")
+	}
+
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rule.Command) {
+		t.Errorf("transform got %q, want %q", got, rule.Command)
+	}
+	checkFile(t, out, "wrapped\n")
+}
+
+func TestHashPath(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		plain  = JRule{Command: []string{"true"}}
+		hashed = JRule{Command: []string{"true"}, HashPath: true}
+	)
+
+	t.Setenv("PATH", filepath.Join(dir, "a"))
+	plain1, hashed1 := contentHash(ctx, t, plain), contentHash(ctx, t, hashed)
+	if bytes.Equal(plain1, hashed1) {
+		t.Error("HashPath did not change the content hash")
+	}
+
+	t.Setenv("PATH", filepath.Join(dir, "b"))
+	if h := contentHash(ctx, t, plain); !bytes.Equal(h, plain1) {
+		t.Error("changing PATH changed the content hash without HashPath")
+	}
+	if h := contentHash(ctx, t, hashed); bytes.Equal(h, hashed1) {
+		t.Error("changing PATH did not change the content hash with HashPath")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		out  = filepath.Join(dir, "out")
+		rule = JRule{
+			Targets: []string{out},
+			Command: []string{"sh", "-c", "echo $A $B > " + out},
+			Env:     []string{"A=1", "B=2"},
+		}
+	)
+
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, out, "1 2\n")
+
+	// The order of Env does not matter to the hashes.
+	reordered := rule
+	reordered.Env = []string{"B=2", "A=1"}
+	if !bytes.Equal(rule.RuleHash(), reordered.RuleHash()) {
+		t.Error("reordering Env changed the rule hash")
+	}
+	if !bytes.Equal(contentHash(ctx, t, rule), contentHash(ctx, t, reordered)) {
+		t.Error("reordering Env changed the content hash")
+	}
+
+	// Its values do.
+	for _, env := range [][]string{nil, {"A=1"}, {"A=1", "B=3"}} {
+		other := rule
+		other.Env = env
+		if bytes.Equal(rule.RuleHash(), other.RuleHash()) {
+			t.Errorf("Env %q did not change the rule hash", env)
+		}
+		if bytes.Equal(contentHash(ctx, t, rule), contentHash(ctx, t, other)) {
+			t.Errorf("Env %q did not change the content hash", env)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		rule = JRule{Command: []string{"sleep", "10"}, Timeout: 50 * time.Millisecond}
+	)
+	start := time.Now()
+	err := rule.Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want one wrapping context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+
+	cases := []struct {
+		json string
+		want time.Duration
+	}{
+		{json: `{"timeout": "90s", "retry_backoff": "1m30s"}`, want: 90 * time.Second},
+		{json: `{"timeout": 90000000000, "retry_backoff": 90000000000}`, want: 90 * time.Second},
+	}
+	for _, c := range cases {
+		var j JRule
+		if err := json.Unmarshal([]byte(c.json), &j); err != nil {
+			t.Fatalf("unmarshaling %s: %s", c.json, err)
+		}
+		if j.Timeout != c.want || j.RetryBackoff != c.want {
+			t.Errorf("got timeout %s and retry backoff %s from %s, want %s", j.Timeout, j.RetryBackoff, c.json, c.want)
+		}
+	}
+}
+
+func TestShell(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		out   = filepath.Join(dir, "out")
+		log   = filepath.Join(dir, "log")
+		shell = filepath.Join(dir, "myshell")
+		rule  = JRule{
+			Targets: []string{out},
+			Command: []string{"echo", "a", "|", "tr", "a", "b", ">", out},
+			Shell:   true,
+		}
+	)
+
+	// The default shell handles the pipe and redirection.
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, out, "b\n")
+
+	// So does a configured one, which is what runs.
+	writeFile(t, shell, "#!/bin/sh\necho \"$2\" >> "+log+"\nexec /bin/sh \"$@\"\n")
+	if err := os.Chmod(shell, 0755); err != nil {
+		t.Fatal(err)
+	}
+	custom := rule
+	custom.ShellCommand = []string{shell, "-c"}
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := custom.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, out, "b\n")
+	checkFile(t, log, "echo a | tr a b > "+out+"\n")
+
+	// The shell is part of the rule hash.
+	plain := rule
+	plain.Shell = false
+	if bytes.Equal(rule.RuleHash(), plain.RuleHash()) {
+		t.Error("Shell did not change the rule hash")
+	}
+	if bytes.Equal(rule.RuleHash(), custom.RuleHash()) {
+		t.Error("ShellCommand did not change the rule hash")
+	}
+	explicit := rule
+	explicit.ShellCommand = rule.shellCommand()
+	if !bytes.Equal(rule.RuleHash(), explicit.RuleHash()) {
+		t.Error("spelling out the default shell changed the rule hash")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		count = filepath.Join(dir, "count")
+	)
+
+	// The command fails until its third attempt.
+	rule := JRule{
+		Command:      []string{"sh", "-c", "echo x >> " + count + " && [ $(wc -l < " + count + ") -ge 3 ]"},
+		Retries:      2,
+		RetryBackoff: 10 * time.Millisecond,
+	}
+	start := time.Now()
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, count, "x\nx\nx\n")
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("retried after %s, want at least 10ms and then 20ms of backoff", elapsed)
+	}
+
+	// With one retry fewer, it stops after the last allowed attempt.
+	if err := os.Remove(count); err != nil {
+		t.Fatal(err)
+	}
+	rule.Retries = 1
+	if err := rule.Run(ctx); err == nil {
+		t.Error("no error after running out of retries")
+	}
+	checkFile(t, count, "x\nx\n")
+}
+
+func TestCondition(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		out  = filepath.Join(dir, "out")
+		log  = filepath.Join(dir, "log")
+		db   = newIterDB()
+		rule = JRule{
+			Targets:   []string{out},
+			Command:   []string{"sh", "-c", "touch " + out + " && echo ran >> " + log},
+			Condition: []string{"false"},
+		}
+	)
+
+	var skipped int
+	if err := (&Fn{DB: db, Rule: rule, OnSkipped: func(Rule) { skipped++ }}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the log after a failing condition, want nonexistence", err)
+	}
+	if skipped != 1 {
+		t.Errorf("got %d calls to OnSkipped after a failing condition, want 1", skipped)
+	}
+	if len(db.entries) != 0 {
+		t.Errorf("got %d DB entries after a failing condition, want 0", len(db.entries))
+	}
+
+	// A passing condition leads to the usual cache logic.
+	rule.Condition = []string{"true"}
+	for i := 0; i < 2; i++ {
+		if err := (&Fn{DB: db, Rule: rule, OnSkipped: func(Rule) { skipped++ }}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFile(t, log, "ran\n")
+	if skipped != 1 {
+		t.Errorf("got %d calls to OnSkipped after a passing condition, want 1", skipped)
+	}
+
+	// A condition cut off by its context is an error, not a skip.
+	slow := rule
+	slow.Condition = []string{"sleep", "10"}
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if ok, err := slow.Gate(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, %v from a timed-out condition, want an error wrapping context.DeadlineExceeded", ok, err)
+	}
+
+	// The condition is not part of the hashes.
+	noCond := rule
+	noCond.Condition = nil
+	if !bytes.Equal(rule.RuleHash(), noCond.RuleHash()) {
+		t.Error("Condition changed the rule hash")
+	}
+	if !bytes.Equal(contentHash(ctx, t, rule), contentHash(ctx, t, noCond)) {
+		t.Error("Condition changed the content hash")
+	}
+}
+
+// TestGoldenHashes pins the hashes of a fixed rule,
+// since any change to them invalidates every cache entry
+// (see CHANGELOG.md).
+func TestGoldenHashes(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		rule = JRule{
+			Sources: []string{"testdata/golden/src"},
+			Targets: []string{"testdata/golden/target"},
+			Command: []string{"gen", "{{.Source}}"},
+		}
+	)
+	cases := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{name: "rule hash", got: rule.RuleHash(), want: "74fe805a96bc5902c25f1201ba764d244465998f92183fd2eee3f6a0cd70aa8f"},
+		{name: "content hash", got: contentHash(ctx, t, rule), want: "b000cb61b4868a35c9c87985e56f9eb7faef85a4e7dd45c59f0e513018db8852"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(c.got); got != c.want {
+			t.Errorf("got %s %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSourceTargetRoles(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		a   = filepath.Join(dir, "a")
+		b   = filepath.Join(dir, "b")
+		cmd = []string{"gen"}
+	)
+	writeFile(t, a, "same")
+	writeFile(t, b, "same")
+
+	rules := []JRule{
+		{Sources: []string{a}, Targets: []string{b}, Command: cmd},
+		{Sources: []string{b}, Targets: []string{a}, Command: cmd},
+		{Sources: []string{a}, Command: cmd},
+		{Targets: []string{a}, Command: cmd},
+		{Sources: []string{a, b}, Command: cmd},
+		{Targets: []string{a, b}, Command: cmd},
+	}
+	seen := make(map[string]int)
+	for i, rule := range rules {
+		h := hex.EncodeToString(contentHash(ctx, t, rule))
+		if j, ok := seen[h]; ok {
+			t.Errorf("rules %d and %d have the same content hash", j, i)
+		}
+		seen[h] = i
+	}
+}
+
+func TestDirHasher(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		srcDir  = filepath.Join(dir, "src")
+		srcFile = filepath.Join(dir, "file")
+		target  = filepath.Join(dir, "out")
+		version = "v1"
+		called  []string
+	)
+	writeFile(t, filepath.Join(srcDir, "a"), "a")
+	writeFile(t, srcFile, "file")
+	writeFile(t, filepath.Join(target, "b"), "b")
+
+	rule := JRule{
+		Sources: []string{srcDir, srcFile},
+		Targets: []string{target},
+		Command: []string{"true"},
+		DirHasher: func(_ context.Context, root string) ([]byte, error) {
+			called = append(called, root)
+			return []byte(version + ":" + filepath.Base(root)), nil
+		},
+	}
+
+	h1 := contentHash(ctx, t, rule)
+	sort.Strings(called)
+	if want := []string{target, srcDir}; !reflect.DeepEqual(called, want) {
+		t.Errorf("DirHasher called for %q, want %q", called, want)
+	}
+
+	// The DirHasher's result, not the directory's content, is what counts.
+	writeFile(t, filepath.Join(srcDir, "a"), "changed")
+	if h := contentHash(ctx, t, rule); !bytes.Equal(h, h1) {
+		t.Error("content hash changed with an unchanged DirHasher result")
+	}
+	version = "v2"
+	if h := contentHash(ctx, t, rule); bytes.Equal(h, h1) {
+		t.Error("content hash unchanged with a changed DirHasher result")
+	}
+}
+
+func TestCancelRemovesPartialTargets(t *testing.T) {
+	var (
+		dir       = t.TempDir()
+		partial   = filepath.Join(dir, "partial")
+		untouched = filepath.Join(dir, "untouched")
+		rule      = JRule{
+			Targets: []string{partial, untouched},
+			Command: []string{"sh", "-c", "echo partial > " + partial + " && sleep 10"},
+		}
+	)
+	writeFile(t, untouched, "untouched")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Cancel once the command has written its partial output.
+		for ctx.Err() == nil {
+			if _, err := os.Stat(partial); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if err := rule.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the partial target, want nonexistence", err)
+	}
+	checkFile(t, untouched, "untouched")
+
+	// An ordinary failure leaves the targets alone.
+	rule.Command = []string{"sh", "-c", "echo partial > " + partial + " && exit 1"}
+	if err := rule.Run(context.Background()); err == nil {
+		t.Fatal("no error from a failing command")
+	}
+	checkFile(t, partial, "partial\n")
+}
+
+func TestCancelRemovesGlobTargets(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		partial = filepath.Join(dir, "a.out")
+		rule    = JRule{
+			Targets: []string{filepath.Join(dir, "*.out")},
+			Command: []string{"sh", "-c", "echo partial > " + partial + " && sleep 10"},
+		}
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if _, err := os.Stat(partial); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// The glob matches nothing until the command runs,
+	// so the partial target is found only when it is expanded again.
+	if err := rule.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the partial target, want nonexistence", err)
+	}
+}
+
+func TestMinTargets(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		db   = newIterDB()
+		rule = JRule{
+			Targets:    []string{filepath.Join(dir, "*.out")},
+			Command:    []string{"true"},
+			MinTargets: 1,
+		}
+	)
+	if err := (&Fn{DB: db, Rule: rule}).Run(ctx); err == nil {
+		t.Error("no error from a glob target matching nothing")
+	}
+	if len(db.entries) != 0 {
+		t.Errorf("got %d DB entries after too few targets, want 0", len(db.entries))
+	}
+
+	rule.Command = []string{"touch", filepath.Join(dir, "a.out")}
+	if err := (&Fn{DB: db, Rule: rule}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.entries) != 1 {
+		t.Errorf("got %d DB entries, want 1", len(db.entries))
+	}
+
+	// MinTargets is not part of the hashes.
+	noMin := rule
+	noMin.MinTargets = 0
+	if !bytes.Equal(rule.RuleHash(), noMin.RuleHash()) {
+		t.Error("MinTargets changed the rule hash")
+	}
+	if !bytes.Equal(contentHash(ctx, t, rule), contentHash(ctx, t, noMin)) {
+		t.Error("MinTargets changed the content hash")
+	}
+}
+
+func TestJTreeWarn(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		bad = filepath.Join(dir, "bad", ".mghash.json")
+	)
+	writeFile(t, filepath.Join(dir, "good", ".mghash.json"), `{"sources": ["a"], "targets": ["b"], "command": ["gen"]}`)
+	writeFile(t, filepath.Join(dir, "good", "sub", ".mghash.json"), `{"targets": ["c"], "command": ["gen"]}`)
+	writeFile(t, bad, `{"sources": `)
+
+	rules, warnings, err := JTreeWarn(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Errorf("got %d rules, want 2", len(rules))
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("got warnings %v, want 1", warnings)
+	}
+	if !strings.Contains(warnings[0].Error(), bad) {
+		t.Errorf("got warning %q, want one naming %s", warnings[0], bad)
+	}
+
+	if _, err = JTree(dir); err == nil {
+		t.Error("no error from JTree for a tree with a bad file")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		src     = filepath.Join(dir, "src")
+		oldName = filepath.Join(dir, "old")
+		newName = filepath.Join(dir, "new")
+		runs    = filepath.Join(dir, "runs")
+		db      = NewMemDB()
+		command = []string{"sh", "-c", "echo >> " + runs}
+		before  = JRule{Sources: []string{src}, Targets: []string{oldName}, Command: command}
+	)
+	writeFile(t, src, "source")
+	writeFile(t, oldName, "target")
+	if err := db.Add(ctx, contentHash(ctx, t, before)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(oldName, newName); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		renamed = JRule{Sources: []string{src}, Targets: []string{newName}, Command: command}
+		aliased = renamed
+	)
+	aliased.Aliases = map[string]string{newName: oldName}
+	if !bytes.Equal(aliased.RuleHash(), renamed.RuleHash()) {
+		t.Error("aliases changed the rule hash")
+	}
+	if !bytes.Equal(contentHash(ctx, t, aliased), contentHash(ctx, t, renamed)) {
+		t.Error("aliases changed the content hash")
+	}
+
+	// Without the alias, the renamed rule is stale.
+	if stale, err := (&Fn{DB: db, Rule: renamed}).Stale(ctx); err != nil {
+		t.Fatal(err)
+	} else if !stale {
+		t.Error("renamed rule without an alias is up to date")
+	}
+
+	// With it, the entry under the old name is a hit,
+	// and the rule's new content hash is recorded.
+	if err := (&Fn{DB: db, Rule: aliased}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(runs); err == nil {
+		t.Error("aliased rule ran")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(ctx, contentHash(ctx, t, renamed)); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("new content hash not recorded after an alias hit")
+	}
+
+	// The old name need not exist, even with MinTargets.
+	aliased.MinTargets = 1
+	if err := (&Fn{DB: NewMemDB(), Rule: aliased}).Run(ctx); err != nil {
+		t.Errorf("running with a nonexistent alias: %s", err)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		src = filepath.Join(dir, "src")
+		db  = NewMemDB()
+		a   = JRule{Sources: []string{src}, Targets: []string{filepath.Join(dir, "a")}, Command: []string{"true"}}
+		b   = JRule{Sources: []string{src}, Targets: []string{filepath.Join(dir, "b")}, Command: []string{"true"}}
+	)
+	writeFile(t, src, "source")
+	if err := Seed(ctx, db, []JRule{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	bumped := a
+	bumped.Generation++
+	if bytes.Equal(bumped.RuleHash(), a.RuleHash()) {
+		t.Error("rule hash unchanged by a new generation")
+	}
+
+	for _, c := range []struct {
+		rule      JRule
+		wantStale bool
+	}{
+		{rule: bumped, wantStale: true},
+		{rule: b, wantStale: false},
+	} {
+		stale, err := (&Fn{DB: db, Rule: c.rule}).Stale(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale != c.wantStale {
+			t.Errorf("%s (generation %d): got stale %v, want %v", c.rule, c.rule.Generation, stale, c.wantStale)
+		}
+	}
+}
+
+func TestJDirSalted(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		root = t.TempDir()
+		// Absolute paths make the rules in the two directories identical.
+		rule = `{"dir": "/", "targets": ["` + filepath.Join(root, "x") + `"], "command": ["true"]}`
+		dirs = []string{filepath.Join(root, "a"), filepath.Join(root, "b")}
+	)
+	for _, dir := range dirs {
+		writeFile(t, filepath.Join(dir, ".mghash.json"), rule+`{"targets": ["y"], "command": ["true"], "salt": "mine"}`)
+	}
+
+	load := func(f func(string) ([]JRule, error)) [][]byte {
+		t.Helper()
+		var result [][]byte
+		for _, dir := range dirs {
+			rules, err := f(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 2 {
+				t.Fatalf("got %d rules in %s, want 2", len(rules), dir)
+			}
+			if rules[1].Salt != "mine" {
+				t.Errorf("got salt %q, want the rule's own", rules[1].Salt)
+			}
+			result = append(result, contentHash(ctx, t, rules[0]))
+		}
+		return result
+	}
+
+	if unsalted := load(JDir); !bytes.Equal(unsalted[0], unsalted[1]) {
+		t.Fatal("identical rules in different directories have different hashes without salting")
+	}
+	if salted := load(JDirSalted); bytes.Equal(salted[0], salted[1]) {
+		t.Error("identical rules in different directories have the same hash with salting")
+	}
+}
+
+func TestJDirMalformed(t *testing.T) {
+	cases := []struct {
+		desc, content, want string
+	}{
+		{desc: "truncated", content: `{"sources": ["a"`, want: "parsing"},
+		{desc: "not an object", content: `["a"]`, want: "parsing"},
+		{desc: "wrong type", content: `{"sources": 1}`, want: "parsing"},
+		{desc: "bad duration", content: `{"timeout": "5 minutes"}`, want: "parsing"},
+		{desc: "bad directive", content: `{"vars": ["a"]}`, want: "parsing directive"},
+		{desc: "undefined variable", content: `{"command": ["${MGHASH_TEST_UNDEFINED}"]}`, want: "in rule 1"},
+		{desc: "bad include", content: `{"include": ["other.json"]}`, want: "including"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, ".mghash.json"), c.content)
+			writeFile(t, filepath.Join(dir, "other.json"), "{")
+			rules, err := JDir(dir)
+			if err == nil {
+				t.Fatalf("got %d rules and no error", len(rules))
+			}
+			if msg := err.Error(); !strings.Contains(msg, c.want) || !strings.Contains(msg, filepath.Join(dir, ".mghash.json")) {
+				t.Errorf("got error %q, want one mentioning %q and the file", msg, c.want)
+			}
+		})
+	}
+
+	// A rule file that cannot be read.
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".mghash.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JDir(dir); err == nil || !strings.Contains(err.Error(), "reading") {
+		t.Errorf("got error %v, want one about reading the file", err)
+	}
+}
@@ -0,0 +1,80 @@
+package mghash
+
+import "github.com/pkg/errors"
+
+// standardizeJSON converts JSON with comments and trailing commas,
+// as may appear in hand-edited .mghash.json files,
+// to standard JSON.
+// Comments in both // and /* */ styles are replaced with spaces
+// (preserving newlines, so error offsets still point to the right line),
+// as are commas before a closing ] or }.
+func standardizeJSON(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	var (
+		inString bool
+		blank    = func(i, j int) {
+			for ; i < j; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	)
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+
+		case '/':
+			if i+1 >= len(out) {
+				break
+			}
+			switch out[i+1] {
+			case '/':
+				j := i + 2
+				for j < len(out) && out[j] != '\n' {
+					j++
+				}
+				blank(i, j)
+				i = j - 1
+
+			case '*':
+				j := i + 2
+				for j+1 < len(out) && !(out[j] == '*' && out[j+1] == '/') {
+					j++
+				}
+				if j+1 >= len(out) {
+					return nil, errors.New("unterminated comment")
+				}
+				blank(i, j+2)
+				i = j + 1
+			}
+
+		case ']', '}':
+			j := i - 1
+			for j >= 0 && isJSONSpace(out[j]) {
+				j--
+			}
+			if j >= 0 && out[j] == ',' {
+				out[j] = ' '
+			}
+		}
+	}
+	return out, nil
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,139 @@
+package mghash
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UnusedEntries returns the entries in db
+// that do not match the current state of any of the given rules:
+// their content hashes and alias hashes (see Aliaser).
+// These are candidates for pruning.
+// The db must be an Iterator
+// holding only the entries of these rules;
+// for a store shared with other rule sets,
+// use a DB scoped to this one,
+// such as one produced by Namespaced.
+// For rules run by Fns with a KeyFunc or BaseDir, use UnusedEntriesFns.
+func UnusedEntries(ctx context.Context, db DB, rules []JRule) ([][]byte, error) {
+	fns, err := Fns(db, rules)
+	if err != nil {
+		return nil, err
+	}
+	return UnusedEntriesFns(ctx, db, fns)
+}
+
+// UnusedEntriesFns is like UnusedEntries,
+// but computes the keys of the rules in fns the way Fn.Run does,
+// honoring each Fn's KeyFunc and BaseDir.
+func UnusedEntriesFns(ctx context.Context, db DB, fns []*Fn) ([][]byte, error) {
+	it, ok := db.(Iterator)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot enumerate its entries", db)
+	}
+
+	current := make(map[string]struct{})
+	for _, f := range fns {
+		keys, err := f.liveKeys(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "computing keys of %s", f.Rule)
+		}
+		for _, k := range keys {
+			current[string(k)] = struct{}{}
+		}
+	}
+
+	var result [][]byte
+	err := it.ForEach(ctx, func(h []byte, _ time.Time) error {
+		if _, ok := current[string(h)]; !ok {
+			result = append(result, h)
+		}
+		return nil
+	})
+	return result, errors.Wrap(err, "enumerating DB entries")
+}
+
+// liveKeys returns the keys under which f.Run would find f.Rule up to date:
+// its content hash (or the result of KeyFunc)
+// and, without KeyFunc, its alias hashes.
+func (f *Fn) liveKeys(ctx context.Context) ([][]byte, error) {
+	f, err := f.rebased()
+	if err != nil {
+		return nil, err
+	}
+	h, err := f.computeKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := [][]byte{h}
+	if a, ok := f.Rule.(Aliaser); ok && f.KeyFunc == nil {
+		aliases, err := a.AliasHashes(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "computing alias hashes")
+		}
+		for _, alias := range aliases {
+			result = append(result, f.withEpoch(alias))
+		}
+	}
+	return result, nil
+}
+
+// Reconcile removes from db the entries that do not match
+// the current content hash of any of the given rules
+// (see UnusedEntries),
+// returning the number removed.
+// The db must be both an Iterator and a Deleter,
+// holding only the entries of these rules.
+// Since an empty set of rules would remove every entry,
+// it is an error.
+// For rules run by Fns with a KeyFunc or BaseDir, use ReconcileFns.
+func Reconcile(ctx context.Context, db DB, rules []JRule) (removed int, err error) {
+	fns, err := Fns(db, rules)
+	if err != nil {
+		return 0, err
+	}
+	return ReconcileFns(ctx, db, fns)
+}
+
+// ReconcileFns is like Reconcile,
+// but computes the keys of the rules in fns the way Fn.Run does
+// (see UnusedEntriesFns).
+func ReconcileFns(ctx context.Context, db DB, fns []*Fn) (removed int, err error) {
+	if len(fns) == 0 {
+		return 0, errors.New("no rules to reconcile with")
+	}
+	d, ok := db.(Deleter)
+	if !ok {
+		return 0, fmt.Errorf("%T cannot delete entries", db)
+	}
+	unused, err := UnusedEntriesFns(ctx, db, fns)
+	if err != nil {
+		return 0, err
+	}
+	if len(unused) == 0 {
+		return 0, nil
+	}
+	if err = d.Delete(ctx, unused...); err != nil {
+		return 0, errors.Wrap(err, "deleting unused entries")
+	}
+	return len(unused), nil
+}
+
+// Seed records the current state of each of the given rules in db,
+// marking them all as up to date without running any commands.
+// This is useful e.g. in a fresh checkout
+// whose committed targets are known to be current.
+func Seed(ctx context.Context, db DB, rules []JRule) error {
+	hashes := make([][]byte, 0, len(rules))
+	for _, rule := range rules {
+		h, err := (&Fn{Rule: rule}).computeKey(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "computing content hash of %s", rule)
+		}
+		hashes = append(hashes, h)
+	}
+	return errors.Wrap(AddMany(ctx, db, hashes), "adding hashes")
+}
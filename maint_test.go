@@ -0,0 +1,224 @@
+package mghash
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// iterDB is a DB that is also an Iterator and a Deleter.
+type iterDB struct {
+	mu      sync.Mutex
+	entries map[string]bool
+}
+
+var (
+	_ Iterator = &iterDB{}
+	_ Deleter  = &iterDB{}
+)
+
+func newIterDB(hashes ...[]byte) *iterDB {
+	db := &iterDB{entries: make(map[string]bool)}
+	for _, h := range hashes {
+		db.entries[string(h)] = true
+	}
+	return db
+}
+
+func (db *iterDB) Has(_ context.Context, h []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.entries[string(h)], nil
+}
+
+func (db *iterDB) Add(_ context.Context, h []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[string(h)] = true
+	return nil
+}
+
+func (db *iterDB) ForEach(ctx context.Context, f func([]byte, time.Time) error) error {
+	db.mu.Lock()
+	keys := make([]string, 0, len(db.entries))
+	for k := range db.entries {
+		keys = append(keys, k)
+	}
+	db.mu.Unlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f([]byte(k), time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *iterDB) Delete(_ context.Context, hashes ...[]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, h := range hashes {
+		delete(db.entries, string(h))
+	}
+	return nil
+}
+
+func TestUnusedEntries(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		src     = filepath.Join(dir, "src")
+		target  = filepath.Join(dir, "target")
+		renamed = filepath.Join(dir, "renamed")
+	)
+	writeFile(t, src, "source")
+	writeFile(t, target, "target")
+	writeFile(t, renamed, "target")
+
+	var (
+		current = JRule{Sources: []string{src}, Targets: []string{target}, Command: []string{"gen"}}
+		aliased = JRule{Sources: []string{src}, Targets: []string{renamed}, Command: []string{"gen2"}, Aliases: map[string]string{renamed: target}}
+		old     = JRule{Sources: []string{src}, Targets: []string{target}, Command: []string{"oldgen"}}
+	)
+	aliasHashes, err := aliased.AliasHashes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		currentHash = contentHash(ctx, t, current)
+		aliasHash   = aliasHashes[0]
+		oldHash     = contentHash(ctx, t, old)
+		db          = newIterDB(currentHash, aliasHash, oldHash)
+	)
+
+	unused, err := UnusedEntries(ctx, db, []JRule{current, aliased})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unused) != 1 || string(unused[0]) != string(oldHash) {
+		t.Errorf("got unused entries %x, want only %x", unused, oldHash)
+	}
+
+	// With a KeyFunc, only its key is live.
+	keyFunc := func(_ context.Context, r Rule) ([]byte, error) {
+		return []byte("key:" + r.String()), nil
+	}
+	db = newIterDB(currentHash, []byte("key:"+current.String()))
+	unused, err = UnusedEntriesFns(ctx, db, []*Fn{{Rule: current, KeyFunc: keyFunc}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unused) != 1 || string(unused[0]) != string(currentHash) {
+		t.Errorf("got unused entries %x with KeyFunc, want only %x", unused, currentHash)
+	}
+
+	if _, err = UnusedEntries(ctx, NewMemDB(), []JRule{current}); err == nil {
+		t.Error("no error from a DB that is not an Iterator")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		db     = NewMemDB()
+		rule   = JRule{
+			Sources: []string{src},
+			Targets: []string{target},
+			// The generator is not available.
+			Command: []string{"false"},
+		}
+	)
+	writeFile(t, src, "source")
+	writeFile(t, target, "committed output")
+
+	if err := Seed(ctx, db, []JRule{rule}); err != nil {
+		t.Fatal(err)
+	}
+	f := &Fn{DB: db, Rule: rule}
+	if stale, err := f.Stale(ctx); err != nil {
+		t.Fatal(err)
+	} else if stale {
+		t.Error("rule stale after seeding")
+	}
+	if err := f.Run(ctx); err != nil {
+		t.Errorf("running a seeded rule: %s", err)
+	}
+
+	// Seeding records the current state, so later changes still count.
+	writeFile(t, src, "changed")
+	if stale, err := f.Stale(ctx); err != nil {
+		t.Fatal(err)
+	} else if !stale {
+		t.Error("rule not stale after changing its source")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		rule   = JRule{Sources: []string{src}, Targets: []string{target}, Command: []string{"gen"}}
+	)
+	writeFile(t, src, "source")
+	writeFile(t, target, "target")
+
+	var (
+		current = contentHash(ctx, t, rule)
+		db      = newIterDB(current, []byte("old1"), []byte("old2"))
+	)
+	removed, err := Reconcile(ctx, db, []JRule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("got %d removed, want 2", removed)
+	}
+	if len(db.entries) != 1 || !db.entries[string(current)] {
+		t.Errorf("got %d entries, want only the current content hash", len(db.entries))
+	}
+
+	// Running it again removes nothing.
+	if removed, err = Reconcile(ctx, db, []JRule{rule}); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Errorf("got %d removed on a second pass, want 0", removed)
+	}
+
+	// No rules means no way to tell which entries are in use.
+	if _, err = Reconcile(ctx, db, nil); err == nil {
+		t.Error("no error reconciling with no rules")
+	}
+	if _, err = ReconcileFns(ctx, db, nil); err == nil {
+		t.Error("no error reconciling with no Fns")
+	}
+	if len(db.entries) != 1 {
+		t.Errorf("got %d entries after refusing to reconcile, want 1", len(db.entries))
+	}
+
+	// ReconcileFns uses each Fn's key.
+	keyFunc := func(_ context.Context, r Rule) ([]byte, error) {
+		return []byte("key:" + r.String()), nil
+	}
+	db = newIterDB(current, []byte("key:"+rule.String()))
+	if removed, err = ReconcileFns(ctx, db, []*Fn{{Rule: rule, KeyFunc: keyFunc}}); err != nil {
+		t.Fatal(err)
+	} else if removed != 1 || db.entries[string(current)] {
+		t.Errorf("got %d removed with KeyFunc, want only the content hash", removed)
+	}
+
+	if _, err = Reconcile(ctx, NewMemDB(), []JRule{rule}); err == nil {
+		t.Error("no error from a DB that is not a Deleter")
+	}
+}
@@ -0,0 +1,73 @@
+package mghash
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestLines is the default value of JRule.ResolveSources.
+// It reads the file at path and returns the paths it lists, one per line.
+// Blank lines and lines beginning with # are ignored.
+// Relative paths are relative to the directory containing the manifest.
+func ManifestLines(ctx context.Context, path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+
+	var (
+		result []string
+		dir    = filepath.Dir(path)
+		sc     = bufio.NewScanner(f)
+	)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		result = append(result, line)
+	}
+	return result, errors.Wrapf(sc.Err(), "reading %s", path)
+}
+
+// allSources returns the files to hash as jr's sources:
+// its script, its ignore file, its manifest, its declared sources (with globs expanded),
+// and the sources listed in the manifest.
+func (jr JRule) allSources(ctx context.Context) ([]string, error) {
+	sources, err := jr.sources()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	if jr.Script != "" {
+		result = append(result, jr.scriptPath())
+	}
+	if jr.IgnoreFile != "" {
+		result = append(result, jr.IgnoreFile)
+	}
+	if jr.Manifest == "" {
+		return append(result, sources...), nil
+	}
+	result = append(result, jr.Manifest)
+	result = append(result, sources...)
+
+	resolve := jr.ResolveSources
+	if resolve == nil {
+		resolve = ManifestLines
+	}
+	listed, err := resolve(ctx, jr.Manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving sources from %s", jr.Manifest)
+	}
+	return append(result, listed...), nil
+}
@@ -0,0 +1,62 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		dir      = t.TempDir()
+		manifest = filepath.Join(dir, "sources.txt")
+		a        = filepath.Join(dir, "a")
+		b        = filepath.Join(dir, "sub", "b")
+		rule     = JRule{Manifest: manifest, Command: []string{"gen"}}
+	)
+	writeFile(t, a, "a")
+	writeFile(t, b, "b")
+	writeFile(t, manifest, "# sources\na\n\n")
+
+	sources, err := rule.SourceFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{manifest, a}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %q, want %q", sources, want)
+	}
+	h1 := contentHash(ctx, t, rule)
+
+	// Adding a source to the manifest includes it in the rule.
+	writeFile(t, manifest, "# sources\na\nsub/b\n")
+	sources, err = rule.SourceFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{manifest, a, b}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %q, want %q", sources, want)
+	}
+	h2 := contentHash(ctx, t, rule)
+	if bytes.Equal(h1, h2) {
+		t.Error("content hash unchanged after adding a source to the manifest")
+	}
+
+	// The new source's content is part of the hash.
+	writeFile(t, b, "changed")
+	if h := contentHash(ctx, t, rule); bytes.Equal(h, h2) {
+		t.Error("content hash unchanged after changing a source listed in the manifest")
+	}
+
+	// A custom resolver.
+	rule.ResolveSources = func(context.Context, string) ([]string, error) {
+		return []string{a}, nil
+	}
+	if sources, err = rule.SourceFiles(ctx); err != nil {
+		t.Fatal(err)
+	} else if want := []string{manifest, a}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %q with a custom resolver, want %q", sources, want)
+	}
+}
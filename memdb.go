@@ -0,0 +1,90 @@
+package mghash
+
+import (
+	"context"
+	"sync"
+)
+
+// MemDB is an in-memory implementation of DB,
+// e.g. for tests and short-lived builds.
+type MemDB struct {
+	mu      sync.RWMutex
+	entries map[string]struct{}
+
+	// Entries in the order they were added,
+	// for evicting the oldest when there are more than max.
+	// This is tracked only when max is positive.
+	order []string
+	max   int
+}
+
+var _ DB = &MemDB{}
+
+// MemOpt is the type of an option that can be passed to NewMemDB.
+type MemOpt func(*MemDB)
+
+// MaxEntries is a MemOpt that limits the number of entries in a MemDB.
+// When adding an entry would exceed n,
+// the entry that was added longest ago is evicted.
+// By default there is no limit.
+func MaxEntries(n int) MemOpt {
+	return func(db *MemDB) {
+		db.max = n
+	}
+}
+
+// NewMemDB produces a new, empty MemDB.
+func NewMemDB(opts ...MemOpt) *MemDB {
+	db := &MemDB{entries: make(map[string]struct{})}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// Has implements DB.Has.
+func (db *MemDB) Has(_ context.Context, h []byte) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, ok := db.entries[string(h)]
+	return ok, nil
+}
+
+// Add implements DB.Add.
+func (db *MemDB) Add(_ context.Context, h []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k := string(h)
+	if _, ok := db.entries[k]; ok {
+		return nil
+	}
+	db.entries[k] = struct{}{}
+	if db.max <= 0 {
+		return nil
+	}
+	db.order = append(db.order, k)
+	if n := len(db.order) - db.max; n > 0 {
+		for _, old := range db.order[:n] {
+			delete(db.entries, old)
+		}
+		// Shift the remaining entries down instead of reslicing,
+		// so that the backing array does not hold on to evicted keys
+		// or keep growing.
+		copy(db.order, db.order[n:])
+		for i := db.max; i < len(db.order); i++ {
+			db.order[i] = ""
+		}
+		db.order = db.order[:db.max]
+	}
+	return nil
+}
+
+// Len tells the number of entries in db.
+func (db *MemDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.entries)
+}
@@ -0,0 +1,56 @@
+package mghash
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestMaxEntries(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = NewMemDB(MaxEntries(3))
+	)
+	for i := 0; i < 100; i++ {
+		if err := db.Add(ctx, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		want := i + 1
+		if want > 3 {
+			want = 3
+		}
+		if got := db.Len(); got != want {
+			t.Fatalf("got %d entries after %d additions, want %d", got, i+1, want)
+		}
+	}
+
+	// Only the three most recent entries remain.
+	for i := 0; i < 100; i++ {
+		ok, err := db.Has(ctx, []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i >= 97; ok != want {
+			t.Errorf("got Has %v for entry %d, want %v", ok, i, want)
+		}
+	}
+
+	// Adding an existing entry neither evicts anything nor refreshes it.
+	if err := db.Add(ctx, []byte("97")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Len(); got != 3 {
+		t.Errorf("got %d entries after re-adding one, want 3", got)
+	}
+	if err := db.Add(ctx, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := db.Has(ctx, []byte("97")); ok {
+		t.Error("oldest entry not evicted")
+	}
+
+	// The eviction order does not grow past the limit.
+	if n := cap(db.order); n > 6 {
+		t.Errorf("got eviction order capacity %d, want at most 6", n)
+	}
+}
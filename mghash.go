@@ -2,12 +2,11 @@ package mghash
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"reflect"
-	"runtime"
+	"strings"
+	"time"
 
 	json "github.com/gibson042/canonicaljson-go"
 	"github.com/magefile/mage/mg"
@@ -26,6 +25,181 @@ import (
 type Fn struct {
 	DB   DB
 	Rule Rule
+
+	// DBs are additional databases to use alongside DB (which may be nil).
+	// They are consulted in order, DB first,
+	// and the first one reporting a hit wins.
+	// A read error from one falls through to the next,
+	// and is reported only if every database fails.
+	// On a miss the new entry is added to all of them,
+	// and any write errors are reported together.
+	DBs []DB
+
+	// After lists Fns that must run before this one.
+	// They are run with mg.CtxDeps before Rule's content hash is computed.
+	// This affects ordering only:
+	// whether Rule runs still depends solely on its content hash.
+	// Run reports an error if the Fns in After
+	// (and theirs, and so on)
+	// include this one.
+	After []mg.Fn
+
+	// KeyFunc, if set, computes the key under which the state of Rule is recorded in DB.
+	// This is a hook for scoping or versioning DB entries.
+	// The default is Rule.ContentHash.
+	KeyFunc func(context.Context, Rule) ([]byte, error)
+
+	// Labels are attached to the entry recorded for Rule
+	// in each database that is a Labeler.
+	Labels []string
+
+	// OnProduced, if set, is called after Rule runs
+	// with the files it created or modified among its targets,
+	// including the contents of target directories.
+	// This requires Rule to be a Targeter.
+	OnProduced func(rule Rule, files []string)
+
+	// Tracer, if set, is notified of the phases of Run,
+	// e.g. for recording tracing spans.
+	Tracer Tracer
+
+	// MtimeCheck, if set, is a sanity check applied when Rule is found to be up to date.
+	// If any of its sources has a modification time newer than all of its targets,
+	// a warning is logged
+	// and, with MtimeRebuild, the rule runs anyway.
+	// Content hashes remain the source of truth;
+	// this is a heuristic defense against a corrupted DB.
+	// It requires Rule to be both a Sourcer and a Targeter.
+	MtimeCheck MtimeCheck
+
+	// OnHashed, if set, is called after each computation of Rule's content hash
+	// (or KeyFunc)
+	// with the time it took.
+	// This helps find rules that are slow to hash.
+	OnHashed func(rule Rule, dur time.Duration)
+
+	// OnSkipped, if set, is called when Run finds Rule to be a Gater
+	// whose Gate returns false,
+	// so that Rule neither runs nor has its hash recorded.
+	OnSkipped func(rule Rule)
+
+	// BaseDir, if set, is a directory against which Rule's relative paths are resolved,
+	// both for hashing and for running.
+	// This allows one set of rules to operate on different working trees.
+	// It requires Rule to be a Rebaser.
+	BaseDir string
+
+	// HashAlgo is the hash algorithm for ID (and for mixing in Epoch).
+	// The default is the one named in the config file (see Config.HashAlgo),
+	// and otherwise SHA256.
+	// It does not affect Rule's hashes.
+	HashAlgo *HashAlgo
+
+	// Epoch, if set, is mixed into the keys under which Rule is found and recorded in the DBs,
+	// so that changing it invalidates all of them at once,
+	// e.g. after a toolchain upgrade that the rules' hashes do not capture.
+	// The default is the Epoch in the config file, if any.
+	Epoch string
+
+	// Force causes Rule to run even if it is up to date.
+	// Its new content hash is still recorded afterward.
+	Force bool
+
+	// Artifacts, if set, saves Rule's targets after it runs,
+	// keyed by Rule's input hash.
+	// That key is scoped like the one in DB:
+	// KeyFunc, if set, is applied to Rule with its input hash in place of its content hash,
+	// and Epoch is mixed in.
+	// When Rule is not up to date,
+	// but its input hash matches an earlier run
+	// (e.g. because its targets were deleted),
+	// the saved targets are restored in place of running Rule,
+	// replacing any existing ones.
+	// OnProduced is not called for restored targets.
+	// This requires Rule to be both an InputHasher and a Targeter.
+	// Symlinks among the targets are saved as symlinks.
+	// Restoring writes only within Rule's declared targets,
+	// and fails for an artifact with entries outside them.
+	Artifacts ArtifactStore
+
+	// TempDir, if set, is the directory for the temporary files
+	// that targets restored from Artifacts are written to
+	// before being renamed into place.
+	// It must be on the same filesystem as the targets.
+	// The default is the directory of each target.
+	TempDir string
+
+	// Metrics, if set, is notified of cache hits and misses
+	// and of the rule running,
+	// e.g. for counting them with Prometheus.
+	Metrics Metrics
+}
+
+// Metrics observes the outcomes of Fn.Run.
+// See Fn.Metrics.
+type Metrics interface {
+	// OnHit is called when a rule is found to be up to date.
+	OnHit(Rule)
+
+	// OnMiss is called when a rule is found not to be up to date.
+	// It is not called for a rule that runs regardless (see Fn.Force).
+	OnMiss(Rule)
+
+	// OnRun is called after a rule runs,
+	// with the time it took and its error, if any.
+	OnRun(rule Rule, dur time.Duration, err error)
+}
+
+// NopMetrics is a Metrics that does nothing.
+// It can be embedded in a type that implements only some of the Metrics methods.
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+// OnHit implements Metrics.OnHit.
+func (NopMetrics) OnHit(Rule) {}
+
+// OnMiss implements Metrics.OnMiss.
+func (NopMetrics) OnMiss(Rule) {}
+
+// OnRun implements Metrics.OnRun.
+func (NopMetrics) OnRun(Rule, time.Duration, error) {}
+
+// Tracer observes the phases of Fn.Run.
+// See the otel subpackage for an implementation using OpenTelemetry.
+type Tracer interface {
+	// StartFn is called at the beginning of Fn.Run.
+	// It returns a context to use for the rest of the call,
+	// and a function to call at the end of it,
+	// telling whether the rule was up to date and any error.
+	StartFn(context.Context, Rule) (context.Context, func(hit bool, err error))
+
+	// StartRule is called just before Fn.Run runs its rule.
+	// It returns a context to pass to Rule.Run,
+	// and a function to call with the result.
+	StartRule(context.Context, Rule) (context.Context, func(error))
+}
+
+// HashTracer is a Tracer that also observes
+// the computation of content hashes in Fn.Run
+// (by Rule.ContentHash or Fn.KeyFunc).
+type HashTracer interface {
+	Tracer
+
+	// StartHash is called just before the content hash of a rule is computed.
+	// It returns a context to use for computing it,
+	// and a function to call with the result.
+	StartHash(context.Context, Rule) (context.Context, func(error))
+}
+
+// DBTracer is a Tracer that also observes the calls that Fn.Run makes to its DBs.
+type DBTracer interface {
+	Tracer
+
+	// StartDB is called just before calling the method op ("Has" or "Add") of db.
+	// It returns a context to pass to the method,
+	// and a function to call with its error.
+	StartDB(ctx context.Context, db DB, op string) (context.Context, func(error))
 }
 
 // Rule knows how to report a hash representing itself,
@@ -60,50 +234,755 @@ type DB interface {
 	Add(context.Context, []byte) error
 }
 
+// Gater is a Rule that can decide whether it applies at all.
+type Gater interface {
+	Rule
+
+	// Gate reports whether the rule should be considered.
+	// If it returns false,
+	// Fn.Run neither runs the rule nor records its hash.
+	Gate(context.Context) (bool, error)
+}
+
+// Freshener is a Rule that decides for itself whether it is up to date,
+// e.g. from the last-modified time of an external resource.
+// Fn.Run uses Fresh in place of content hashing for such a rule,
+// and neither consults nor updates its DBs.
+// See FreshRule.
+type Freshener interface {
+	Rule
+
+	// Fresh reports whether the rule is up to date.
+	Fresh(context.Context) (bool, error)
+}
+
+// AlwaysRunner is a Rule that may need to run even when it is up to date,
+// e.g. for deploying or testing.
+// When AlwaysRun returns true,
+// Fn.Run treats the rule as if Fn.Force were set.
+// See PhonyRule.
+type AlwaysRunner interface {
+	Rule
+
+	// AlwaysRun tells whether the rule must run.
+	AlwaysRun() bool
+}
+
+// Aliaser is a Rule that may have been recorded in a DB under other keys,
+// e.g. before its targets were renamed.
+// When Fn.Run does not find a Rule's content hash in its DB,
+// it checks the alias hashes too.
+// If one is found,
+// the rule is up to date,
+// and its content hash is added to the DB.
+// Aliases are not consulted when Fn.KeyFunc is set.
+type Aliaser interface {
+	Rule
+
+	// AliasHashes returns the alternative content hashes of the rule.
+	AliasHashes(context.Context) ([][]byte, error)
+}
+
+// Rebaser is a Rule that can resolve its relative paths against a base directory.
+// See Fn.BaseDir.
+type Rebaser interface {
+	Rule
+
+	// Rebase returns a copy of the rule with paths resolved against dir.
+	Rebase(dir string) Rule
+}
+
+// Targeter is a Rule that can list its targets.
+type Targeter interface {
+	Rule
+
+	// TargetFiles returns the rule's targets.
+	// Some of them may be directories.
+	TargetFiles() []string
+}
+
+// Sourcer is a Rule that can list its sources.
+type Sourcer interface {
+	Rule
+
+	// SourceFiles returns the rule's sources.
+	// Some of them may be directories.
+	SourceFiles(context.Context) ([]string, error)
+}
+
+// Iterator is a DB that can enumerate its entries.
+type Iterator interface {
+	DB
+
+	// ForEach calls f for each entry in the database,
+	// together with the entry's last-access time.
+	// If f returns an error, iteration stops and ForEach returns that error.
+	// Iteration also stops, with ctx's error, if ctx is canceled.
+	// Entries are not all loaded into memory at once,
+	// so this is suitable for large databases.
+	ForEach(ctx context.Context, f func(h []byte, lastAccess time.Time) error) error
+}
+
+// Deleter is a DB that can remove entries.
+type Deleter interface {
+	DB
+
+	// Delete removes the given entries from the database.
+	// Entries that are not present are ignored.
+	Delete(ctx context.Context, hashes ...[]byte) error
+}
+
+// BatchAdder is a DB that can add many entries at once,
+// more efficiently than by calling Add for each.
+// See AddMany.
+type BatchAdder interface {
+	DB
+
+	// AddMany adds the given entries to the database,
+	// as if by calling Add for each.
+	AddMany(ctx context.Context, hashes [][]byte) error
+}
+
+// AddMany adds hashes to db.
+// It uses db's AddMany method if db is a BatchAdder,
+// and otherwise calls Add for each hash.
+func AddMany(ctx context.Context, db DB, hashes [][]byte) error {
+	if b, ok := db.(BatchAdder); ok {
+		return b.AddMany(ctx, hashes)
+	}
+	for _, h := range hashes {
+		if err := db.Add(ctx, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reserver is a DB that lets concurrent builds avoid running the same rule at once.
+// When one of an Fn's DBs is a Reserver,
+// Fn.Run reserves the rule's content hash before running the rule
+// and releases it afterward.
+// If another caller holds the reservation,
+// Run waits until it is released,
+// then computes the content hash again,
+// finding the rule up to date if the other caller built it in the same tree.
+type Reserver interface {
+	DB
+
+	// CheckAndReserve atomically checks that h is neither in the database
+	// nor reserved by another caller,
+	// and if so reserves it,
+	// reporting whether it did.
+	CheckAndReserve(ctx context.Context, h []byte) (bool, error)
+
+	// Release gives up a reservation made with CheckAndReserve.
+	Release(ctx context.Context, h []byte) error
+}
+
+// Statser is a DB that can report statistics about its entries.
+type Statser interface {
+	DB
+
+	Stats(context.Context) (Stats, error)
+}
+
+// Stats describes the entries in a DB.
+type Stats struct {
+	// Entries is the number of entries.
+	Entries int
+
+	// Bytes is the total length of the hashes,
+	// not counting storage overhead
+	// (such as hex encoding).
+	Bytes int64
+
+	// Oldest and Newest are the earliest and latest last-access times of the entries.
+	// They are zero when there are no entries.
+	Oldest, Newest time.Time
+}
+
+// Labeler is a DB that can attach labels to its entries,
+// e.g. for bulk deletion.
+type Labeler interface {
+	DB
+
+	// AddWithLabels adds an entry to the database with the given labels.
+	AddWithLabels(context.Context, []byte, ...string) error
+}
+
 var _ mg.Fn = &Fn{}
 
 // Name implements mg.Fn.
+// It is the rule's String value.
 func (f *Fn) Name() string {
-	// As suggested at https://pkg.go.dev/github.com/magefile/mage@v1.13.0/mg#Fn.
-	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return f.Rule.String()
 }
 
 // ID implements mg.Fn.
+// It depends only on the type of f.Rule and its rule hash,
+// so Fns for equal rules have the same ID
+// (and mage runs only one of them)
+// in any build of any program.
 func (f *Fn) ID() string {
 	s := struct {
-		Name     string `json:"name"`
+		Type     string `json:"type"`
 		RuleHash []byte `json:"rule_hash"`
 	}{
-		Name:     f.Name(),
+		Type:     fmt.Sprintf("%T", f.Rule),
 		RuleHash: f.Rule.RuleHash(),
 	}
 	j, _ := json.Marshal(s)
-	sum := sha256.Sum256(j)
-	return hex.EncodeToString(sum[:])
+	return hex.EncodeToString(domainHash(f.algo(), fnIDDomain, j))
 }
 
+// fnIDDomain is the domain-separation tag for Fn.ID.
+const fnIDDomain = "mghash.Fn.ID"
+
 // Run implements mg.Fn.
 func (f *Fn) Run(ctx context.Context) error {
-	h, err := f.Rule.ContentHash(ctx)
+	_, err := f.runTraced(ctx)
+	return err
+}
+
+// RunCapture is like Run,
+// but collects the standard output and standard error of the rule's command
+// and returns them to the caller
+// rather than writing them to the console.
+// It also tells whether the rule ran.
+// Output is captured only for JRules.
+func (f *Fn) RunCapture(ctx context.Context) (output []byte, rebuilt bool, err error) {
+	c := new(capture)
+	_, err = f.runTraced(context.WithValue(ctx, captureKey{}, c))
+	return c.buf.Bytes(), c.ran, err
+}
+
+// runTraced does the work of Run,
+// applying BaseDir and Tracer.
+func (f *Fn) runTraced(ctx context.Context) (bool, error) {
+	if err := f.afterCycle(); err != nil {
+		return false, err
+	}
+	f, err := f.rebased()
+	if err != nil {
+		return false, err
+	}
+	if f.Tracer == nil {
+		return f.run(ctx)
+	}
+	ctx, end := f.Tracer.StartFn(ctx, f.Rule)
+	hit, err := f.run(ctx)
+	end(hit, err)
+	return hit, err
+}
+
+// rebased returns f with f.BaseDir applied to f.Rule
+// (or f itself if f.BaseDir is not set).
+func (f *Fn) rebased() (*Fn, error) {
+	if f.BaseDir == "" {
+		return f, nil
+	}
+	r, ok := f.Rule.(Rebaser)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support BaseDir", f.Rule)
+	}
+	f2 := *f
+	f2.Rule = r.Rebase(f.BaseDir)
+	f2.BaseDir = ""
+	return &f2, nil
+}
+
+// run does the work of Run,
+// reporting whether the rule was found to be up to date.
+func (f *Fn) run(ctx context.Context) (bool, error) {
+	if err := f.algo().check(); err != nil {
+		return false, err
+	}
+
+	if len(f.After) > 0 {
+		deps := make([]interface{}, 0, len(f.After))
+		for _, dep := range f.After {
+			deps = append(deps, dep)
+		}
+		// Output from prerequisites is not captured (see RunCapture).
+		mg.CtxDeps(context.WithValue(ctx, captureKey{}, (*capture)(nil)), deps...)
+	}
+
+	if g, ok := f.Rule.(Gater); ok {
+		ok, err := g.Gate(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "evaluating gate")
+		}
+		if !ok {
+			if verbose() {
+				log.Printf("%s skipped", f.Rule)
+			}
+			if f.OnSkipped != nil {
+				f.OnSkipped(f.Rule)
+			}
+			return false, nil
+		}
+	}
+
+	if fr, ok := f.Rule.(Freshener); ok {
+		return f.runFresh(ctx, fr)
+	}
+
+	if !f.forced() {
+		ok, release, err := f.upToDateOrReserve(ctx)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			if verbose() {
+				log.Printf("%s up to date", f.Rule)
+			}
+			f.onHit()
+			return true, nil
+		}
+		if release != nil {
+			defer release()
+		}
+		f.onMiss()
+	}
+
+	if f.Artifacts != nil && !f.forced() {
+		ok, err := f.restore(ctx)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			h, err := f.key(ctx)
+			if err != nil {
+				return false, errors.Wrap(err, "recomputing content hash")
+			}
+			if err = f.add(ctx, h); err != nil {
+				return false, err
+			}
+			if verbose() {
+				log.Printf("%s restored", f.Rule)
+			}
+			return true, nil
+		}
+	}
+
+	var (
+		targeter, _ = f.Rule.(Targeter)
+		before      snapshot
+		err         error
+	)
+	if f.OnProduced != nil && targeter != nil {
+		if before, err = takeSnapshot(targeter.TargetFiles()); err != nil {
+			return false, errors.Wrap(err, "snapshotting targets")
+		}
+	}
+
+	if err = f.runRule(ctx); err != nil {
+		return false, errors.Wrap(err, "in Run")
+	}
+	h, err := f.key(ctx)
 	if err != nil {
-		return errors.Wrap(err, "computing content hash")
+		return false, errors.Wrap(err, "recomputing content hash")
+	}
+	// The artifact is saved before the hash is recorded,
+	// so a rule is not up to date if saving fails.
+	if f.Artifacts != nil {
+		if err = f.save(ctx); err != nil {
+			return false, err
+		}
+	}
+	if err = f.add(ctx, h); err != nil {
+		return false, err
 	}
-	ok, err := f.DB.Has(ctx, h)
+
+	if f.OnProduced != nil && targeter != nil {
+		after, err := takeSnapshot(targeter.TargetFiles())
+		if err != nil {
+			return false, errors.Wrap(err, "snapshotting targets")
+		}
+		f.OnProduced(f.Rule, after.changedSince(before))
+	}
+	return false, nil
+}
+
+// upToDate tells whether f.Rule's content hash (or an alias hash) is in f's DBs,
+// subject to f.MtimeCheck.
+// It also returns the content hash.
+// If record is true,
+// an alias hit causes the content hash to be added to the DBs.
+func (f *Fn) upToDate(ctx context.Context, record bool) (bool, []byte, error) {
+	h, err := f.key(ctx)
 	if err != nil {
-		return errors.Wrap(err, "consulting hash DB")
+		return false, nil, errors.Wrap(err, "computing content hash")
+	}
+	ok, err := f.has(ctx, h)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "consulting hash DB")
+	}
+	if !ok {
+		if ok, err = f.hasAlias(ctx); err != nil {
+			return false, nil, err
+		}
+		if ok && record {
+			if err = f.add(ctx, h); err != nil {
+				return false, nil, err
+			}
+		}
 	}
-	if ok {
-		if mg.Verbose() {
-			log.Printf("%s up to date", f.Rule)
+	if ok && f.MtimeCheck != MtimeIgnore {
+		stale, err := f.mtimeStale(ctx)
+		if err != nil {
+			return false, nil, errors.Wrap(err, "checking modification times")
 		}
-		return nil
+		ok = !stale || f.MtimeCheck == MtimeWarn
 	}
-	if err = f.Rule.Run(ctx); err != nil {
-		return errors.Wrap(err, "in Run")
+	return ok, h, nil
+}
+
+// upToDateOrReserve is like upToDate (with record set),
+// but if f.Rule is not up to date
+// and one of f's DBs is a Reserver,
+// it reserves the content hash,
+// returning a function that releases the reservation.
+// While another caller holds the reservation,
+// it waits, checking again every reservePoll,
+// until the rule is up to date or the reservation can be had.
+func (f *Fn) upToDateOrReserve(ctx context.Context) (bool, func(), error) {
+	r := f.reserver()
+	for {
+		ok, h, err := f.upToDate(ctx, true)
+		if err != nil || ok || r == nil {
+			return ok, nil, err
+		}
+		reserved, err := r.CheckAndReserve(ctx, h)
+		if err != nil {
+			return false, nil, errors.Wrap(err, "reserving content hash")
+		}
+		if reserved {
+			release := func() {
+				// The reservation is released even if ctx is canceled.
+				if err := r.Release(context.Background(), h); err != nil {
+					log.Printf("Warning: releasing reservation for %s: %s", f.Rule, err)
+				}
+			}
+			return false, release, nil
+		}
+		if verbose() {
+			log.Printf("%s is being built elsewhere, waiting", f.Rule)
+		}
+		timer := time.NewTimer(reservePoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, nil, errors.Wrapf(ctx.Err(), "waiting for %s", f.Rule)
+		case <-timer.C:
+		}
 	}
-	h, err = f.Rule.ContentHash(ctx)
+}
+
+// reservePoll is how often upToDateOrReserve checks again
+// while waiting for a reservation.
+var reservePoll = time.Second
+
+// reserver returns the first of f's DBs that is a Reserver, if any.
+func (f *Fn) reserver() Reserver {
+	for _, db := range f.dbs() {
+		if r, ok := db.(Reserver); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Stale tells whether Run would run f's rule,
+// without running it or adding anything to f's DBs
+// (though a DB may update the last-access time of an entry it finds).
+// The rule's Gate, if any, is evaluated,
+// but the Fns in f.After are not run,
+// so a rule whose sources a prerequisite would rebuild
+// may be reported as not stale.
+func (f *Fn) Stale(ctx context.Context) (bool, error) {
+	f, err := f.rebased()
 	if err != nil {
-		return errors.Wrap(err, "recomputing content hash")
+		return false, err
+	}
+	if err := f.algo().check(); err != nil {
+		return false, err
+	}
+	if g, ok := f.Rule.(Gater); ok {
+		ok, err := g.Gate(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "evaluating gate")
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	if f.forced() {
+		return true, nil
+	}
+	if fr, ok := f.Rule.(Freshener); ok {
+		ok, err := fr.Fresh(ctx)
+		return !ok, errors.Wrap(err, "checking freshness")
+	}
+	ok, _, err := f.upToDate(ctx, false)
+	return !ok, err
+}
+
+// Stale returns the members of fns that would run (see Fn.Stale),
+// in order.
+// This is useful for reporting what a build would do
+// and for debugging unexpected cache misses.
+func Stale(ctx context.Context, fns []*Fn) ([]*Fn, error) {
+	var result []*Fn
+	for _, f := range fns {
+		stale, err := f.Stale(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checking %s", f.Rule)
+		}
+		if stale {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+// runFresh does the work of run for a Freshener.
+func (f *Fn) runFresh(ctx context.Context, fr Freshener) (bool, error) {
+	if !f.forced() {
+		ok, err := fr.Fresh(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "checking freshness")
+		}
+		if ok {
+			if verbose() {
+				log.Printf("%s up to date", f.Rule)
+			}
+			f.onHit()
+			return true, nil
+		}
+		f.onMiss()
+	}
+	return false, errors.Wrap(f.runRule(ctx), "in Run")
+}
+
+// forced tells whether f.Rule must run regardless of its DBs:
+// because of f.Force,
+// or because f.Rule is an AlwaysRunner.
+func (f *Fn) forced() bool {
+	if f.Force {
+		return true
+	}
+	ar, ok := f.Rule.(AlwaysRunner)
+	return ok && ar.AlwaysRun()
+}
+
+func (f *Fn) runRule(ctx context.Context) error {
+	if c := captured(ctx); c != nil {
+		c.ran = true
+	}
+	if f.Metrics != nil {
+		start := time.Now()
+		err := f.traceRule(ctx)
+		f.Metrics.OnRun(f.Rule, time.Since(start), err)
+		return err
+	}
+	return f.traceRule(ctx)
+}
+
+func (f *Fn) traceRule(ctx context.Context) error {
+	if f.Tracer == nil {
+		return f.Rule.Run(ctx)
+	}
+	ctx, end := f.Tracer.StartRule(ctx, f.Rule)
+	err := f.Rule.Run(ctx)
+	end(err)
+	return err
+}
+
+func (f *Fn) onHit() {
+	if f.Metrics != nil {
+		f.Metrics.OnHit(f.Rule)
+	}
+}
+
+func (f *Fn) onMiss() {
+	if f.Metrics != nil {
+		f.Metrics.OnMiss(f.Rule)
+	}
+}
+
+func (f *Fn) dbs() []DB {
+	if f.DB == nil {
+		return f.DBs
+	}
+	return append([]DB{f.DB}, f.DBs...)
+}
+
+func (f *Fn) has(ctx context.Context, h []byte) (bool, error) {
+	var (
+		dbs      = f.dbs()
+		firstErr error
+		nerrs    int
+	)
+	for _, db := range dbs {
+		ok, err := f.dbHas(ctx, db, h)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			nerrs++
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	if nerrs > 0 && nerrs == len(dbs) {
+		return false, firstErr
+	}
+	return false, nil
+}
+
+// hasAlias tells whether any alias hash of f.Rule is in f's DBs.
+func (f *Fn) hasAlias(ctx context.Context) (bool, error) {
+	a, ok := f.Rule.(Aliaser)
+	if !ok || f.KeyFunc != nil {
+		return false, nil
+	}
+	hashes, err := a.AliasHashes(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "computing alias hashes")
+	}
+	for _, h := range hashes {
+		ok, err := f.has(ctx, f.withEpoch(h))
+		if err != nil {
+			return false, errors.Wrap(err, "consulting hash DB")
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *Fn) add(ctx context.Context, h []byte) error {
+	var errs multiErr
+	for _, db := range f.dbs() {
+		if err := f.dbAdd(ctx, db, h); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// dbHas calls db.Has,
+// tracing the call if f.Tracer is a DBTracer.
+func (f *Fn) dbHas(ctx context.Context, db DB, h []byte) (bool, error) {
+	dt, ok := f.Tracer.(DBTracer)
+	if !ok {
+		return db.Has(ctx, h)
+	}
+	ctx, end := dt.StartDB(ctx, db, "Has")
+	found, err := db.Has(ctx, h)
+	end(err)
+	return found, err
+}
+
+// dbAdd adds h to db,
+// with f.Labels if db is a Labeler,
+// tracing the call if f.Tracer is a DBTracer.
+func (f *Fn) dbAdd(ctx context.Context, db DB, h []byte) error {
+	if dt, ok := f.Tracer.(DBTracer); ok {
+		var end func(error)
+		ctx, end = dt.StartDB(ctx, db, "Add")
+		err := f.dbAddUntraced(ctx, db, h)
+		end(err)
+		return err
+	}
+	return f.dbAddUntraced(ctx, db, h)
+}
+
+func (f *Fn) dbAddUntraced(ctx context.Context, db DB, h []byte) error {
+	if l, ok := db.(Labeler); ok && len(f.Labels) > 0 {
+		return l.AddWithLabels(ctx, h, f.Labels...)
+	}
+	return db.Add(ctx, h)
+}
+
+type multiErr []error
+
+func (m multiErr) Error() string {
+	strs := make([]string, 0, len(m))
+	for _, err := range m {
+		strs = append(strs, err.Error())
+	}
+	return strings.Join(strs, "; ")
+}
+
+func (f *Fn) key(ctx context.Context) ([]byte, error) {
+	if f.OnHashed != nil {
+		start := time.Now()
+		defer func() { f.OnHashed(f.Rule, time.Since(start)) }()
+	}
+	if ht, ok := f.Tracer.(HashTracer); ok {
+		ctx, end := ht.StartHash(ctx, f.Rule)
+		h, err := f.computeKey(ctx)
+		end(err)
+		return h, err
+	}
+	return f.computeKey(ctx)
+}
+
+func (f *Fn) computeKey(ctx context.Context) ([]byte, error) {
+	var (
+		h   []byte
+		err error
+	)
+	if f.KeyFunc != nil {
+		h, err = f.KeyFunc(ctx, f.Rule)
+	} else {
+		h, err = f.Rule.ContentHash(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.withEpoch(h), nil
+}
+
+// withEpoch mixes f's epoch, if any, into the key h.
+func (f *Fn) withEpoch(h []byte) []byte {
+	epoch := f.Epoch
+	if epoch == "" {
+		epoch = defaults().Epoch
+	}
+	if epoch == "" {
+		return h
+	}
+	s := struct {
+		Epoch string `json:"epoch"`
+		Key   []byte `json:"key"`
+	}{
+		Epoch: epoch,
+		Key:   h,
+	}
+	j, _ := json.Marshal(s)
+	return domainHash(f.algo(), epochDomain, j)
+}
+
+// epochDomain is the domain-separation tag for keys with an epoch.
+const epochDomain = "mghash.Fn.Epoch"
+
+// algo returns f.HashAlgo,
+// or the default from the config file if that is nil.
+func (f *Fn) algo() *HashAlgo {
+	if f.HashAlgo != nil {
+		return f.HashAlgo
 	}
-	return f.DB.Add(ctx, h)
+	return defaultHashAlgo()
 }
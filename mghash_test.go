@@ -0,0 +1,465 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRule is a Rule with fixed hashes that counts its runs.
+type testRule struct {
+	name    string
+	content string
+	runs    *int
+}
+
+func (r testRule) String() string   { return r.name }
+func (r testRule) RuleHash() []byte { return []byte(r.name) }
+
+func (r testRule) ContentHash(context.Context) ([]byte, error) {
+	return []byte(r.name + ":" + r.content), nil
+}
+
+func (r testRule) Run(context.Context) error {
+	*r.runs++
+	return nil
+}
+
+func newTestRule(name, content string) testRule {
+	return testRule{name: name, content: content, runs: new(int)}
+}
+
+func TestKeyFunc(t *testing.T) {
+	ctx := context.Background()
+
+	db := NewMemDB()
+	rule := newTestRule("rule", "v1")
+	if err := db.Add(ctx, []byte("custom:rule")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without KeyFunc, the entry under the custom key is not a match.
+	f := &Fn{DB: db, Rule: rule}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *rule.runs != 1 {
+		t.Fatalf("got %d runs without KeyFunc, want 1", *rule.runs)
+	}
+
+	// With KeyFunc, it is,
+	// even though the content hash has changed.
+	keyFunc := func(_ context.Context, r Rule) ([]byte, error) {
+		return []byte("custom:" + r.String()), nil
+	}
+	rule = newTestRule("rule", "v2")
+	f = &Fn{DB: db, Rule: rule, KeyFunc: keyFunc}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *rule.runs != 0 {
+		t.Errorf("got %d runs with KeyFunc, want 0", *rule.runs)
+	}
+
+	// KeyFunc also determines what is recorded after a run.
+	var (
+		rule2 = newTestRule("other", "v1")
+		db2   = NewMemDB()
+	)
+	f = &Fn{DB: db2, Rule: rule2, KeyFunc: keyFunc}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db2.Has(ctx, []byte("custom:other")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("KeyFunc key not recorded")
+	}
+	if ok, err := db2.Has(ctx, []byte("other:v1")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("content hash recorded despite KeyFunc")
+	}
+}
+
+func TestForce(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		db   = NewMemDB()
+		rule = newTestRule("rule", "v1")
+	)
+	if err := db.Add(ctx, []byte("rule:v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Fn{DB: db, Rule: rule, Force: true}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *rule.runs != 1 {
+		t.Errorf("got %d runs of an up-to-date rule with Force, want 1", *rule.runs)
+	}
+
+	// The new hash is recorded,
+	// so a later unforced run finds it.
+	rule = newTestRule("rule", "v2")
+	f = &Fn{DB: db, Rule: rule, Force: true}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(ctx, []byte("rule:v2")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("new content hash not recorded after a forced run")
+	}
+	f.Force = false
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *rule.runs != 1 {
+		t.Errorf("got %d runs after a forced run, want 1", *rule.runs)
+	}
+}
+
+func TestFnID(t *testing.T) {
+	var (
+		jr    = JRule{Sources: []string{"a"}, Targets: []string{"b"}, Command: []string{"gen"}}
+		same  = JRule{Sources: []string{"a"}, Targets: []string{"b"}, Command: []string{"gen"}}
+		other = JRule{Sources: []string{"a"}, Targets: []string{"b"}, Command: []string{"gen2"}}
+	)
+	cases := []struct {
+		desc  string
+		a, b  *Fn
+		equal bool
+	}{
+		{desc: "equal rules", a: &Fn{Rule: jr}, b: &Fn{Rule: same}, equal: true},
+		{desc: "equal rules, other fields differing", a: &Fn{Rule: jr}, b: &Fn{Rule: same, DB: NewMemDB(), Force: true}, equal: true},
+		{desc: "different rules", a: &Fn{Rule: jr}, b: &Fn{Rule: other}},
+		{desc: "same rule hash, different types", a: &Fn{Rule: newTestRule("r", "")}, b: &Fn{Rule: funcRule{name: "r"}}},
+		{desc: "same rule hash, different content hashes", a: &Fn{Rule: newTestRule("r", "")}, b: &Fn{Rule: testRule{name: "r", content: "other"}}, equal: true},
+	}
+	for _, c := range cases {
+		if got := c.a.ID() == c.b.ID(); got != c.equal {
+			t.Errorf("%s: got equal IDs %v, want %v", c.desc, got, c.equal)
+		}
+	}
+
+	// The ID does not depend on the program or build.
+	const want = "50a48fe1989870aa9959e154732b91f1533a301fa7e724dcc37f55f58c91da9c"
+	if got := (&Fn{Rule: newTestRule("r", "")}).ID(); got != want {
+		t.Errorf("got ID %s, want %s", got, want)
+	}
+}
+
+// errDB is a DB whose every call fails.
+type errDB struct{}
+
+func (errDB) Has(context.Context, []byte) (bool, error) { return false, errors.New("has failed") }
+func (errDB) Add(context.Context, []byte) error         { return errors.New("add failed") }
+
+func TestDBs(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		local = NewMemDB()
+		rem   = NewMemDB()
+		rule  = newTestRule("rule", "v1")
+	)
+
+	// A hit in a later DB is a hit.
+	if err := rem.Add(ctx, []byte("rule:v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Fn{DB: local, DBs: []DB{rem}, Rule: rule}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *rule.runs != 0 {
+		t.Fatalf("got %d runs with a hit in the second DB, want 0", *rule.runs)
+	}
+
+	// A read error falls through to the next DB,
+	// and a write error does not prevent writing the rest,
+	// but is reported.
+	rule = newTestRule("rule", "v2")
+	err := (&Fn{DBs: []DB{errDB{}, local, rem}, Rule: rule}).Run(ctx)
+	if err == nil {
+		t.Error("no error from a failing Add")
+	}
+	if *rule.runs != 1 {
+		t.Errorf("got %d runs, want 1", *rule.runs)
+	}
+	for i, db := range []DB{local, rem} {
+		if ok, err := db.Has(ctx, []byte("rule:v2")); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("content hash not recorded in DB %d", i)
+		}
+	}
+
+	// When every read fails, so does Run.
+	rule = newTestRule("rule", "v3")
+	if err = (&Fn{DBs: []DB{errDB{}}, Rule: rule}).Run(ctx); err == nil {
+		t.Error("no error when every DB fails")
+	}
+	if *rule.runs != 0 {
+		t.Errorf("got %d runs when every DB fails, want 0", *rule.runs)
+	}
+}
+
+func TestOnProduced(t *testing.T) {
+	var (
+		ctx = context.Background()
+		out = filepath.Join(t.TempDir(), "out")
+		db  = NewMemDB()
+	)
+	writeFile(t, filepath.Join(out, "old"), "preexisting")
+
+	rule := JRule{
+		Targets: []string{out},
+		Command: []string{"sh", "-c", "echo 1 > " + out + "/new && mkdir -p " + out + "/sub && echo 2 > " + out + "/sub/new"},
+	}
+	var (
+		got   []string
+		calls int
+	)
+	f := &Fn{DB: db, Rule: rule, OnProduced: func(_ Rule, files []string) {
+		got = files
+		calls++
+	}}
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(out, "new"), filepath.Join(out, "sub", "new")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got produced files %q, want %q", got, want)
+	}
+
+	// No call on a cache hit.
+	if err := f.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls to OnProduced, want 1", calls)
+	}
+}
+
+func TestMtimeCheck(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		runs   = filepath.Join(dir, "runs")
+		rule   = JRule{
+			Sources: []string{src},
+			Targets: []string{target},
+			Command: []string{"sh", "-c", "echo >> " + runs},
+		}
+		old = time.Now().Add(-time.Hour)
+	)
+	writeFile(t, src, "source")
+	writeFile(t, target, "target")
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	cases := []struct {
+		check    MtimeCheck
+		srcNewer bool
+		wantRun  bool
+		wantWarn bool
+	}{
+		{check: MtimeIgnore, srcNewer: true},
+		{check: MtimeWarn, srcNewer: false},
+		{check: MtimeWarn, srcNewer: true, wantWarn: true},
+		{check: MtimeRebuild, srcNewer: false},
+		{check: MtimeRebuild, srcNewer: true, wantRun: true, wantWarn: true},
+	}
+	for _, c := range cases {
+		srcTime, targetTime := old, old
+		if c.srcNewer {
+			srcTime = old.Add(time.Minute)
+		}
+		if err := os.Chtimes(src, srcTime, srcTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(target, targetTime, targetTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(runs); err != nil {
+			t.Fatal(err)
+		}
+		logged.Reset()
+
+		// Modification times are not part of the content hash,
+		// so a seeded DB has a hit for the rule.
+		db := NewMemDB()
+		if err := Seed(ctx, db, []JRule{rule}); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Fn{DB: db, Rule: rule, MtimeCheck: c.check}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := os.Stat(runs)
+		if gotRun := err == nil; gotRun != c.wantRun {
+			t.Errorf("check %d, source newer %v: got run %v, want %v", c.check, c.srcNewer, gotRun, c.wantRun)
+		}
+		if gotWarn := strings.Contains(logged.String(), "is newer than its targets"); gotWarn != c.wantWarn {
+			t.Errorf("check %d, source newer %v: got warning %v, want %v", c.check, c.srcNewer, gotWarn, c.wantWarn)
+		}
+	}
+}
+
+func TestOnHashed(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		big   = writeRandomFiles(t, dir, 1, 32<<20)[0]
+		empty = filepath.Join(dir, "empty")
+	)
+	writeFile(t, empty, "")
+
+	hashTime := func(src string) time.Duration {
+		t.Helper()
+		var (
+			rule  = JRule{Sources: []string{src}, Command: []string{"true"}}
+			durs  []time.Duration
+			rules []Rule
+		)
+		f := &Fn{DB: NewMemDB(), Rule: rule, OnHashed: func(r Rule, dur time.Duration) {
+			rules = append(rules, r)
+			durs = append(durs, dur)
+		}}
+		if _, err := f.Stale(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(durs) != 1 {
+			t.Fatalf("got %d OnHashed calls, want 1", len(durs))
+		}
+		if !reflect.DeepEqual(rules[0], Rule(rule)) {
+			t.Errorf("got rule %s in OnHashed, want %s", rules[0], rule)
+		}
+		return durs[0]
+	}
+
+	var (
+		bigTime   = hashTime(big)
+		emptyTime = hashTime(empty)
+	)
+	if bigTime <= emptyTime {
+		t.Errorf("got hashing time %s for a 32MiB source, want more than the %s for an empty one", bigTime, emptyTime)
+	}
+}
+
+func TestFreshRule(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		fresh     func(context.Context) (bool, error)
+		wantRuns  int
+		wantStale bool
+		wantErr   bool
+	}{
+		{fresh: func(context.Context) (bool, error) { return true, nil }, wantRuns: 0},
+		{fresh: func(context.Context) (bool, error) { return false, nil }, wantRuns: 1, wantStale: true},
+		{fresh: nil, wantRuns: 1, wantStale: true},
+		{fresh: func(context.Context) (bool, error) { return false, errors.New("unreachable") }, wantErr: true},
+	}
+	for i, c := range cases {
+		var (
+			inner = newTestRule("rule", "v1")
+			// errDB shows that the DB is neither consulted nor updated.
+			f = &Fn{DB: errDB{}, Rule: FreshRule{Rule: inner, FreshnessFunc: c.fresh}}
+		)
+		stale, err := f.Stale(ctx)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("case %d: no error from Stale", i)
+			}
+			if err = f.Run(ctx); err == nil {
+				t.Errorf("case %d: no error from Run", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if stale != c.wantStale {
+			t.Errorf("case %d: got stale %v, want %v", i, stale, c.wantStale)
+		}
+		if err = f.Run(ctx); err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if *inner.runs != c.wantRuns {
+			t.Errorf("case %d: got %d runs, want %d", i, *inner.runs, c.wantRuns)
+		}
+	}
+}
+
+// countingMetrics is a Metrics counting its calls.
+type countingMetrics struct {
+	hits, misses, runs int
+	errs               []error
+}
+
+func (m *countingMetrics) OnHit(Rule)  { m.hits++ }
+func (m *countingMetrics) OnMiss(Rule) { m.misses++ }
+
+func (m *countingMetrics) OnRun(_ Rule, _ time.Duration, err error) {
+	m.runs++
+	m.errs = append(m.errs, err)
+}
+
+func TestMetrics(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		db   = NewMemDB()
+		rule = newTestRule("rule", "v1")
+		m    = new(countingMetrics)
+		f    = &Fn{DB: db, Rule: rule, Metrics: m}
+	)
+	check := func(hits, misses, runs int) {
+		t.Helper()
+		if m.hits != hits || m.misses != misses || m.runs != runs {
+			t.Errorf("got %d hits, %d misses, and %d runs, want %d, %d, and %d", m.hits, m.misses, m.runs, hits, misses, runs)
+		}
+	}
+
+	// The first run is a miss and runs the rule,
+	// the second is a hit.
+	for i := 0; i < 2; i++ {
+		if err := f.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(1, 1, 1)
+	if *rule.runs != 1 {
+		t.Errorf("got %d runs, want 1", *rule.runs)
+	}
+
+	// A forced run is neither.
+	forced := *f
+	forced.Force = true
+	if err := forced.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(1, 1, 2)
+
+	// A failing rule's error reaches OnRun.
+	failure := errors.New("failure")
+	f = &Fn{DB: db, Rule: funcRule{name: "fail", run: func(context.Context) error { return failure }}, Metrics: m}
+	if err := f.Run(ctx); err == nil {
+		t.Fatal("no error from failing rule")
+	}
+	check(1, 2, 3)
+	if err := m.errs[2]; !errors.Is(err, failure) {
+		t.Errorf("got error %v in OnRun, want %v", err, failure)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package mghash
+
+import (
+	"io"
+	"os"
+)
+
+// hashMapped reports false on platforms without mmap support.
+func hashMapped(io.Writer, *os.File, int64) (bool, error) {
+	return false, nil
+}
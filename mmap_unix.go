@@ -0,0 +1,29 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package mghash
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// hashMapped memory-maps the first size bytes of f and writes them to w.
+// It reports false if f could not be mapped,
+// in which case nothing has been written to w and the caller should fall back to reading f.
+func hashMapped(w io.Writer, f *os.File, size int64) (bool, error) {
+	if int64(int(size)) != size {
+		return false, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return false, nil
+	}
+	if _, err = w.Write(data); err != nil {
+		syscall.Munmap(data)
+		return true, errors.Wrap(err, "hashing mapped data")
+	}
+	return true, errors.Wrap(syscall.Munmap(data), "unmapping")
+}
@@ -0,0 +1,77 @@
+package mghash
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MtimeCheck is the type of Fn.MtimeCheck.
+type MtimeCheck int
+
+const (
+	// MtimeIgnore skips the modification-time check (the default).
+	MtimeIgnore MtimeCheck = iota
+
+	// MtimeWarn logs a warning when a source is newer than all targets.
+	MtimeWarn
+
+	// MtimeRebuild logs a warning when a source is newer than all targets,
+	// and runs the rule.
+	MtimeRebuild
+)
+
+// mtimeStale tells whether any source of f.Rule is newer than all its targets,
+// logging a warning if so.
+// It reports false if f.Rule cannot list its sources and targets,
+// or if none of the targets exists.
+func (f *Fn) mtimeStale(ctx context.Context) (bool, error) {
+	sourcer, ok := f.Rule.(Sourcer)
+	if !ok {
+		return false, nil
+	}
+	targeter, ok := f.Rule.(Targeter)
+	if !ok {
+		return false, nil
+	}
+
+	var newestTarget time.Time
+	for _, target := range targeter.TargetFiles() {
+		info, err := os.Stat(target)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "statting %s", target)
+		}
+		if info.ModTime().After(newestTarget) {
+			newestTarget = info.ModTime()
+		}
+	}
+	if newestTarget.IsZero() {
+		return false, nil
+	}
+
+	sources, err := sourcer.SourceFiles(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "listing sources")
+	}
+	for _, src := range sources {
+		info, err := os.Stat(src)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "statting %s", src)
+		}
+		if info.ModTime().After(newestTarget) {
+			log.Printf("Warning: %s is up to date, but source %s is newer than its targets", f.Rule, src)
+			return true, nil
+		}
+	}
+	return false, nil
+}
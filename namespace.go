@@ -0,0 +1,266 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// Namespaced produces a DB that stores its entries in db
+// with prefix prepended,
+// so that several projects or branches can share a single store
+// without seeing each other's entries.
+// The prefix is itself preceded by its length,
+// so no two distinct prefixes produce the same keys
+// (e.g. "ab" with entry "c" and "a" with entry "bc").
+//
+// The result implements each of Iterator, Deleter, Labeler, and Reserver
+// if db does,
+// operating only on the entries in its namespace.
+// If db is an Iterator,
+// the result is also a Statser
+// reporting on the entries in its namespace.
+func Namespaced(db DB, prefix []byte) DB {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(prefix)))
+	p := append(buf[:n:n], prefix...)
+	ns := namespacedDB{db: db, prefix: p}
+
+	var which int
+	if _, ok := db.(Iterator); ok {
+		which |= nsIter
+	}
+	if _, ok := db.(Deleter); ok {
+		which |= nsDel
+	}
+	if _, ok := db.(Labeler); ok {
+		which |= nsLabel
+	}
+	if _, ok := db.(Reserver); ok {
+		which |= nsReserve
+	}
+	return namespacedForms[which](ns)
+}
+
+// Bits identifying the optional interfaces of a namespaced DB.
+const (
+	nsIter = 1 << iota
+	nsDel
+	nsLabel
+	nsReserve
+)
+
+// namespacedForms produces the namespaced form of a DB
+// for each combination of optional interfaces it implements,
+// indexed by the bits above.
+// The embedded types each add the methods of one interface.
+var namespacedForms = [16]func(namespacedDB) DB{
+	func(ns namespacedDB) DB { return ns },
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+		}{ns, nsIterator(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsDeleter
+		}{ns, nsDeleter(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsDeleter
+		}{ns, nsIterator(ns), nsDeleter(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsLabeler
+		}{ns, nsLabeler(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsLabeler
+		}{ns, nsIterator(ns), nsLabeler(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsDeleter
+			nsLabeler
+		}{ns, nsDeleter(ns), nsLabeler(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsDeleter
+			nsLabeler
+		}{ns, nsIterator(ns), nsDeleter(ns), nsLabeler(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsReserver
+		}{ns, nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsReserver
+		}{ns, nsIterator(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsDeleter
+			nsReserver
+		}{ns, nsDeleter(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsDeleter
+			nsReserver
+		}{ns, nsIterator(ns), nsDeleter(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsLabeler
+			nsReserver
+		}{ns, nsLabeler(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsLabeler
+			nsReserver
+		}{ns, nsIterator(ns), nsLabeler(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsDeleter
+			nsLabeler
+			nsReserver
+		}{ns, nsDeleter(ns), nsLabeler(ns), nsReserver(ns)}
+	},
+	func(ns namespacedDB) DB {
+		return struct {
+			namespacedDB
+			nsIterator
+			nsDeleter
+			nsLabeler
+			nsReserver
+		}{ns, nsIterator(ns), nsDeleter(ns), nsLabeler(ns), nsReserver(ns)}
+	},
+}
+
+type namespacedDB struct {
+	db DB
+
+	// The length-prefixed namespace.
+	prefix []byte
+}
+
+var _ BatchAdder = namespacedDB{}
+
+// Has implements DB.Has.
+func (ns namespacedDB) Has(ctx context.Context, h []byte) (bool, error) {
+	return ns.db.Has(ctx, ns.key(h))
+}
+
+// Add implements DB.Add.
+func (ns namespacedDB) Add(ctx context.Context, h []byte) error {
+	return ns.db.Add(ctx, ns.key(h))
+}
+
+// AddMany implements BatchAdder.
+func (ns namespacedDB) AddMany(ctx context.Context, hashes [][]byte) error {
+	return AddMany(ctx, ns.db, ns.keys(hashes))
+}
+
+func (ns namespacedDB) key(h []byte) []byte {
+	k := make([]byte, 0, len(ns.prefix)+len(h))
+	k = append(k, ns.prefix...)
+	return append(k, h...)
+}
+
+func (ns namespacedDB) keys(hashes [][]byte) [][]byte {
+	keys := make([][]byte, 0, len(hashes))
+	for _, h := range hashes {
+		keys = append(keys, ns.key(h))
+	}
+	return keys
+}
+
+// The methods of the optional interfaces of a namespaced DB,
+// each on its own type
+// so that namespacedForms can combine them.
+type (
+	nsIterator namespacedDB
+	nsDeleter  namespacedDB
+	nsLabeler  namespacedDB
+	nsReserver namespacedDB
+)
+
+// ForEach implements Iterator.ForEach.
+// It sees only the entries in the namespace,
+// without the prefix.
+func (ns nsIterator) ForEach(ctx context.Context, f func([]byte, time.Time) error) error {
+	return ns.db.(Iterator).ForEach(ctx, func(k []byte, lastAccess time.Time) error {
+		if !bytes.HasPrefix(k, ns.prefix) {
+			return nil
+		}
+		return f(k[len(ns.prefix):], lastAccess)
+	})
+}
+
+// Stats implements Statser.Stats.
+// It iterates over the entries in the namespace.
+func (ns nsIterator) Stats(ctx context.Context) (Stats, error) {
+	var s Stats
+	err := ns.ForEach(ctx, func(h []byte, lastAccess time.Time) error {
+		s.Entries++
+		s.Bytes += int64(len(h))
+		if s.Oldest.IsZero() || lastAccess.Before(s.Oldest) {
+			s.Oldest = lastAccess
+		}
+		if lastAccess.After(s.Newest) {
+			s.Newest = lastAccess
+		}
+		return nil
+	})
+	return s, err
+}
+
+// Delete implements Deleter.Delete.
+func (ns nsDeleter) Delete(ctx context.Context, hashes ...[]byte) error {
+	return ns.db.(Deleter).Delete(ctx, namespacedDB(ns).keys(hashes)...)
+}
+
+// AddWithLabels implements Labeler.AddWithLabels.
+// The labels are not namespaced.
+func (ns nsLabeler) AddWithLabels(ctx context.Context, h []byte, labels ...string) error {
+	return ns.db.(Labeler).AddWithLabels(ctx, namespacedDB(ns).key(h), labels...)
+}
+
+// CheckAndReserve implements Reserver.CheckAndReserve.
+func (ns nsReserver) CheckAndReserve(ctx context.Context, h []byte) (bool, error) {
+	return ns.db.(Reserver).CheckAndReserve(ctx, namespacedDB(ns).key(h))
+}
+
+// Release implements Reserver.Release.
+func (ns nsReserver) Release(ctx context.Context, h []byte) error {
+	return ns.db.(Reserver).Release(ctx, namespacedDB(ns).key(h))
+}
@@ -0,0 +1,246 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNamespaced(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		db    = newIterDB([]byte("raw"))
+		ab    = Namespaced(db, []byte("ab"))
+		a     = Namespaced(db, []byte("a"))
+		empty = Namespaced(db, nil)
+	)
+	add := func(ns DB, hashes ...string) {
+		t.Helper()
+		for _, h := range hashes {
+			if err := ns.Add(ctx, []byte(h)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(ab, "c", "d")
+	add(a, "bc")
+	if err := AddMany(ctx, empty, [][]byte{[]byte("e"), []byte("f")}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ns         DB
+		has, hasnt string
+	}{
+		{ns: ab, has: "c", hasnt: "bc"},
+		{ns: a, has: "bc", hasnt: "c"},
+		{ns: empty, has: "e", hasnt: "raw"},
+	}
+	for i, c := range cases {
+		if ok, err := c.ns.Has(ctx, []byte(c.has)); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Errorf("case %d: %s not found", i, c.has)
+		}
+		if ok, err := c.ns.Has(ctx, []byte(c.hasnt)); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Errorf("case %d: %s found", i, c.hasnt)
+		}
+	}
+
+	entries := func(ns DB) []string {
+		t.Helper()
+		it, ok := ns.(Iterator)
+		if !ok {
+			t.Fatalf("%T is not an Iterator", ns)
+		}
+		var result []string
+		err := it.ForEach(ctx, func(h []byte, _ time.Time) error {
+			result = append(result, string(h))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// ForEach sees only the namespace's own entries, without the prefix.
+	if got, want := entries(ab), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+	if got, want := entries(empty), []string{"e", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+
+	// Delete removes only the namespace's own entries.
+	if err := ab.(Deleter).Delete(ctx, []byte("c"), []byte("bc")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entries(ab), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q after deleting, want %q", got, want)
+	}
+	if got, want := entries(a), []string{"bc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q in another namespace after deleting, want %q", got, want)
+	}
+	if !db.entries["raw"] {
+		t.Error("entry outside any namespace deleted")
+	}
+
+	// The result is an Iterator or Deleter only if db is.
+	mem := Namespaced(NewMemDB(), []byte("x"))
+	if _, ok := mem.(Iterator); ok {
+		t.Error("namespaced MemDB is an Iterator")
+	}
+	if _, ok := mem.(Deleter); ok {
+		t.Error("namespaced MemDB is a Deleter")
+	}
+	if _, ok := mem.(BatchAdder); !ok {
+		t.Error("namespaced MemDB is not a BatchAdder")
+	}
+	iterOnly := Namespaced(struct{ Iterator }{db}, []byte("ab"))
+	if _, ok := iterOnly.(Deleter); ok {
+		t.Error("namespaced Iterator is a Deleter")
+	}
+	if got, want := entries(iterOnly), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %q from a namespaced Iterator, want %q", got, want)
+	}
+	delOnly := Namespaced(struct{ Deleter }{db}, []byte("ab"))
+	if _, ok := delOnly.(Iterator); ok {
+		t.Error("namespaced Deleter is an Iterator")
+	}
+	if err := delOnly.(Deleter).Delete(ctx, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(ab); len(got) != 0 {
+		t.Errorf("got entries %q after deleting with a namespaced Deleter, want none", got)
+	}
+}
+
+// fullDB is an iterDB that is also a Labeler and a Reserver.
+type fullDB struct {
+	*iterDB
+	labels   map[string][]string
+	reserved map[string]bool
+}
+
+var (
+	_ Labeler  = &fullDB{}
+	_ Reserver = &fullDB{}
+)
+
+func newFullDB() *fullDB {
+	return &fullDB{
+		iterDB:   newIterDB(),
+		labels:   make(map[string][]string),
+		reserved: make(map[string]bool),
+	}
+}
+
+func (db *fullDB) AddWithLabels(ctx context.Context, h []byte, labels ...string) error {
+	db.mu.Lock()
+	db.labels[string(h)] = labels
+	db.mu.Unlock()
+	return db.Add(ctx, h)
+}
+
+func (db *fullDB) CheckAndReserve(_ context.Context, h []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.entries[string(h)] || db.reserved[string(h)] {
+		return false, nil
+	}
+	db.reserved[string(h)] = true
+	return true, nil
+}
+
+func (db *fullDB) Release(_ context.Context, h []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.reserved, string(h))
+	return nil
+}
+
+func TestNamespacedOptional(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = newFullDB()
+		ns  = Namespaced(db, []byte("ns"))
+	)
+	for _, ok := range []bool{
+		isIterator(ns), isDeleter(ns), isLabeler(ns), isReserver(ns), isStatser(ns),
+	} {
+		if !ok {
+			t.Fatalf("namespaced %T lacks an optional interface of the DB it wraps", ns)
+		}
+	}
+	mem := Namespaced(NewMemDB(), []byte("ns"))
+	for _, ok := range []bool{
+		isIterator(mem), isDeleter(mem), isLabeler(mem), isReserver(mem), isStatser(mem),
+	} {
+		if ok {
+			t.Fatalf("namespaced MemDB has an optional interface that MemDB lacks")
+		}
+	}
+
+	// Fn's labels reach the wrapped DB, on the namespaced key.
+	rule := newTestRule("rule", "v1")
+	if err := (&Fn{DB: ns, Rule: rule, Labels: []string{"label"}}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.labels) != 1 {
+		t.Fatalf("got %d labeled entries, want 1", len(db.labels))
+	}
+	for k, labels := range db.labels {
+		if !bytes.HasPrefix([]byte(k), []byte("\x02ns")) {
+			t.Errorf("labeled entry %q is not in the namespace", k)
+		}
+		if !reflect.DeepEqual(labels, []string{"label"}) {
+			t.Errorf("got labels %q, want [label]", labels)
+		}
+	}
+
+	// Reservations are per namespace.
+	other := Namespaced(db, []byte("other"))
+	for _, r := range []DB{ns, other} {
+		ok, err := r.(Reserver).CheckAndReserve(ctx, []byte("h"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("could not reserve h in %T", r)
+		}
+	}
+	if ok, err := ns.(Reserver).CheckAndReserve(ctx, []byte("h")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("reserved h twice in the same namespace")
+	}
+	if err := ns.(Reserver).Release(ctx, []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	if !db.reserved["\x05otherh"] || db.reserved["\x02nsh"] {
+		t.Errorf("got reservations %v after releasing h in ns", db.reserved)
+	}
+
+	// Stats count only the namespace's entries.
+	if err := other.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ns.(Statser).Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 {
+		t.Errorf("got %d entries in the namespace, want 1", stats.Entries)
+	}
+}
+
+func isIterator(db DB) bool { _, ok := db.(Iterator); return ok }
+func isDeleter(db DB) bool  { _, ok := db.(Deleter); return ok }
+func isLabeler(db DB) bool  { _, ok := db.(Labeler); return ok }
+func isReserver(db DB) bool { _, ok := db.(Reserver); return ok }
+func isStatser(db DB) bool  { _, ok := db.(Statser); return ok }
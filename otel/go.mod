@@ -0,0 +1,20 @@
+module github.com/bobg/mghash/otel
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015011847-7a2bf27b68fe
+	go.opentelemetry.io/otel v1.11.2
+	go.opentelemetry.io/otel/sdk v1.11.2
+	go.opentelemetry.io/otel/trace v1.11.2
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/magefile/mage v1.13.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
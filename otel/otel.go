@@ -0,0 +1,106 @@
+// Package otel provides an OpenTelemetry implementation of mghash.Tracer.
+package otel
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/bobg/mghash"
+)
+
+// Tracer is an mghash.Tracer that records OpenTelemetry spans.
+// Each call to mghash.Fn.Run produces a span named "mghash.Fn.Run",
+// with child spans named "mghash.Rule.ContentHash" for computing the rule's content hash,
+// "mghash.DB.Has" and "mghash.DB.Add" for each call to a DB,
+// and, on a cache miss, "mghash.Rule.Run" for the execution of the rule.
+// A content-hash span records the numbers of the rule's sources and targets,
+// if it is a Sourcer and a Targeter;
+// listing them may repeat some of the work of hashing.
+// Spans nest under any span already present in the context.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var (
+	_ mghash.HashTracer = Tracer{}
+	_ mghash.DBTracer   = Tracer{}
+)
+
+// InstrumentationName is the name of the OpenTelemetry tracer used by Tracer.
+const InstrumentationName = "github.com/bobg/mghash"
+
+// New produces a Tracer using the given TracerProvider.
+func New(tp trace.TracerProvider) Tracer {
+	return Tracer{tracer: tp.Tracer(InstrumentationName)}
+}
+
+// Attribute keys used in spans.
+const (
+	RuleKey     = attribute.Key("mghash.rule")
+	RuleHashKey = attribute.Key("mghash.rule_hash")
+	HitKey      = attribute.Key("mghash.hit")
+	SourcesKey  = attribute.Key("mghash.sources")
+	TargetsKey  = attribute.Key("mghash.targets")
+	DBKey       = attribute.Key("mghash.db")
+)
+
+// StartFn implements mghash.Tracer.
+func (t Tracer) StartFn(ctx context.Context, rule mghash.Rule) (context.Context, func(bool, error)) {
+	ctx, span := t.tracer.Start(ctx, "mghash.Fn.Run", trace.WithAttributes(ruleAttrs(rule)...))
+	return ctx, func(hit bool, err error) {
+		span.SetAttributes(HitKey.Bool(hit))
+		endSpan(span, err)
+	}
+}
+
+// StartRule implements mghash.Tracer.
+func (t Tracer) StartRule(ctx context.Context, rule mghash.Rule) (context.Context, func(error)) {
+	ctx, span := t.tracer.Start(ctx, "mghash.Rule.Run", trace.WithAttributes(ruleAttrs(rule)...))
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// StartHash implements mghash.HashTracer.
+func (t Tracer) StartHash(ctx context.Context, rule mghash.Rule) (context.Context, func(error)) {
+	ctx, span := t.tracer.Start(ctx, "mghash.Rule.ContentHash", trace.WithAttributes(ruleAttrs(rule)...))
+	return ctx, func(err error) {
+		if s, ok := rule.(mghash.Sourcer); ok && err == nil {
+			if sources, err := s.SourceFiles(ctx); err == nil {
+				span.SetAttributes(SourcesKey.Int(len(sources)))
+			}
+		}
+		if tg, ok := rule.(mghash.Targeter); ok && err == nil {
+			span.SetAttributes(TargetsKey.Int(len(tg.TargetFiles())))
+		}
+		endSpan(span, err)
+	}
+}
+
+// StartDB implements mghash.DBTracer.
+func (t Tracer) StartDB(ctx context.Context, db mghash.DB, op string) (context.Context, func(error)) {
+	ctx, span := t.tracer.Start(ctx, "mghash.DB."+op, trace.WithAttributes(DBKey.String(fmt.Sprintf("%T", db))))
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+func ruleAttrs(rule mghash.Rule) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		RuleKey.String(rule.String()),
+		RuleHashKey.String(hex.EncodeToString(rule.RuleHash())),
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
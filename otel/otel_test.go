@@ -0,0 +1,90 @@
+package otel
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/bobg/mghash"
+)
+
+func TestTracer(t *testing.T) {
+	var (
+		exp  = tracetest.NewInMemoryExporter()
+		tp   = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+		rule = mghash.JRule{Command: []string{"true"}}
+		f    = &mghash.Fn{DB: mghash.NewMemDB(), Rule: rule, Tracer: New(tp)}
+	)
+
+	// The spans nest under one already in the context.
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "build")
+	for i := 0; i < 2; i++ {
+		if err := f.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parent.End()
+
+	spans := exp.GetSpans()
+	var (
+		byName  = make(map[string][]tracetest.SpanStub)
+		build   tracetest.SpanStub
+		ruleRun tracetest.SpanStub
+	)
+	for _, s := range spans {
+		byName[s.Name] = append(byName[s.Name], s)
+		if s.Name == "build" {
+			build = s
+		}
+	}
+
+	// Two runs, one a miss.
+	wantCounts := map[string]int{
+		"build":                   1,
+		"mghash.Fn.Run":           2,
+		"mghash.Rule.ContentHash": 3, // before and after the miss, and for the hit
+		"mghash.DB.Has":           2,
+		"mghash.DB.Add":           1,
+		"mghash.Rule.Run":         1,
+	}
+	for name, want := range wantCounts {
+		if got := len(byName[name]); got != want {
+			t.Errorf("got %d %s spans, want %d", got, name, want)
+		}
+	}
+	if len(byName["mghash.Rule.Run"]) == 1 {
+		ruleRun = byName["mghash.Rule.Run"][0]
+	}
+
+	fnRuns := byName["mghash.Fn.Run"]
+	for i, s := range fnRuns {
+		if s.Parent.SpanID() != build.SpanContext.SpanID() {
+			t.Errorf("Fn.Run span %d is not a child of the enclosing span", i)
+		}
+		attrs := attrMap(s.Attributes)
+		if got := attrs[RuleKey].AsString(); got != rule.String() {
+			t.Errorf("got rule %q in Fn.Run span %d, want %q", got, i, rule.String())
+		}
+		if got, want := attrs[RuleHashKey].AsString(), hex.EncodeToString(rule.RuleHash()); got != want {
+			t.Errorf("got rule hash %s in Fn.Run span %d, want %s", got, i, want)
+		}
+		if got, want := attrs[HitKey].AsBool(), i == 1; got != want {
+			t.Errorf("got hit %v in Fn.Run span %d, want %v", got, i, want)
+		}
+	}
+	if len(fnRuns) > 0 && ruleRun.Parent.SpanID() != fnRuns[0].SpanContext.SpanID() {
+		t.Error("Rule.Run span is not a child of the first Fn.Run span")
+	}
+}
+
+func attrMap(attrs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	result := make(map[attribute.Key]attribute.Value)
+	for _, kv := range attrs {
+		result[kv.Key] = kv.Value
+	}
+	return result
+}
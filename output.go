@@ -0,0 +1,37 @@
+package mghash
+
+import "sync"
+
+// maxBufferedOutput is the amount of command output kept by JRule.BufferOutput.
+const maxBufferedOutput = 64 * 1024
+
+// tailBuffer is an io.Writer that keeps the last max bytes written to it.
+// It is safe for concurrent use,
+// so it can serve as both stdout and stderr of a command.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(p)
+	if len(p) > t.max {
+		p = p[len(p)-t.max:]
+	}
+	if excess := len(t.buf) + len(p) - t.max; excess > 0 {
+		t.buf = append(t.buf[:0], t.buf[excess:]...)
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+// Bytes returns the buffered output.
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf
+}
@@ -0,0 +1,148 @@
+package mghash
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magefile/mage/mg"
+)
+
+func TestTailBuffer(t *testing.T) {
+	cases := []struct {
+		writes []string
+		want   string
+	}{
+		{},
+		{writes: []string{"ab"}, want: "ab"},
+		{writes: []string{"abc", "def"}, want: "cdef"},
+		{writes: []string{"abcdef"}, want: "cdef"},
+		{writes: []string{"ab", "123456"}, want: "3456"},
+		{writes: []string{"a", "b", "c", "d", "e"}, want: "bcde"},
+	}
+	for _, c := range cases {
+		tb := &tailBuffer{max: 4}
+		for _, w := range c.writes {
+			if n, err := tb.Write([]byte(w)); err != nil {
+				t.Fatal(err)
+			} else if n != len(w) {
+				t.Errorf("got %d from writing %q, want %d", n, w, len(w))
+			}
+		}
+		if got := string(tb.Bytes()); got != c.want {
+			t.Errorf("after writing %q, got %q, want %q", c.writes, got, c.want)
+		}
+	}
+}
+
+func TestBufferOutput(t *testing.T) {
+	t.Setenv(mg.VerboseEnv, "0")
+	ctx := context.Background()
+
+	rule := JRule{BufferOutput: true, Command: []string{"sh", "-c", "echo out; echo err >&2"}}
+	got := captureStderr(t, func() {
+		if err := rule.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	if got != "" {
+		t.Errorf("got output %q from a successful command, want none", got)
+	}
+
+	rule.Command = []string{"sh", "-c", "echo out; echo err >&2; exit 1"}
+	got = captureStderr(t, func() {
+		if err := rule.Run(ctx); err == nil {
+			t.Error("no error from a failing command")
+		}
+	})
+	if !strings.Contains(got, "out\n") || !strings.Contains(got, "err\n") {
+		t.Errorf("got output %q from a failing command, want its stdout and stderr", got)
+	}
+}
+
+// captureStderr returns what is written to os.Stderr while f runs.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ch := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		ch <- string(b)
+	}()
+
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+	f()
+	w.Close()
+	return <-ch
+}
+
+func TestRunCapture(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		db     = NewMemDB()
+		rule   = JRule{
+			Sources: []string{src},
+			Targets: []string{target},
+			Command: []string{"sh", "-c", "echo out && echo err >&2 && cp " + src + " " + target},
+		}
+		f = &Fn{DB: db, Rule: rule}
+	)
+	writeFile(t, src, "source")
+
+	var (
+		output  []byte
+		rebuilt bool
+		err     error
+	)
+	stderr := captureStderr(t, func() {
+		output, rebuilt, err = f.RunCapture(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rebuilt {
+		t.Error("got rebuilt false on a miss, want true")
+	}
+	if got := string(output); got != "out\nerr\n" {
+		t.Errorf("got output %q on a miss, want %q", got, "out\nerr\n")
+	}
+	if strings.Contains(stderr, "err") {
+		t.Errorf("captured output also written to the console: %q", stderr)
+	}
+
+	// A hit has no output.
+	if output, rebuilt, err = f.RunCapture(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt {
+		t.Error("got rebuilt true on a hit, want false")
+	}
+	if len(output) != 0 {
+		t.Errorf("got output %q on a hit, want none", output)
+	}
+
+	// A failing command's output is returned with the error.
+	rule.Command = []string{"sh", "-c", "echo broken && exit 1"}
+	if output, rebuilt, err = (&Fn{DB: db, Rule: rule}).RunCapture(ctx); err == nil {
+		t.Fatal("no error from a failing command")
+	}
+	if !rebuilt {
+		t.Error("got rebuilt false for a failing command, want true")
+	}
+	if got := string(output); got != "broken\n" {
+		t.Errorf("got output %q from a failing command, want %q", got, "broken\n")
+	}
+}
@@ -0,0 +1,23 @@
+package mghash
+
+// PhonyRule is an AlwaysRunner that wraps another Rule,
+// causing it to run every time its Fn does.
+// Fn.Stale always reports it as stale.
+//
+// As with Fn.Force,
+// the wrapped rule's content hash is still computed and recorded in the Fn's DBs after it runs.
+// That entry never keeps the PhonyRule from running,
+// but an Fn for the unwrapped rule will find it up to date.
+// Rules depending on a PhonyRule (see Fn.After)
+// still decide whether to run from their own content hashes,
+// so they rerun only if it changes their sources.
+type PhonyRule struct {
+	Rule
+}
+
+var _ AlwaysRunner = PhonyRule{}
+
+// AlwaysRun implements AlwaysRunner.
+func (PhonyRule) AlwaysRun() bool {
+	return true
+}
@@ -0,0 +1,65 @@
+package mghash
+
+import (
+	"context"
+	"testing"
+)
+
+// sometimesRule is an AlwaysRunner whose AlwaysRun result is chosen by the test.
+type sometimesRule struct {
+	testRule
+	always bool
+}
+
+func (r sometimesRule) AlwaysRun() bool { return r.always }
+
+func TestPhonyRule(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		db    = NewMemDB()
+		inner = newTestRule("rule", "v1")
+		f     = &Fn{DB: db, Rule: PhonyRule{Rule: inner}}
+	)
+	if err := db.Add(ctx, contentHash(ctx, t, inner)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hash in db does not keep the PhonyRule from running, every time.
+	for i := 1; i <= 3; i++ {
+		if stale, err := f.Stale(ctx); err != nil {
+			t.Fatal(err)
+		} else if !stale {
+			t.Error("PhonyRule not stale")
+		}
+		if err := f.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if *inner.runs != i {
+			t.Errorf("got %d runs after %d calls to Run, want %d", *inner.runs, i, i)
+		}
+	}
+
+	// The unwrapped rule is up to date.
+	if err := (&Fn{DB: db, Rule: inner}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if *inner.runs != 3 {
+		t.Errorf("got %d runs of the unwrapped rule, want 3", *inner.runs)
+	}
+
+	// An AlwaysRunner runs regardless of db only when it says so.
+	for _, always := range []bool{false, true} {
+		r := sometimesRule{testRule: inner, always: always}
+		*inner.runs = 0
+		if err := (&Fn{DB: db, Rule: r}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if always {
+			want = 1
+		}
+		if *inner.runs != want {
+			t.Errorf("got %d runs with AlwaysRun %v, want %d", *inner.runs, always, want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package postgres implements mghash.DB using a Postgres database,
+// for build caches shared by a team.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+
+	"github.com/bobg/mghash"
+)
+
+// DB is an implementation of mghash.DB that uses a Postgres database for persistent storage.
+// It is safe for concurrent use,
+// including by several processes sharing the database.
+type DB struct {
+	db   *sql.DB
+	keep time.Duration
+	now  func() time.Time
+
+	// Whether db was opened by Open (and not supplied to New).
+	owned bool
+
+	// The schema holding the table,
+	// and the value of its project column for this DB's entries.
+	schema, project string
+
+	// How often to evict expired entries (see Keep).
+	evictInterval time.Duration
+
+	onEvict func(count int)
+
+	mu        sync.Mutex // protects lastEvict
+	lastEvict time.Time
+}
+
+var (
+	_ mghash.DB         = &DB{}
+	_ mghash.BatchAdder = &DB{}
+	_ mghash.Deleter    = &DB{}
+	_ mghash.Statser    = &DB{}
+)
+
+const schema = `
+CREATE SCHEMA IF NOT EXISTS {schema};
+
+CREATE TABLE IF NOT EXISTS {schema}.hashes (
+  project TEXT NOT NULL,
+  hash BYTEA NOT NULL,
+  unix_secs BIGINT NOT NULL,
+  PRIMARY KEY (project, hash)
+);
+
+-- For eviction (see Keep).
+CREATE INDEX IF NOT EXISTS hashes_project_unix_secs ON {schema}.hashes (project, unix_secs);
+`
+
+// Open connects to the Postgres database described by dsn
+// (a URL or a keyword/value string, as understood by github.com/jackc/pgx)
+// and returns it as a *DB.
+// The database schema is created if needed.
+// Callers should call Close when finished operating on the database.
+func Open(ctx context.Context, dsn string, opts ...Option) (*DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening postgres db")
+	}
+	result, err := New(ctx, db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "initializing postgres db")
+	}
+	result.owned = true
+	return result, nil
+}
+
+// New returns a *DB using an existing Postgres connection.
+// The database schema is created if needed.
+// The caller remains responsible for closing db;
+// the Close method of the result does not close it.
+func New(ctx context.Context, db *sql.DB, opts ...Option) (*DB, error) {
+	result := &DB{
+		db:            db,
+		now:           time.Now,
+		schema:        "mghash",
+		evictInterval: defaultEvictInterval,
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	if !validIdentifier.MatchString(result.schema) {
+		return nil, fmt.Errorf("invalid schema name %q", result.schema)
+	}
+	if _, err := db.ExecContext(ctx, result.sql(schema)); err != nil {
+		return nil, errors.Wrap(err, "creating schema")
+	}
+	return result, nil
+}
+
+const defaultEvictInterval = time.Minute
+
+var validIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sql replaces {schema} in q with the name of db's schema.
+func (db *DB) sql(q string) string {
+	return strings.ReplaceAll(q, "{schema}", db.schema)
+}
+
+// Close releases the resources of db.
+// If db was created with New,
+// this does nothing.
+func (db *DB) Close() error {
+	if !db.owned {
+		return nil
+	}
+	return db.db.Close()
+}
+
+// Option is the type of a config option that can be passed to Open and New.
+type Option func(*DB)
+
+// Keep is an Option that sets the amount of time to keep a database entry.
+// By default, DB keeps all entries.
+// Using Keep(d) allows DB to evict entries whose last-access time is older than d.
+// Eviction happens in Add and AddMany,
+// at most once per EvictInterval.
+func Keep(d time.Duration) Option {
+	return func(db *DB) {
+		db.keep = d
+	}
+}
+
+// EvictInterval is an Option that sets how often DB evicts expired entries
+// (see Keep).
+// The default is one minute.
+// Each process using the database evicts independently.
+func EvictInterval(d time.Duration) Option {
+	return func(db *DB) {
+		db.evictInterval = d
+	}
+}
+
+// Clock is an Option that sets the function DB uses to get the current time.
+// By default this is time.Now.
+// It is mainly useful in tests of eviction behavior.
+func Clock(now func() time.Time) Option {
+	return func(db *DB) {
+		db.now = now
+	}
+}
+
+// OnEvict is an Option that sets a function to call after DB evicts entries
+// (see Keep),
+// with the number of entries evicted.
+// It is not called when an eviction pass finds nothing to remove.
+func OnEvict(f func(count int)) Option {
+	return func(db *DB) {
+		db.onEvict = f
+	}
+}
+
+// Schema is an Option that sets the name of the Postgres schema
+// holding DB's table.
+// The default is "mghash".
+// The schema is created if needed.
+// The name must consist of letters, digits, and underscores,
+// and must not begin with a digit.
+func Schema(name string) Option {
+	return func(db *DB) {
+		db.schema = name
+	}
+}
+
+// Project is an Option that sets the project name
+// recorded with each of DB's entries.
+// DBs with different project names share a table but not entries,
+// and evict only their own entries.
+// The default is the empty string.
+func Project(name string) Option {
+	return func(db *DB) {
+		db.project = name
+	}
+}
+
+// Has tells whether db contains the given hash.
+// If found, it also updates the last-access time of the hash.
+func (db *DB) Has(ctx context.Context, h []byte) (bool, error) {
+	const q = `UPDATE {schema}.hashes SET unix_secs = $1 WHERE project = $2 AND hash = $3 RETURNING true`
+	var found bool
+	err := db.db.QueryRowContext(ctx, db.sql(q), db.now().Unix(), db.project, h).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return found, errors.Wrap(err, "updating database")
+}
+
+const addQuery = `INSERT INTO {schema}.hashes (project, hash, unix_secs) VALUES ($1, $2, $3)
+  ON CONFLICT (project, hash) DO UPDATE SET unix_secs = EXCLUDED.unix_secs`
+
+// Add adds a hash to db.
+// If it is already present, its last-access time is updated.
+// If db was opened with the Keep option,
+// entries with old last-access times may be evicted.
+func (db *DB) Add(ctx context.Context, h []byte) error {
+	_, err := db.db.ExecContext(ctx, db.sql(addQuery), db.project, h, db.now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "adding hash to database")
+	}
+	return db.maybeEvict(ctx)
+}
+
+// AddMany adds hashes to db as with Add,
+// in a single transaction.
+// It implements mghash.BatchAdder.
+func (db *DB) AddMany(ctx context.Context, hashes [][]byte) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, db.sql(addQuery))
+	if err != nil {
+		return errors.Wrap(err, "preparing statement")
+	}
+	defer stmt.Close()
+
+	now := db.now().Unix()
+	for _, h := range hashes {
+		if _, err = stmt.ExecContext(ctx, db.project, h, now); err != nil {
+			return errors.Wrap(err, "adding hash to database")
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	return db.maybeEvict(ctx)
+}
+
+// maybeEvict evicts expired entries
+// if db.keep is set
+// and db.evictInterval has passed since the last time.
+func (db *DB) maybeEvict(ctx context.Context) error {
+	if db.keep <= 0 {
+		return nil
+	}
+	now := db.now()
+
+	db.mu.Lock()
+	if now.Sub(db.lastEvict) < db.evictInterval {
+		db.mu.Unlock()
+		return nil
+	}
+	db.lastEvict = now
+	db.mu.Unlock()
+
+	const q = `DELETE FROM {schema}.hashes WHERE project = $1 AND unix_secs < $2`
+	res, err := db.db.ExecContext(ctx, db.sql(q), db.project, now.Add(-db.keep).Unix())
+	if err != nil {
+		return errors.Wrap(err, "evicting expired database entries")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "counting evicted entries")
+	}
+	if n > 0 && db.onEvict != nil {
+		db.onEvict(int(n))
+	}
+	return nil
+}
+
+// Delete removes the given hashes from db.
+// It implements mghash.Deleter.
+func (db *DB) Delete(ctx context.Context, hashes ...[]byte) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	const q = `DELETE FROM {schema}.hashes WHERE project = $1 AND hash = $2`
+	for _, h := range hashes {
+		if _, err = tx.ExecContext(ctx, db.sql(q), db.project, h); err != nil {
+			return errors.Wrap(err, "deleting hash")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+// Stats reports the number and size of db's entries
+// and the range of their last-access times.
+// It implements mghash.Statser.
+func (db *DB) Stats(ctx context.Context) (mghash.Stats, error) {
+	const q = `SELECT COUNT(*), COALESCE(SUM(LENGTH(hash)), 0), MIN(unix_secs), MAX(unix_secs) FROM {schema}.hashes WHERE project = $1`
+	var (
+		result         mghash.Stats
+		oldest, newest sql.NullInt64
+	)
+	err := db.db.QueryRowContext(ctx, db.sql(q), db.project).Scan(&result.Entries, &result.Bytes, &oldest, &newest)
+	if err != nil {
+		return result, errors.Wrap(err, "querying stats")
+	}
+	if oldest.Valid {
+		result.Oldest = time.Unix(oldest.Int64, 0)
+	}
+	if newest.Valid {
+		result.Newest = time.Unix(newest.Int64, 0)
+	}
+	return result, nil
+}
@@ -0,0 +1,162 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB opens the Postgres database at $MGHASH_POSTGRES_DSN,
+// skipping the test if it is not set,
+// using a schema unique to the test
+// that is dropped when the test ends.
+func openTestDB(ctx context.Context, t *testing.T, opts ...Option) (*sql.DB, []Option) {
+	t.Helper()
+	dsn := os.Getenv("MGHASH_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MGHASH_POSTGRES_DSN not set")
+	}
+	sdb, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("mghash_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		defer sdb.Close()
+		if _, err := sdb.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+	return sdb, append([]Option{Schema(schema)}, opts...)
+}
+
+func newTestDB(ctx context.Context, t *testing.T, sdb *sql.DB, opts ...Option) *DB {
+	t.Helper()
+	db, err := New(ctx, sdb, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func has(ctx context.Context, t *testing.T, db *DB, h string) bool {
+	t.Helper()
+	ok, err := db.Has(ctx, []byte(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestDB(t *testing.T) {
+	ctx := context.Background()
+	sdb, opts := openTestDB(ctx, t)
+
+	var (
+		db    = newTestDB(ctx, t, sdb, append(opts, Project("a"))...)
+		other = newTestDB(ctx, t, sdb, append(opts, Project("b"))...)
+	)
+
+	if has(ctx, t, db, "x") {
+		t.Error("x found before adding it")
+	}
+	if err := db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddMany(ctx, [][]byte{[]byte("y"), []byte("zz")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"x", "y", "zz"} {
+		if !has(ctx, t, db, h) {
+			t.Errorf("%s not found after adding it", h)
+		}
+	}
+
+	// A different project has different entries.
+	if has(ctx, t, other, "x") {
+		t.Error("x found in a different project")
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 3 || stats.Bytes != 4 {
+		t.Errorf("got %d entries of %d bytes, want 3 of 4", stats.Entries, stats.Bytes)
+	}
+
+	if err = db.Delete(ctx, []byte("x"), []byte("nonexistent")); err != nil {
+		t.Fatal(err)
+	}
+	if has(ctx, t, db, "x") {
+		t.Error("x found after deleting it")
+	}
+	if !has(ctx, t, db, "y") {
+		t.Error("y not found after deleting x")
+	}
+}
+
+func TestKeep(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		now     = time.Unix(1000000, 0)
+		evicted int
+	)
+	sdb, opts := openTestDB(ctx, t)
+	opts = append(opts, Keep(time.Hour), EvictInterval(time.Minute), Clock(func() time.Time { return now }), OnEvict(func(n int) { evicted += n }))
+
+	var (
+		db    = newTestDB(ctx, t, sdb, append(opts, Project("a"))...)
+		other = newTestDB(ctx, t, sdb, append(opts, Project("b"))...)
+	)
+	add := func(db *DB, h string) {
+		t.Helper()
+		if err := db.Add(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add(db, "old")
+	add(other, "old")
+	now = now.Add(2 * time.Hour)
+	add(db, "new")
+	if evicted != 1 {
+		t.Fatalf("got %d evicted, want 1", evicted)
+	}
+	if has(ctx, t, db, "old") {
+		t.Error("expired entry found")
+	}
+
+	// Each project evicts only its own entries.
+	if !has(ctx, t, other, "old") {
+		t.Error("entry in another project evicted")
+	}
+
+	// Within EvictInterval of the last eviction, nothing is evicted.
+	last := now
+	now = last.Add(-2 * time.Hour)
+	add(db, "backdated")
+	now = last.Add(30 * time.Second)
+	add(db, "newer")
+	if evicted != 1 {
+		t.Errorf("got %d evicted within EvictInterval, want 1", evicted)
+	}
+	now = last.Add(2 * time.Minute)
+	add(db, "newest")
+	if evicted != 2 {
+		t.Errorf("got %d evicted after EvictInterval, want 2", evicted)
+	}
+	if has(ctx, t, db, "backdated") || !has(ctx, t, db, "new") || !has(ctx, t, db, "newer") {
+		t.Error("got the wrong entries evicted")
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	// The name is checked before the database is used.
+	if _, err := New(context.Background(), nil, Schema("bad name")); err == nil {
+		t.Error("no error for an invalid schema name")
+	}
+}
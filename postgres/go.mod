@@ -0,0 +1,20 @@
+module github.com/bobg/mghash/postgres
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015011847-7a2bf27b68fe
+	github.com/jackc/pgx/v5 v5.2.0
+	github.com/pkg/errors v0.9.1
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/magefile/mage v1.13.0 // indirect
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/text v0.3.8 // indirect
+)
@@ -1,61 +1,158 @@
 package mghash
 
-import "github.com/bobg/mghash"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type protoCmd struct {
 	name      string
-	goOut     string
+	outs      []protoOut
 	dirs      []string
 	otherArgs []string
+	targets   []string
+
+	// See ProtoGRPC.
+	grpc     bool
+	grpcOpts []string
+}
+
+// protoOut is an output spec for protoc:
+// a language plugin and an output directory,
+// producing a --LANG_out=DIR flag.
+type protoOut struct {
+	lang, dir string
 }
 
-// Proto produces a Rule for compiling protocol buffers to Go.
-func Proto(sources, targets []string, options ...ProtoOpt) mghash.Rule {
-	cmd := ProtoCmd{
-		name:  "protoc",
-		goOut: "--go_out=.",
-		dirs:  []string{"."},
+// Proto produces a Rule for compiling protocol buffers to Go,
+// and optionally to other languages (see ProtoOut).
+func Proto(sources, targets []string, options ...ProtoOpt) Rule {
+	cmd := protoCmd{
+		name: "protoc",
+		outs: []protoOut{{lang: "go", dir: "."}},
+		dirs: []string{"."},
 	}
 
 	for _, opt := range options {
 		opt(&cmd)
 	}
+	if cmd.grpc {
+		cmd.addGRPC(targets)
+	}
+
+	// Sort the output specs so the command does not depend on the order of options.
+	sort.Slice(cmd.outs, func(i, j int) bool {
+		return cmd.outs[i].lang < cmd.outs[j].lang
+	})
 
 	command := []string{cmd.name}
-	if cmd.goOut != "" {
-		command = append(command, cmd.goOut)
+	for _, out := range cmd.outs {
+		command = append(command, fmt.Sprintf("--%s_out=%s", out.lang, out.dir))
+	}
+	for _, opt := range cmd.grpcOpts {
+		command = append(command, "--go-grpc_opt="+opt)
 	}
 	for _, dir := range cmd.dirs {
 		command = append(command, "-I"+dir)
 	}
-	for _, arg := range cmd.otherArgs {
-		command = append(command, arg)
-	}
+	command = append(command, cmd.otherArgs...)
 	command = append(command, sources...)
 
 	return JRule{
 		Sources: sources,
-		Targets: targets,
+		Targets: append(append([]string{}, targets...), cmd.targets...),
 		Command: command,
 	}
 }
 
+// addGRPC adds the go-grpc output for ProtoGRPC,
+// in the same directory as the Go output,
+// unless ProtoOut has added one already.
+// The targets are those of the Go output
+// with .pb.go changed to _grpc.pb.go.
+func (cmd *protoCmd) addGRPC(goTargets []string) {
+	dir := "."
+	for _, out := range cmd.outs {
+		if out.lang == "go-grpc" {
+			return
+		}
+		if out.lang == "go" {
+			dir = out.dir
+		}
+	}
+	cmd.outs = append(cmd.outs, protoOut{lang: "go-grpc", dir: dir})
+	for _, target := range goTargets {
+		if strings.HasSuffix(target, ".pb.go") {
+			cmd.targets = append(cmd.targets, strings.TrimSuffix(target, ".pb.go")+"_grpc.pb.go")
+		}
+	}
+}
+
+// ProtoOpt is the type of an option that can be passed to Proto.
 type ProtoOpt func(*protoCmd)
 
+// Protoc is a ProtoOpt that sets the name of the protoc command.
+// The default is "protoc".
 func Protoc(name string) ProtoOpt {
 	return func(cmdptr *protoCmd) {
 		cmdptr.name = name
 	}
 }
 
-func ProtoDirs(dirs...string) ProtoOpt {
+// ProtoDirs is a ProtoOpt that adds directories to search for imports,
+// producing -I flags.
+// The current directory is always searched.
+func ProtoDirs(dirs ...string) ProtoOpt {
 	return func(cmdptr *protoCmd) {
-		cmd.dirs = append(cmd.dirs, dirs...)
+		cmdptr.dirs = append(cmdptr.dirs, dirs...)
 	}
 }
 
+// ProtocArgs is a ProtoOpt that adds arbitrary arguments to the protoc command,
+// placed before the sources.
 func ProtocArgs(args ...string) ProtoOpt {
 	return func(cmdptr *protoCmd) {
-		protoCmd.otherArgs = append(protoCmd.otherArgs, args...)
+		cmdptr.otherArgs = append(cmdptr.otherArgs, args...)
+	}
+}
+
+// ProtoOut is a ProtoOpt that adds an output language to the protoc command,
+// producing the flag --LANG_out=DIR.
+// The files generated for that language should be listed in targets,
+// which are added to the rule's targets.
+// By default, Proto generates Go into the current directory;
+// using ProtoOut with lang "go" replaces that default.
+// Several languages can be generated by one rule
+// by using ProtoOut once for each.
+func ProtoOut(lang, dir string, targets ...string) ProtoOpt {
+	return func(cmdptr *protoCmd) {
+		for i, out := range cmdptr.outs {
+			if out.lang == lang {
+				cmdptr.outs = append(cmdptr.outs[:i], cmdptr.outs[i+1:]...)
+				break
+			}
+		}
+		cmdptr.outs = append(cmdptr.outs, protoOut{lang: lang, dir: dir})
+		cmdptr.targets = append(cmdptr.targets, targets...)
+	}
+}
+
+// ProtoGRPC is a ProtoOpt that also generates gRPC stubs for Go,
+// using protoc-gen-go-grpc.
+// It produces the flag --go-grpc_out=DIR,
+// where DIR is the directory of the Go output,
+// plus --go-grpc_opt=OPT for each of opts,
+// e.g. "paths=source_relative".
+// For each target of Proto named X.pb.go,
+// X_grpc.pb.go is added to the rule's targets.
+// Since protoc-gen-go-grpc generates nothing for a .proto file without services,
+// such files should be compiled by a separate rule,
+// or their gRPC targets listed explicitly with ProtoOut("go-grpc", DIR, TARGETS...),
+// which takes precedence over the directory and targets chosen by ProtoGRPC.
+func ProtoGRPC(opts ...string) ProtoOpt {
+	return func(cmdptr *protoCmd) {
+		cmdptr.grpc = true
+		cmdptr.grpcOpts = append(cmdptr.grpcOpts, opts...)
 	}
 }
@@ -0,0 +1,93 @@
+package mghash
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtoMultipleLanguages(t *testing.T) {
+	var (
+		sources = []string{"a.proto"}
+		targets = []string{"a.pb.go"}
+		ts      = ProtoOut("ts", "web", "web/a_pb.ts")
+		py      = ProtoOut("python", "py", "py/a_pb2.py")
+	)
+	wantCommand := []string{"protoc", "--go_out=.", "--python_out=py", "--ts_out=web", "-I.", "a.proto"}
+
+	for _, opts := range [][]ProtoOpt{{ts, py}, {py, ts}} {
+		jr := Proto(sources, targets, opts...).(JRule)
+		if !reflect.DeepEqual(jr.Command, wantCommand) {
+			t.Errorf("got command %q, want %q", jr.Command, wantCommand)
+		}
+		for _, target := range []string{"a.pb.go", "web/a_pb.ts", "py/a_pb2.py"} {
+			if !hasString(jr.Targets, target) {
+				t.Errorf("targets %q lack %s", jr.Targets, target)
+			}
+		}
+		if len(jr.Targets) != 3 {
+			t.Errorf("got targets %q, want 3", jr.Targets)
+		}
+	}
+
+	// ProtoOut for Go replaces the default Go output.
+	jr := Proto(sources, nil, ProtoOut("go", "gen", "gen/a.pb.go"), ts).(JRule)
+	wantCommand = []string{"protoc", "--go_out=gen", "--ts_out=web", "-I.", "a.proto"}
+	if !reflect.DeepEqual(jr.Command, wantCommand) {
+		t.Errorf("got command %q, want %q", jr.Command, wantCommand)
+	}
+	if want := []string{"gen/a.pb.go", "web/a_pb.ts"}; !reflect.DeepEqual(jr.Targets, want) {
+		t.Errorf("got targets %q, want %q", jr.Targets, want)
+	}
+}
+
+func TestProtoOptions(t *testing.T) {
+	var (
+		sources = []string{"a.proto", "b.proto"}
+		targets = []string{"a.pb.go", "b.pb.go"}
+	)
+	cases := []struct {
+		opts        []ProtoOpt
+		wantCommand []string
+		wantTargets []string
+	}{{
+		wantCommand: []string{"protoc", "--go_out=.", "-I.", "a.proto", "b.proto"},
+		wantTargets: targets,
+	}, {
+		opts:        []ProtoOpt{Protoc("/opt/bin/protoc")},
+		wantCommand: []string{"/opt/bin/protoc", "--go_out=.", "-I.", "a.proto", "b.proto"},
+		wantTargets: targets,
+	}, {
+		opts:        []ProtoOpt{ProtoDirs("vendor", "third_party"), ProtoDirs("x")},
+		wantCommand: []string{"protoc", "--go_out=.", "-I.", "-Ivendor", "-Ithird_party", "-Ix", "a.proto", "b.proto"},
+		wantTargets: targets,
+	}, {
+		opts:        []ProtoOpt{ProtocArgs("--experimental_allow_proto3_optional"), ProtoDirs("x")},
+		wantCommand: []string{"protoc", "--go_out=.", "-I.", "-Ix", "--experimental_allow_proto3_optional", "a.proto", "b.proto"},
+		wantTargets: targets,
+	}, {
+		opts:        []ProtoOpt{ProtoGRPC("paths=source_relative")},
+		wantCommand: []string{"protoc", "--go_out=.", "--go-grpc_out=.", "--go-grpc_opt=paths=source_relative", "-I.", "a.proto", "b.proto"},
+		wantTargets: []string{"a.pb.go", "b.pb.go", "a_grpc.pb.go", "b_grpc.pb.go"},
+	}, {
+		opts:        []ProtoOpt{ProtoOut("go", "gen"), ProtoGRPC()},
+		wantCommand: []string{"protoc", "--go_out=gen", "--go-grpc_out=gen", "-I.", "a.proto", "b.proto"},
+		wantTargets: []string{"a.pb.go", "b.pb.go", "a_grpc.pb.go", "b_grpc.pb.go"},
+	}, {
+		// An explicit go-grpc output takes precedence over ProtoGRPC's.
+		opts:        []ProtoOpt{ProtoGRPC(), ProtoOut("go-grpc", "rpc", "rpc/a_grpc.pb.go")},
+		wantCommand: []string{"protoc", "--go_out=.", "--go-grpc_out=rpc", "-I.", "a.proto", "b.proto"},
+		wantTargets: []string{"a.pb.go", "b.pb.go", "rpc/a_grpc.pb.go"},
+	}}
+	for i, c := range cases {
+		jr := Proto(sources, targets, c.opts...).(JRule)
+		if !reflect.DeepEqual(jr.Command, c.wantCommand) {
+			t.Errorf("case %d: got command %q, want %q", i, jr.Command, c.wantCommand)
+		}
+		if !reflect.DeepEqual(jr.Targets, c.wantTargets) {
+			t.Errorf("case %d: got targets %q, want %q", i, jr.Targets, c.wantTargets)
+		}
+		if !reflect.DeepEqual(jr.Sources, sources) {
+			t.Errorf("case %d: got sources %q, want %q", i, jr.Sources, sources)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package mghash
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		db   = newFullDB()
+		rule = newTestRule("rule", "v1")
+		hit  = newTestRule("hit", "v1")
+	)
+	h := contentHash(ctx, t, hit)
+	if err := db.Add(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	ro := ReadOnly(db)
+
+	// Lookups reach db.
+	if ok, err := ro.Has(ctx, h); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("entry in the wrapped DB not found")
+	}
+	if ok, err := ro.Has(ctx, []byte("other")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("entry not in the wrapped DB found")
+	}
+
+	// Additions do not.
+	if err := ro.Add(ctx, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := db.Has(ctx, []byte("other")); ok {
+		t.Error("Add wrote to the wrapped DB")
+	}
+
+	// Nor do deletions,
+	// since the optional interfaces of db are hidden.
+	if _, ok := ro.(Deleter); ok {
+		t.Error("ReadOnly DB is a Deleter")
+	}
+	if _, err := ReconcileFns(ctx, ro, []*Fn{{Rule: rule}}); err == nil {
+		t.Error("no error reconciling a ReadOnly DB")
+	}
+	if ok, _ := db.Has(ctx, h); !ok {
+		t.Error("entry deleted from the wrapped DB")
+	}
+
+	// A rule found in db does not run;
+	// one that runs is not recorded, even with labels.
+	for _, r := range []testRule{hit, rule} {
+		if err := (&Fn{DB: ro, Rule: r, Labels: []string{"x"}}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *hit.runs != 0 {
+		t.Errorf("got %d runs of the rule in the wrapped DB, want 0", *hit.runs)
+	}
+	if *rule.runs != 1 {
+		t.Errorf("got %d runs of the rule not in the wrapped DB, want 1", *rule.runs)
+	}
+	if got := len(db.entries); got != 1 {
+		t.Errorf("got %d entries in the wrapped DB, want 1", got)
+	}
+	if got := len(db.labels); got != 0 {
+		t.Errorf("got %d labeled entries in the wrapped DB, want 0", got)
+	}
+}
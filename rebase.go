@@ -0,0 +1,48 @@
+package mghash
+
+import "path/filepath"
+
+// Rebase implements Rebaser.
+// Relative paths in Dir, Sources, Targets, Submodules, CleanDirs, Manifest, Aliases,
+// StdoutFile, StderrFile, TempDir, IgnoreFile, and DownloadDir
+// are joined to dir.
+// URL sources are unchanged.
+// An empty Dir becomes dir.
+// Script, which is relative to Dir, and Command are unchanged.
+func (jr JRule) Rebase(dir string) Rule {
+	rebase := func(path string) string {
+		if filepath.IsAbs(path) || isURL(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	rebaseAll := func(paths []string) []string {
+		if paths == nil {
+			return nil
+		}
+		result := make([]string, 0, len(paths))
+		for _, path := range paths {
+			result = append(result, rebase(path))
+		}
+		return result
+	}
+
+	jr.Dir = rebase(jr.Dir)
+	jr.Sources = rebaseAll(jr.Sources)
+	jr.Targets = rebaseAll(jr.Targets)
+	jr.Submodules = rebaseAll(jr.Submodules)
+	jr.CleanDirs = rebaseAll(jr.CleanDirs)
+	for _, p := range []*string{&jr.Manifest, &jr.StdoutFile, &jr.StderrFile, &jr.TempDir, &jr.IgnoreFile, &jr.DownloadDir} {
+		if *p != "" {
+			*p = rebase(*p)
+		}
+	}
+	if jr.Aliases != nil {
+		aliases := make(map[string]string, len(jr.Aliases))
+		for target, old := range jr.Aliases {
+			aliases[rebase(target)] = rebase(old)
+		}
+		jr.Aliases = aliases
+	}
+	return jr
+}
@@ -0,0 +1,90 @@
+package mghash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBaseDir(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		db     = NewMemDB()
+		shared = filepath.Join(t.TempDir(), "shared")
+		trees  = []string{t.TempDir(), t.TempDir()}
+		rule   = JRule{
+			Dir:     "sub",
+			Sources: []string{"sub/in", shared},
+			Targets: []string{"sub/out"},
+			Command: []string{"sh", "-c", "cat in " + shared + " > out"},
+		}
+	)
+	writeFile(t, shared, "!")
+	writeFile(t, filepath.Join(trees[0], "sub", "in"), "zero")
+	writeFile(t, filepath.Join(trees[1], "sub", "in"), "one")
+
+	// The same rule operates on each tree.
+	for _, tree := range trees {
+		if err := (&Fn{DB: db, Rule: rule, BaseDir: tree}).Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFile(t, filepath.Join(trees[0], "sub", "out"), "zero!")
+	checkFile(t, filepath.Join(trees[1], "sub", "out"), "one!")
+	if _, err := os.Stat("sub"); err == nil {
+		t.Error("rule ran in the current directory")
+	}
+
+	// Each tree has its own DB entry.
+	writeFile(t, filepath.Join(trees[1], "sub", "in"), "changed")
+	for i, wantStale := range []bool{false, true} {
+		stale, err := (&Fn{DB: db, Rule: rule, BaseDir: trees[i]}).Stale(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale != wantStale {
+			t.Errorf("tree %d: got stale %v, want %v", i, stale, wantStale)
+		}
+	}
+
+	// A Rule that is not a Rebaser cannot have a BaseDir.
+	if err := (&Fn{DB: db, Rule: newTestRule("rule", "v1"), BaseDir: trees[0]}).Run(ctx); err == nil {
+		t.Error("no error for BaseDir with a rule that is not a Rebaser")
+	}
+}
+
+func TestJDirBase(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		directive   string
+		wantSources []string
+		wantErr     bool
+	}{
+		{wantSources: []string{"src"}},
+		{directive: `{"base": "cwd"}`, wantSources: []string{"src"}},
+		{directive: `{"base": "file"}`, wantSources: []string{filepath.Join(dir, "src")}},
+		{directive: `{"base": "bogus"}`, wantErr: true},
+	}
+	for _, c := range cases {
+		writeFile(t, filepath.Join(dir, ".mghash.json"), c.directive+`{"sources": ["src"], "command": ["gen"]}`)
+		rules, err := JDir(dir)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", c.directive)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", c.directive, err)
+		}
+		if rules[0].Dir != dir {
+			t.Errorf("%s: got dir %s, want %s", c.directive, rules[0].Dir, dir)
+		}
+		if !reflect.DeepEqual(rules[0].Sources, c.wantSources) {
+			t.Errorf("%s: got sources %q, want %q", c.directive, rules[0].Sources, c.wantSources)
+		}
+	}
+}
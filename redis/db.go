@@ -0,0 +1,88 @@
+// Package redis implements mghash.DB using Redis,
+// for sharing a cache among machines.
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/bobg/mghash"
+)
+
+// DB is an implementation of mghash.DB that stores hashes as Redis keys.
+type DB struct {
+	client redis.UniversalClient
+	prefix string
+	keep   time.Duration
+}
+
+var _ mghash.DB = &DB{}
+
+// New produces a *DB using the given Redis client.
+// The caller remains responsible for closing the client.
+func New(client redis.UniversalClient, opts ...Option) *DB {
+	result := &DB{
+		client: client,
+		prefix: "mghash",
+	}
+	for _, opt := range opts {
+		opt(result)
+	}
+	return result
+}
+
+// Option is the type of a config option that can be passed to New.
+type Option func(*DB)
+
+// Keep is an Option that sets the amount of time to keep a database entry.
+// By default, DB keeps all entries.
+// Using Keep(d) gives each entry a Redis expiration of d,
+// which is renewed whenever the entry is found by Has.
+func Keep(d time.Duration) Option {
+	return func(db *DB) {
+		db.keep = d
+	}
+}
+
+// Prefix is an Option that sets a prefix for the keys DB uses.
+// The default is "mghash".
+// A key is the prefix, a colon, and the hash in hex,
+// so no two prefixes produce the same key.
+// Using different prefixes,
+// several projects can share a Redis instance without sharing entries.
+func Prefix(p string) Option {
+	return func(db *DB) {
+		db.prefix = p
+	}
+}
+
+// Has tells whether db contains the given hash.
+// If found, and db was created with the Keep option,
+// its expiration is renewed.
+func (db *DB) Has(ctx context.Context, h []byte) (bool, error) {
+	key := db.key(h)
+	if db.keep > 0 {
+		ok, err := db.client.Expire(ctx, key, db.keep).Result()
+		return ok, errors.Wrap(err, "renewing expiration")
+	}
+	n, err := db.client.Exists(ctx, key).Result()
+	return n > 0, errors.Wrap(err, "checking existence")
+}
+
+// Add adds a hash to db.
+// If db was created with the Keep option,
+// the entry expires after that long.
+func (db *DB) Add(ctx context.Context, h []byte) error {
+	err := db.client.Set(ctx, db.key(h), time.Now().Unix(), db.keep).Err()
+	return errors.Wrap(err, "adding hash to database")
+}
+
+func (db *DB) key(h []byte) string {
+	// The hex encoding contains no colon,
+	// so the last colon in a key ends the prefix.
+	return db.prefix + ":" + hex.EncodeToString(h)
+}
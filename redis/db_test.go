@@ -0,0 +1,137 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testClient connects to the Redis server at $MGHASH_REDIS_ADDR,
+// skipping the test if it is not set,
+// and returns the client with a key prefix unique to the test.
+// Keys with that prefix are deleted when the test ends.
+func testClient(ctx context.Context, t *testing.T) (*redis.Client, string) {
+	t.Helper()
+	addr := os.Getenv("MGHASH_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("MGHASH_REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("mghash-test:%s:%d:", t.Name(), time.Now().UnixNano())
+	t.Cleanup(func() {
+		defer client.Close()
+		keys, err := client.Keys(ctx, prefix+"*").Result()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(keys) > 0 {
+			if err = client.Del(ctx, keys...).Err(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return client, prefix
+}
+
+func TestDB(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := testClient(ctx, t)
+
+	var (
+		db    = New(client, Prefix(prefix+"a"))
+		other = New(client, Prefix(prefix+"b"))
+	)
+	has := func(db *DB, h string) bool {
+		t.Helper()
+		ok, err := db.Has(ctx, []byte(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if has(db, "x") {
+		t.Error("x found before adding it")
+	}
+	if err := db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !has(db, "x") {
+		t.Error("x not found after adding it")
+	}
+
+	// A different prefix has different entries.
+	if has(other, "x") {
+		t.Error("x found with a different prefix")
+	}
+
+	// Without Keep, entries do not expire.
+	ttl, err := client.TTL(ctx, db.key([]byte("x"))).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl >= 0 {
+		t.Errorf("got TTL %s without Keep, want none", ttl)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	ctx := context.Background()
+	client, prefix := testClient(ctx, t)
+
+	db := New(client, Prefix(prefix), Keep(time.Hour))
+	if err := db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	key := db.key([]byte("x"))
+
+	// Shorten the expiration, as if time had passed,
+	// and check that Has renews it.
+	if err := client.Expire(ctx, key, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("x not found")
+	}
+	ttl, err := client.TTL(ctx, key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= time.Minute || ttl > time.Hour {
+		t.Errorf("got TTL %s after Has, want it renewed to about an hour", ttl)
+	}
+
+	// An expired entry is not found.
+	if err = client.Del(ctx, key).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Has(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("expired entry found")
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	var (
+		ab   = New(nil, Prefix("ab"))
+		abcd = New(nil, Prefix("abcd"))
+	)
+	if k1, k2 := ab.key([]byte{0xcd, 0x00}), abcd.key([]byte{0x00}); k1 == k2 {
+		t.Errorf("prefixes ab and abcd produce the same key %s", k1)
+	}
+	if got, want := New(nil).key([]byte{0x12}), "mghash:12"; got != want {
+		t.Errorf("got default key %s, want %s", got, want)
+	}
+}
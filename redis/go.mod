@@ -0,0 +1,18 @@
+module github.com/bobg/mghash/redis
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015011847-7a2bf27b68fe
+	github.com/pkg/errors v0.9.1
+	github.com/redis/go-redis/v9 v9.0.5
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	github.com/magefile/mage v1.13.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
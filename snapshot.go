@@ -0,0 +1,77 @@
+package mghash
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshot records the size and modtime of a set of files.
+type snapshot map[string]fileState
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// takeSnapshot records the state of the given paths,
+// recursing into those that are directories.
+// Nonexistent paths are skipped.
+func takeSnapshot(paths []string) (snapshot, error) {
+	result := make(snapshot)
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return errors.Wrapf(err, "getting info for %s", p)
+			}
+			result[p] = fileState{size: info.Size(), modTime: info.ModTime()}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "walking %s", path)
+		}
+	}
+	return result, nil
+}
+
+// changedSince returns the sorted list of files in s
+// that are absent from, or differ from, those in before.
+func (s snapshot) changedSince(before snapshot) []string {
+	var result []string
+	for path, state := range s {
+		if prev, ok := before[path]; !ok || prev.size != state.size || !prev.modTime.Equal(state.modTime) {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// removeChanged removes the files among paths
+// that were created or modified since before was taken.
+func removeChanged(paths []string, before snapshot) error {
+	after, err := takeSnapshot(paths)
+	if err != nil {
+		return err
+	}
+	for _, path := range after.changedSince(before) {
+		if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Wrapf(err, "removing %s", path)
+		}
+	}
+	return nil
+}
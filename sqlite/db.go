@@ -3,6 +3,10 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,39 +19,254 @@ import (
 type DB struct {
 	db   *sql.DB
 	keep time.Duration
+	now  func() time.Time
+
+	// Whether db was opened by Open (and not supplied to New).
+	owned bool
+
+	checkIntegrity bool
+
+	// Connection settings (see JournalMode and BusyTimeout).
+	journalMode string
+	busyTimeout time.Duration
+
+	// Whether hashes are stored as hex text rather than as blobs.
+	hex bool
+
+	onEvict       func(count int)
+	onEvictHashes func(hashes [][]byte)
+
+	// How long a reservation lasts (see CheckAndReserve).
+	reservationTimeout time.Duration
+
+	// Names of the tables in use.
+	// These are substituted for {hashes}, {labels}, {files}, and {meta} in queries.
+	hashesTable, labelsTable, filesTable, metaTable string
 }
 
-var _ mghash.DB = &DB{}
+var (
+	_ mghash.DB         = &DB{}
+	_ mghash.Labeler    = &DB{}
+	_ mghash.Iterator   = &DB{}
+	_ mghash.Deleter    = &DB{}
+	_ mghash.BatchAdder = &DB{}
+	_ mghash.Statser    = &DB{}
+	_ mghash.Reserver   = &DB{}
+
+	_ mghash.FileHashCache = &DB{}
+)
 
 const schema = `
-CREATE TABLE IF NOT EXISTS hashes (
+-- An entry's status is 'done' once added,
+-- or 'pending' while reserved (see CheckAndReserve),
+-- in which case unix_secs is when it was reserved.
+-- Databases created before the status column existed get it when next opened.
+CREATE TABLE IF NOT EXISTS {hashes} (
   hash BLOB NOT NULL PRIMARY KEY,
-  unix_secs INT NOT NULL
+  unix_secs INT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'done'
+);
+
+-- For eviction (see Keep).
+-- Databases created before this index existed get it when next opened.
+CREATE INDEX IF NOT EXISTS {hashes}_unix_secs ON {hashes} (unix_secs);
+
+CREATE TABLE IF NOT EXISTS {labels} (
+  hash BLOB NOT NULL,
+  label TEXT NOT NULL,
+  PRIMARY KEY (hash, label)
+);
+
+CREATE TABLE IF NOT EXISTS {files} (
+  path TEXT NOT NULL,
+  mode TEXT NOT NULL,
+  size INT NOT NULL,
+  mtime_nanos INT NOT NULL,
+  hash BLOB NOT NULL,
+  PRIMARY KEY (path, mode)
+);
+
+-- Facts about the database itself,
+-- such as the format of its hashes (see Hex).
+CREATE TABLE IF NOT EXISTS {meta} (
+  key TEXT NOT NULL PRIMARY KEY,
+  value TEXT NOT NULL
 );
 `
 
 // Open opens the given file and returns it as a *DB.
+// Unless overridden with the JournalMode and BusyTimeout options,
+// the database uses WAL journaling
+// and a busy timeout of five seconds,
+// which allow concurrent use by several processes
+// (such as parallel mage targets).
+// WAL relies on shared memory,
+// so it does not work for a database on a network filesystem;
+// use JournalMode("DELETE") for that.
+// If path is empty,
+// the DB named in the project config file is used
+// (see mghash.LoadConfig).
 // The file is created if it doesn't already exist.
 // The database schema is created in the file if needed.
 // Callers should call Close when finished operating on the database.
 func Open(ctx context.Context, path string, opts ...Option) (*DB, error) {
-	db, err := sql.Open("sqlite3", path)
+	if path == "" {
+		c, err := mghash.LoadConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "loading config")
+		}
+		if c.DB == "" {
+			return nil, errors.New("no database path given or configured")
+		}
+		path = c.DB
+	}
+
+	settings := DB{journalMode: "WAL", busyTimeout: defaultBusyTimeout}
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
+	db, err := sql.Open("sqlite3", settings.dsn(path))
 	if err != nil {
 		return nil, errors.Wrapf(err, "opening sqlite db %s", path)
 	}
-	_, err = db.ExecContext(ctx, schema)
+	result, err := New(ctx, db, opts...)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating schema")
+		db.Close()
+		return nil, errors.Wrapf(err, "initializing %s", path)
+	}
+	result.owned = true
+	return result, nil
+}
+
+const defaultBusyTimeout = 5 * time.Second
+
+// dsn produces the data source name for opening path
+// with db's connection settings.
+func (db *DB) dsn(path string) string {
+	var params []string
+	if db.journalMode != "" {
+		params = append(params, "_journal_mode="+db.journalMode)
+	}
+	if db.busyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", db.busyTimeout.Milliseconds()))
+	}
+	if len(params) == 0 {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + strings.Join(params, "&")
+}
+
+// New returns a *DB using an existing Sqlite3 connection.
+// The database schema is created if needed.
+// The caller remains responsible for closing db;
+// the Close method of the result does not close it.
+func New(ctx context.Context, db *sql.DB, opts ...Option) (*DB, error) {
+	result := &DB{
+		db:                 db,
+		now:                time.Now,
+		reservationTimeout: DefaultReservationTimeout,
+		hashesTable:        "hashes",
+		labelsTable:        "labels",
+		filesTable:         "files",
+		metaTable:          "meta",
 	}
-	result := &DB{db: db}
 	for _, opt := range opts {
 		opt(result)
 	}
+	if !validIdentifier.MatchString(result.hashesTable) {
+		return nil, fmt.Errorf("invalid table name %q", result.hashesTable)
+	}
+	if result.checkIntegrity {
+		if err := result.integrityCheck(ctx); err != nil {
+			return nil, errors.Wrap(err, "checking integrity")
+		}
+	}
+	if result.journalMode != "" {
+		if !validIdentifier.MatchString(result.journalMode) {
+			return nil, fmt.Errorf("invalid journal mode %q", result.journalMode)
+		}
+		if _, err := db.ExecContext(ctx, "PRAGMA journal_mode = "+result.journalMode); err != nil {
+			return nil, errors.Wrap(err, "setting journal mode")
+		}
+	}
+	if _, err := db.ExecContext(ctx, result.sql(schema)); err != nil {
+		return nil, errors.Wrap(err, "creating schema")
+	}
+	if err := result.addStatus(ctx); err != nil {
+		return nil, errors.Wrap(err, "adding status column")
+	}
+	if err := result.checkFormat(ctx); err != nil {
+		return nil, errors.Wrap(err, "checking hash format")
+	}
 	return result, nil
 }
 
-// Close releases the resources of s.
+var validIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// addStatus adds the status column to a hashes table created without it,
+// marking every existing entry done.
+func (db *DB) addStatus(ctx context.Context) error {
+	var n int
+	const q1 = `SELECT COUNT(*) FROM pragma_table_info('{hashes}') WHERE name = 'status'`
+	if err := db.db.QueryRowContext(ctx, db.sql(q1)).Scan(&n); err != nil {
+		return errors.Wrap(err, "examining table")
+	}
+	if n > 0 {
+		return nil
+	}
+	const q2 = `ALTER TABLE {hashes} ADD COLUMN status TEXT NOT NULL DEFAULT 'done'`
+	_, err := db.db.ExecContext(ctx, db.sql(q2))
+	return errors.Wrap(err, "altering table")
+}
+
+// sql replaces {hashes}, {labels}, {files}, and {meta} in q with the names of db's tables.
+func (db *DB) sql(q string) string {
+	return strings.NewReplacer(
+		"{hashes}", db.hashesTable,
+		"{labels}", db.labelsTable,
+		"{files}", db.filesTable,
+		"{meta}", db.metaTable,
+	).Replace(q)
+}
+
+func (db *DB) integrityCheck(ctx context.Context) error {
+	rows, err := db.db.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return errors.Wrap(err, "running integrity check")
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return errors.Wrap(err, "scanning integrity check result")
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "iterating over integrity check results")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database is corrupt: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Close releases the resources of db.
+// If db was created with New,
+// this does nothing.
 func (db *DB) Close() error {
+	if !db.owned {
+		return nil
+	}
 	return db.db.Close()
 }
 
@@ -57,17 +276,234 @@ type Option func(*DB)
 // Keep is an Option that sets the amount of time to keep a database entry.
 // By default, DB keeps all entries.
 // Using Keep(d) allows DB to evict entries whose last-access time is older than d.
+// Last-access times are recorded to the second.
 func Keep(d time.Duration) Option {
 	return func(db *DB) {
 		db.keep = d
 	}
 }
 
+// Clock is an Option that sets the function DB uses to get the current time.
+// By default this is time.Now.
+// It is mainly useful in tests of eviction behavior.
+func Clock(now func() time.Time) Option {
+	return func(db *DB) {
+		db.now = now
+	}
+}
+
+// OnEvict is an Option that sets a function to call after DB evicts entries
+// (see Keep),
+// with the number of entries evicted.
+// It is not called when an eviction pass finds nothing to remove.
+// This can help in choosing a Keep duration
+// that does not cause entries to churn.
+func OnEvict(f func(count int)) Option {
+	return func(db *DB) {
+		db.onEvict = f
+	}
+}
+
+// OnEvictHashes is an Option that sets a function to call after DB evicts entries
+// (see Keep),
+// with the evicted hashes.
+// This can be used to clean up external state associated with the entries.
+// It is not called when an eviction pass finds nothing to remove.
+func OnEvictHashes(f func(hashes [][]byte)) Option {
+	return func(db *DB) {
+		db.onEvictHashes = f
+	}
+}
+
+// CheckIntegrity is an Option that causes Open to verify the integrity of the database file,
+// returning an error if it is corrupt.
+// This can be slow for large databases.
+func CheckIntegrity(db *DB) {
+	db.checkIntegrity = true
+}
+
+// JournalMode is an Option that sets the sqlite journal mode,
+// e.g. "WAL" or "DELETE".
+// See https://www.sqlite.org/pragma.html#pragma_journal_mode.
+// Open uses WAL by default.
+// With New the default is to leave the journal mode unchanged,
+// as does an empty mode.
+func JournalMode(mode string) Option {
+	return func(db *DB) {
+		db.journalMode = mode
+	}
+}
+
+// BusyTimeout is an Option that sets how long an operation waits for a lock
+// held by another connection
+// before failing with a "database is locked" error.
+// The default is five seconds.
+// It affects only databases opened with Open;
+// for New, set it when opening the *sql.DB,
+// e.g. with the _busy_timeout parameter of github.com/mattn/go-sqlite3.
+// A zero duration leaves the driver's default in place.
+func BusyTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.busyTimeout = d
+	}
+}
+
+// Hex is an Option that causes DB to store hashes as lowercase hexadecimal text
+// rather than as binary blobs,
+// so that generic database tools can display them.
+// The format is recorded in the database.
+// Existing blob entries are converted
+// the first time the database is opened with this option,
+// after which opening it without the option is an error.
+// Blobs are the default because they are more compact.
+func Hex(db *DB) {
+	db.hex = true
+}
+
+// Hash formats recorded in the {meta} table.
+const (
+	formatBlob = "blob"
+	formatHex  = "hex"
+
+	// Only detected, never recorded.
+	formatMixed = "mixed"
+)
+
+// checkFormat makes sure the hashes in db are stored in the format the Hex option calls for,
+// converting blobs to hex text if needed,
+// and records the format.
+func (db *DB) checkFormat(ctx context.Context) error {
+	want := formatBlob
+	if db.hex {
+		want = formatHex
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var stored string
+	err = tx.QueryRowContext(ctx, db.sql(`SELECT value FROM {meta} WHERE key = 'format'`)).Scan(&stored)
+	if err == nil && stored == want {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// A new database, or one from before the format was recorded.
+		stored, err = db.detectFormat(ctx, tx)
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting hash format")
+	}
+
+	switch {
+	case stored == want:
+	case want == formatHex:
+		if err = db.convertToHex(ctx, tx); err != nil {
+			return errors.Wrap(err, "converting hashes to hex")
+		}
+	case stored == formatHex:
+		return errors.New("the database stores hashes as hex text; open it with the Hex option")
+	default:
+		return errors.New("the database stores hashes both as blobs and as hex text; open it with the Hex option to convert them")
+	}
+
+	const q = `INSERT INTO {meta} (key, value) VALUES ('format', $1) ON CONFLICT (key) DO UPDATE SET value = excluded.value`
+	if _, err = tx.ExecContext(ctx, db.sql(q), want); err != nil {
+		return errors.Wrap(err, "recording hash format")
+	}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+// detectFormat tells how the hashes in db are stored,
+// judging from the entries themselves.
+// An empty database is taken to store blobs.
+func (db *DB) detectFormat(ctx context.Context, tx *sql.Tx) (string, error) {
+	var hasBlob, hasText bool
+	const q = `SELECT EXISTS (SELECT 1 FROM {hashes} WHERE typeof(hash) = 'blob'), EXISTS (SELECT 1 FROM {hashes} WHERE typeof(hash) = 'text')`
+	if err := tx.QueryRowContext(ctx, db.sql(q)).Scan(&hasBlob, &hasText); err != nil {
+		return "", errors.Wrap(err, "examining hashes")
+	}
+	switch {
+	case hasBlob && hasText:
+		return formatMixed, nil
+	case hasText:
+		return formatHex, nil
+	default:
+		return formatBlob, nil
+	}
+}
+
+// convertToHex converts blob hashes in db to hex text.
+// Where both forms of a hash are present,
+// the hex one is kept.
+func (db *DB) convertToHex(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range []string{"{hashes}", "{labels}"} {
+		q1 := `UPDATE OR IGNORE ` + table + ` SET hash = lower(hex(hash)) WHERE typeof(hash) = 'blob'`
+		if _, err := tx.ExecContext(ctx, db.sql(q1)); err != nil {
+			return errors.Wrap(err, "updating hashes")
+		}
+		q2 := `DELETE FROM ` + table + ` WHERE typeof(hash) = 'blob'`
+		if _, err := tx.ExecContext(ctx, db.sql(q2)); err != nil {
+			return errors.Wrap(err, "deleting duplicate hashes")
+		}
+	}
+	return nil
+}
+
+// key produces the database representation of h.
+func (db *DB) key(h []byte) interface{} {
+	if db.hex {
+		return hex.EncodeToString(h)
+	}
+	return h
+}
+
+// Table is an Option that sets the name of the table DB uses for storing hashes.
+// The default is "hashes".
+// Using different tables,
+// several DBs can share a single file without sharing entries.
+// The name must consist of letters, digits, and underscores,
+// and must not begin with a digit.
+// Labels (see AddWithLabels), file hashes (see FileHash),
+// and facts about the table itself (see Hex)
+// are stored in additional tables
+// named by adding the suffixes "_labels", "_files", and "_meta".
+func Table(name string) Option {
+	return func(db *DB) {
+		db.hashesTable = name
+		db.labelsTable = name + "_labels"
+		db.filesTable = name + "_files"
+		db.metaTable = name + "_meta"
+	}
+}
+
+// ReservationTimeout is an Option that sets how long a reservation made with CheckAndReserve lasts
+// if it is neither released nor completed with Add,
+// e.g. because the process holding it crashed.
+// After that, the reservation is stale:
+// the next call to CheckAndReserve clears it
+// (along with any other stale reservations)
+// and another caller may take it over.
+// The default is DefaultReservationTimeout;
+// it should be longer than any rule takes to run.
+func ReservationTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.reservationTimeout = d
+	}
+}
+
+// DefaultReservationTimeout is how long a reservation lasts
+// without the ReservationTimeout option.
+const DefaultReservationTimeout = 10 * time.Minute
+
 // Has tells whether db contains the given hash.
 // If found, it also updates the last-access time of the hash.
+// A hash that is only reserved (see CheckAndReserve) is not found.
 func (db *DB) Has(ctx context.Context, h []byte) (bool, error) {
-	const q = `UPDATE hashes SET unix_secs = $1 WHERE hash = $2`
-	res, err := db.db.ExecContext(ctx, q, time.Now().Unix(), h)
+	const q = `UPDATE {hashes} SET unix_secs = $1 WHERE hash = $2 AND status = 'done'`
+	res, err := db.db.ExecContext(ctx, db.sql(q), db.now().Unix(), db.key(h))
 	if err != nil {
 		return false, errors.Wrap(err, "updating database")
 	}
@@ -77,20 +513,302 @@ func (db *DB) Has(ctx context.Context, h []byte) (bool, error) {
 
 // Add adds a hash to db.
 // If it is already present, its last-access time is updated.
+// If it is reserved (see CheckAndReserve), the reservation is completed.
 // If db was opened with the Keep option,
 // entries with old last-access times are evicted.
 func (db *DB) Add(ctx context.Context, h []byte) error {
-	const q = `INSERT INTO hashes (hash, unix_secs) VALUES ($1, $2) ON CONFLICT DO UPDATE SET unix_secs = $2 WHERE hash = $1`
-	_, err := db.db.ExecContext(ctx, q, h, time.Now().Unix())
+	const q = `INSERT INTO {hashes} (hash, unix_secs) VALUES ($1, $2) ON CONFLICT DO UPDATE SET unix_secs = $2, status = 'done' WHERE hash = $1`
+	_, err := db.db.ExecContext(ctx, db.sql(q), db.key(h), db.now().Unix())
 	if err != nil {
 		return errors.Wrap(err, "adding hash to database")
 	}
 	if db.keep > 0 {
-		const q2 = `DELETE FROM hashes WHERE unix_secs < $1`
-		_, err = db.db.ExecContext(ctx, q, time.Now().Add(-db.keep).Unix())
-		if err != nil {
-			return errors.Wrap(err, "evicting expired database entries")
+		return db.evict(ctx)
+	}
+	return nil
+}
+
+// AddMany adds hashes to db as with Add,
+// in a single transaction.
+// This is much faster than calling Add for each.
+// It implements mghash.BatchAdder.
+func (db *DB) AddMany(ctx context.Context, hashes [][]byte) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	const q = `INSERT INTO {hashes} (hash, unix_secs) VALUES ($1, $2) ON CONFLICT DO UPDATE SET unix_secs = $2, status = 'done' WHERE hash = $1`
+	stmt, err := tx.PrepareContext(ctx, db.sql(q))
+	if err != nil {
+		return errors.Wrap(err, "preparing statement")
+	}
+	defer stmt.Close()
+
+	now := db.now().Unix()
+	for _, h := range hashes {
+		if _, err = stmt.ExecContext(ctx, db.key(h), now); err != nil {
+			return errors.Wrap(err, "adding hash to database")
 		}
 	}
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	if db.keep > 0 {
+		return db.evict(ctx)
+	}
+	return nil
+}
+
+// evict removes entries whose last-access times are older than db.keep,
+// together with their labels,
+// calling the OnEvict and OnEvictHashes functions, if any.
+func (db *DB) evict(ctx context.Context) error {
+	var (
+		cutoff  = db.now().Add(-db.keep).Unix()
+		n       int
+		evicted [][]byte
+		err     error
+	)
+	if db.onEvictHashes == nil {
+		n, err = db.evictCount(ctx, cutoff)
+	} else {
+		evicted, err = db.evictHashes(ctx, cutoff)
+		n = len(evicted)
+	}
+	if err != nil {
+		return errors.Wrap(err, "evicting expired database entries")
+	}
+	if n == 0 {
+		return nil
+	}
+
+	const q = `DELETE FROM {labels} WHERE hash NOT IN (SELECT hash FROM {hashes})`
+	if _, err = db.db.ExecContext(ctx, db.sql(q)); err != nil {
+		return errors.Wrap(err, "deleting orphaned labels")
+	}
+
+	if db.onEvict != nil {
+		db.onEvict(n)
+	}
+	if db.onEvictHashes != nil {
+		db.onEvictHashes(evicted)
+	}
 	return nil
 }
+
+// evictCount deletes entries last accessed before cutoff,
+// returning how many there were.
+func (db *DB) evictCount(ctx context.Context, cutoff int64) (int, error) {
+	const q = `DELETE FROM {hashes} WHERE unix_secs < $1 AND status = 'done'`
+	res, err := db.db.ExecContext(ctx, db.sql(q), cutoff)
+	if err != nil {
+		return 0, errors.Wrap(err, "deleting entries")
+	}
+	n, err := res.RowsAffected()
+	return int(n), errors.Wrap(err, "counting deleted entries")
+}
+
+// evictHashes deletes entries last accessed before cutoff,
+// returning their hashes.
+func (db *DB) evictHashes(ctx context.Context, cutoff int64) ([][]byte, error) {
+	const q = `DELETE FROM {hashes} WHERE unix_secs < $1 AND status = 'done' RETURNING hash`
+	rows, err := db.db.QueryContext(ctx, db.sql(q), cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "deleting entries")
+	}
+	defer rows.Close()
+
+	var result [][]byte
+	for rows.Next() {
+		var h []byte
+		if err = rows.Scan(&h); err != nil {
+			return nil, errors.Wrap(err, "scanning deleted hash")
+		}
+		if db.hex {
+			if h, err = hex.DecodeString(string(h)); err != nil {
+				return nil, errors.Wrap(err, "decoding deleted hash")
+			}
+		}
+		result = append(result, h)
+	}
+	return result, errors.Wrap(rows.Err(), "iterating over deleted hashes")
+}
+
+// CheckAndReserve reserves h for the caller
+// if db neither contains it nor holds an unexpired reservation for it
+// (see ReservationTimeout),
+// reporting whether it did.
+// The reservation is an entry with a status of pending,
+// which Add completes and Release removes.
+// Stale reservations are cleared first.
+// It implements mghash.Reserver.
+func (db *DB) CheckAndReserve(ctx context.Context, h []byte) (bool, error) {
+	now := db.now()
+
+	const q1 = `DELETE FROM {hashes} WHERE status = 'pending' AND unix_secs < $1`
+	if _, err := db.db.ExecContext(ctx, db.sql(q1), now.Add(-db.reservationTimeout).Unix()); err != nil {
+		return false, errors.Wrap(err, "clearing stale reservations")
+	}
+
+	// The insertion is the atomic check:
+	// it adds a row only if there is none for h,
+	// whether added or reserved.
+	const q2 = `INSERT INTO {hashes} (hash, unix_secs, status) VALUES ($1, $2, 'pending') ON CONFLICT DO NOTHING`
+	res, err := db.db.ExecContext(ctx, db.sql(q2), db.key(h), now.Unix())
+	if err != nil {
+		return false, errors.Wrap(err, "adding reservation")
+	}
+	aff, err := res.RowsAffected()
+	return aff > 0, errors.Wrap(err, "counting affected rows")
+}
+
+// Release removes the reservation for h made with CheckAndReserve,
+// if it has not been completed with Add.
+// It implements mghash.Reserver.
+func (db *DB) Release(ctx context.Context, h []byte) error {
+	const q = `DELETE FROM {hashes} WHERE hash = $1 AND status = 'pending'`
+	_, err := db.db.ExecContext(ctx, db.sql(q), db.key(h))
+	return errors.Wrap(err, "removing reservation")
+}
+
+// AddWithLabels adds a hash to db as with Add,
+// and attaches the given labels to it.
+// Entries can later be removed in bulk with DeleteByLabel.
+func (db *DB) AddWithLabels(ctx context.Context, h []byte, labels ...string) error {
+	if err := db.Add(ctx, h); err != nil {
+		return err
+	}
+	const q = `INSERT INTO {labels} (hash, label) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	for _, label := range labels {
+		if _, err := db.db.ExecContext(ctx, db.sql(q), db.key(h), label); err != nil {
+			return errors.Wrapf(err, "adding label %s", label)
+		}
+	}
+	return nil
+}
+
+// DeleteByLabel removes from db all hashes having the given label.
+func (db *DB) DeleteByLabel(ctx context.Context, label string) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	const q1 = `DELETE FROM {hashes} WHERE hash IN (SELECT hash FROM {labels} WHERE label = $1)`
+	if _, err = tx.ExecContext(ctx, db.sql(q1), label); err != nil {
+		return errors.Wrap(err, "deleting labeled hashes")
+	}
+	const q2 = `DELETE FROM {labels} WHERE hash NOT IN (SELECT hash FROM {hashes})`
+	if _, err = tx.ExecContext(ctx, db.sql(q2)); err != nil {
+		return errors.Wrap(err, "deleting orphaned labels")
+	}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+// Delete removes the given hashes, and their labels, from db.
+// It implements mghash.Deleter.
+func (db *DB) Delete(ctx context.Context, hashes ...[]byte) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	const (
+		q1 = `DELETE FROM {hashes} WHERE hash = $1`
+		q2 = `DELETE FROM {labels} WHERE hash = $1`
+	)
+	for _, h := range hashes {
+		if _, err = tx.ExecContext(ctx, db.sql(q1), db.key(h)); err != nil {
+			return errors.Wrap(err, "deleting hash")
+		}
+		if _, err = tx.ExecContext(ctx, db.sql(q2), db.key(h)); err != nil {
+			return errors.Wrap(err, "deleting labels")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "committing transaction")
+}
+
+// Stats reports the number and size of the entries in db
+// and the range of their last-access times.
+// It implements mghash.Statser.
+func (db *DB) Stats(ctx context.Context) (mghash.Stats, error) {
+	const q = `SELECT COUNT(*), COALESCE(SUM(LENGTH(hash)), 0), MIN(unix_secs), MAX(unix_secs) FROM {hashes} WHERE status = 'done'`
+	var (
+		result         mghash.Stats
+		oldest, newest sql.NullInt64
+	)
+	err := db.db.QueryRowContext(ctx, db.sql(q)).Scan(&result.Entries, &result.Bytes, &oldest, &newest)
+	if err != nil {
+		return result, errors.Wrap(err, "querying stats")
+	}
+	if db.hex {
+		// Two hex digits per byte.
+		result.Bytes /= 2
+	}
+	if oldest.Valid {
+		result.Oldest = time.Unix(oldest.Int64, 0)
+	}
+	if newest.Valid {
+		result.Newest = time.Unix(newest.Int64, 0)
+	}
+	return result, nil
+}
+
+// ForEach calls f for each hash in db and its last-access time.
+// Rows are streamed from the database, not loaded all at once.
+// It implements mghash.Iterator.
+func (db *DB) ForEach(ctx context.Context, f func([]byte, time.Time) error) error {
+	const q = `SELECT hash, unix_secs FROM {hashes} WHERE status = 'done'`
+	rows, err := db.db.QueryContext(ctx, db.sql(q))
+	if err != nil {
+		return errors.Wrap(err, "querying hashes")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			h        []byte
+			unixSecs int64
+		)
+		if err = rows.Scan(&h, &unixSecs); err != nil {
+			return errors.Wrap(err, "scanning row")
+		}
+		if db.hex {
+			if h, err = hex.DecodeString(string(h)); err != nil {
+				return errors.Wrap(err, "decoding hash")
+			}
+		}
+		if err = f(h, time.Unix(unixSecs, 0)); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "iterating over rows")
+}
+
+// FileHash implements mghash.FileHashCache.
+// File hashes are stored separately from the hashes added with Add,
+// and are not subject to eviction.
+func (db *DB) FileHash(ctx context.Context, key mghash.FileKey) ([]byte, error) {
+	const q = `SELECT hash FROM {files} WHERE path = $1 AND mode = $2 AND size = $3 AND mtime_nanos = $4`
+	var h []byte
+	err := db.db.QueryRowContext(ctx, db.sql(q), key.Path, key.Mode, key.Size, key.ModTime.UnixNano()).Scan(&h)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return h, errors.Wrap(err, "querying file hash")
+}
+
+// SetFileHash implements mghash.FileHashCache.
+func (db *DB) SetFileHash(ctx context.Context, key mghash.FileKey, h []byte) error {
+	const q = `INSERT INTO {files} (path, mode, size, mtime_nanos, hash) VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT DO UPDATE SET size = $3, mtime_nanos = $4, hash = $5`
+	_, err := db.db.ExecContext(ctx, db.sql(q), key.Path, key.Mode, key.Size, key.ModTime.UnixNano(), h)
+	return errors.Wrap(err, "storing file hash")
+}
@@ -0,0 +1,909 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bobg/mghash"
+)
+
+func TestDeleteByLabel(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(ctx, t)
+
+	entries := []struct {
+		hash   string
+		labels []string
+	}{
+		{hash: "a", labels: []string{"x"}},
+		{hash: "b", labels: []string{"x", "y"}},
+		{hash: "c", labels: []string{"y"}},
+		{hash: "d"},
+	}
+	for _, e := range entries {
+		if err := db.AddWithLabels(ctx, []byte(e.hash), e.labels...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.DeleteByLabel(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		want := e.hash == "c" || e.hash == "d"
+		if got := has(ctx, t, db, e.hash); got != want {
+			t.Errorf("after DeleteByLabel, Has(%s) = %v, want %v", e.hash, got, want)
+		}
+	}
+
+	// The labels of deleted entries are gone too,
+	// so re-adding b without labels does not bring back its label y.
+	if err := db.Add(ctx, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteByLabel(ctx, "y"); err != nil {
+		t.Fatal(err)
+	}
+	if !has(ctx, t, db, "b") {
+		t.Error("stale label deleted b")
+	}
+	if has(ctx, t, db, "c") {
+		t.Error("DeleteByLabel(y) did not delete c")
+	}
+}
+
+func openTestDB(ctx context.Context, t testing.TB, opts ...Option) *DB {
+	t.Helper()
+	db, err := Open(ctx, filepath.Join(t.TempDir(), "test.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func has(ctx context.Context, t *testing.T, db *DB, h string) bool {
+	t.Helper()
+	ok, err := db.Has(ctx, []byte(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// fakeClock is a settable clock for the Clock option.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestClock(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(ctx, t, Clock(clock.now))
+	)
+	if err := db.Add(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := accessTime(ctx, t, db, "a"); !got.Equal(clock.t) {
+		t.Errorf("got access time %s after Add, want %s", got, clock.t)
+	}
+
+	// Has records the time of the access.
+	clock.advance(time.Hour)
+	if !has(ctx, t, db, "a") {
+		t.Fatal("a missing")
+	}
+	if got := accessTime(ctx, t, db, "a"); !got.Equal(clock.t) {
+		t.Errorf("got access time %s after Has, want %s", got, clock.t)
+	}
+}
+
+// accessTime returns the last-access time recorded for h in db.
+func accessTime(ctx context.Context, t *testing.T, db *DB, h string) time.Time {
+	t.Helper()
+	var secs int64
+	if err := db.db.QueryRowContext(ctx, `SELECT unix_secs FROM hashes WHERE hash = $1`, []byte(h)).Scan(&secs); err != nil {
+		t.Fatal(err)
+	}
+	return time.Unix(secs, 0)
+}
+
+func TestKeepBoundary(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(ctx, t, Keep(time.Hour), Clock(clock.now))
+	)
+
+	add := func(h string) {
+		t.Helper()
+		if err := db.Add(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("a")
+	clock.advance(30 * time.Minute)
+	add("b")
+
+	// Exactly Keep after a was added, it is not yet expired.
+	clock.advance(30 * time.Minute)
+	add("c")
+	if got := entries(ctx, t, db); !got["a"] || !got["b"] || !got["c"] {
+		t.Fatalf("got entries %v at the Keep boundary, want a, b, and c", got)
+	}
+
+	// A second later, it is.
+	clock.advance(time.Second)
+	add("d")
+	if got := entries(ctx, t, db); got["a"] || !got["b"] || !got["c"] || !got["d"] {
+		t.Fatalf("got entries %v a second past the boundary, want b, c, and d", got)
+	}
+
+	// Has refreshes an entry's last-access time.
+	if !has(ctx, t, db, "b") {
+		t.Fatal("b missing")
+	}
+	clock.advance(time.Hour)
+	add("e")
+	if got := entries(ctx, t, db); !got["b"] || got["c"] {
+		t.Errorf("got entries %v, want b (refreshed) but not c", got)
+	}
+}
+
+// entries returns the entries of db,
+// without updating their last-access times as Has would.
+func entries(ctx context.Context, t *testing.T, db *DB) map[string]bool {
+	t.Helper()
+	result := make(map[string]bool)
+	err := db.ForEach(ctx, func(h []byte, _ time.Time) error {
+		result[string(h)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "test.db")
+	)
+
+	// Rollback journaling keeps everything in the main file,
+	// where it can be corrupted.
+	db, err := Open(ctx, path, JournalMode("DELETE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([][]byte, 0, 2000)
+	for i := 0; i < 2000; i++ {
+		hashes = append(hashes, []byte(fmt.Sprintf("hash %d, long enough to need many pages", i)))
+	}
+	if err = db.AddMany(ctx, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(ctx, path, JournalMode("DELETE"), CheckIntegrity)
+	if err != nil {
+		t.Fatalf("intact database: %s", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite some pages in the middle of the file.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 8192), 8192); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(ctx, path, JournalMode("DELETE"), CheckIntegrity)
+	if err == nil {
+		db.Close()
+		t.Fatal("no error opening a corrupt database")
+	}
+	if !strings.Contains(err.Error(), "checking integrity") {
+		t.Errorf("got error %q, want one from the integrity check", err)
+	}
+}
+
+func TestTable(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "test.db")
+	)
+	open := func(opts ...Option) *DB {
+		t.Helper()
+		db, err := Open(ctx, path, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	var (
+		dflt = open()
+		a    = open(Table("tool_a"))
+		b    = open(Table("tool_b"))
+	)
+
+	if err := a.AddWithLabels(ctx, []byte("x"), "l"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddWithLabels(ctx, []byte("y"), "l"); err != nil {
+		t.Fatal(err)
+	}
+	if !has(ctx, t, a, "x") || has(ctx, t, a, "y") {
+		t.Error("table tool_a does not have exactly its own entry")
+	}
+	if !has(ctx, t, b, "y") || has(ctx, t, b, "x") {
+		t.Error("table tool_b does not have exactly its own entry")
+	}
+	if has(ctx, t, dflt, "x") || has(ctx, t, dflt, "y") {
+		t.Error("default table has another table's entry")
+	}
+
+	// Labels are separate too.
+	if err := a.DeleteByLabel(ctx, "l"); err != nil {
+		t.Fatal(err)
+	}
+	if has(ctx, t, a, "x") {
+		t.Error("DeleteByLabel did not delete x")
+	}
+	if !has(ctx, t, b, "y") {
+		t.Error("DeleteByLabel in tool_a deleted an entry in tool_b")
+	}
+
+	for _, name := range []string{"", "1abc", "a-b", "a b", "hashes; DROP TABLE hashes"} {
+		if db, err := Open(ctx, path, Table(name)); err == nil {
+			db.Close()
+			t.Errorf("no error for table name %q", name)
+		}
+	}
+}
+
+func TestOpenConfigDB(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		sub = filepath.Join(dir, "sub")
+	)
+	t.Setenv(mghash.ConfigEnv, "")
+	if err := os.WriteFile(filepath.Join(dir, mghash.ConfigFile), []byte(`{"db": "cache.db", /* comment */}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file is found in an ancestor of the current directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(sub); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	db, err := Open(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB path in the config file is relative to the file's directory.
+	db, err = Open(ctx, filepath.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !has(ctx, t, db, "x") {
+		t.Error("entry added via the configured DB not found in it")
+	}
+}
+
+func TestFileHashCache(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		dbPath = filepath.Join(dir, "test.db")
+		src    = filepath.Join(dir, "big")
+		mtime  = time.Unix(1600000000, 123)
+	)
+	write := func(b byte, size int, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(src, bytes.Repeat([]byte{b}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// contentHash opens the DB afresh, as a new process would.
+	contentHash := func() []byte {
+		t.Helper()
+		db, err := Open(ctx, dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		rule := mghash.JRule{Sources: []string{src}, Command: []string{"gen"}, FileHashCache: db}
+		h, err := rule.ContentHash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write('a', 1<<20, mtime)
+	h1 := contentHash()
+
+	// Different content with the same size and modification time
+	// shows whether the file is read again.
+	write('b', 1<<20, mtime)
+	if h := contentHash(); !bytes.Equal(h, h1) {
+		t.Error("file reread despite an unchanged size and modification time")
+	}
+
+	write('b', 1<<20, mtime.Add(time.Second))
+	h2 := contentHash()
+	if bytes.Equal(h2, h1) {
+		t.Error("cached hash used despite a changed modification time")
+	}
+
+	write('b', 1<<20+1, mtime.Add(time.Second))
+	if h := contentHash(); bytes.Equal(h, h2) {
+		t.Error("cached hash used despite a changed size")
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		clock  = &fakeClock{t: time.Unix(1000000, 0)}
+		counts []int
+		db     = openTestDB(ctx, t, Keep(time.Hour), Clock(clock.now), OnEvict(func(n int) {
+			counts = append(counts, n)
+		}))
+	)
+	add := func(h string) {
+		t.Helper()
+		if err := db.Add(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("a")
+	add("b")
+	add("c")
+	if len(counts) != 0 {
+		t.Fatalf("got OnEvict calls %v with nothing expired, want none", counts)
+	}
+
+	clock.advance(2 * time.Hour)
+	add("d")
+	if !reflect.DeepEqual(counts, []int{3}) {
+		t.Errorf("got OnEvict calls %v, want [3]", counts)
+	}
+
+	add("e")
+	if !reflect.DeepEqual(counts, []int{3}) {
+		t.Errorf("got OnEvict calls %v after an eviction pass removing nothing, want [3]", counts)
+	}
+}
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	sdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	db, err := New(ctx, sdb, Table("tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !has(ctx, t, db, "x") {
+		t.Error("entry not found after Add")
+	}
+
+	// The schema is in the caller's database.
+	var n int
+	if err = sdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM tool").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d rows in the caller's database, want 1", n)
+	}
+
+	// Closing the DB leaves the caller's connection open.
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sdb.PingContext(ctx); err != nil {
+		t.Errorf("caller's connection closed: %s", err)
+	}
+}
+
+func TestHex(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "test.db")
+	)
+	open := func(opts ...Option) (*DB, error) {
+		t.Helper()
+		db, err := Open(ctx, path, opts...)
+		if err == nil {
+			t.Cleanup(func() { db.Close() })
+		}
+		return db, err
+	}
+	typeCounts := func(db *DB) map[string]int {
+		t.Helper()
+		rows, err := db.db.QueryContext(ctx, `SELECT typeof(hash), COUNT(*) FROM hashes GROUP BY 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		result := make(map[string]int)
+		for rows.Next() {
+			var (
+				typ string
+				n   int
+			)
+			if err = rows.Scan(&typ, &n); err != nil {
+				t.Fatal(err)
+			}
+			result[typ] = n
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	db, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AddWithLabels(ctx, []byte("x"), "l"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening with Hex converts the existing entries.
+	db, err = open(Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := typeCounts(db), map[string]int{"text": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got hash types %v after conversion, want %v", got, want)
+	}
+	if !has(ctx, t, db, "x") {
+		t.Error("converted entry not found")
+	}
+	if err = db.Add(ctx, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteByLabel(ctx, "l"); err != nil {
+		t.Fatal(err)
+	}
+	if has(ctx, t, db, "x") || !has(ctx, t, db, "y") {
+		t.Error("converted label not found")
+	}
+
+	// Conversion happens only once.
+	if _, err = db.db.ExecContext(ctx, `INSERT INTO hashes (hash, unix_secs) VALUES (X'00', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = open(Hex); err != nil {
+		t.Fatal(err)
+	}
+	if got := typeCounts(db)["blob"]; got != 1 {
+		t.Errorf("got %d blobs, want 1 (not converted again)", got)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening a hex database without Hex is an error,
+	// not a silent miss.
+	if _, err = open(); err == nil || !strings.Contains(err.Error(), "Hex option") {
+		t.Errorf("got error %v opening a hex database without Hex, want one about the Hex option", err)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		hashes  []string // SQL literals
+		wantHex bool     // whether opening requires Hex
+	}{
+		{hashes: nil},
+		{hashes: []string{"X'01'"}},
+		{hashes: []string{"'01'"}, wantHex: true},
+		{hashes: []string{"X'01'", "'02'"}, wantHex: true},
+	}
+	for i, c := range cases {
+		for _, withHex := range []bool{false, true} {
+			// A database from before the format was recorded.
+			path := filepath.Join(t.TempDir(), "test.db")
+			sdb, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = sdb.ExecContext(ctx, `CREATE TABLE hashes (hash BLOB NOT NULL PRIMARY KEY, unix_secs INT NOT NULL)`); err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range c.hashes {
+				if _, err = sdb.ExecContext(ctx, `INSERT INTO hashes (hash, unix_secs) VALUES (`+h+`, 0)`); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = sdb.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var opts []Option
+			if withHex {
+				opts = append(opts, Hex)
+			}
+			db, err := Open(ctx, path, opts...)
+			if err == nil {
+				db.Close()
+			}
+			if wantOK := withHex || !c.wantHex; wantOK != (err == nil) {
+				t.Errorf("case %d, Hex %v: got error %v, want success %v", i, withHex, err, wantOK)
+			}
+		}
+	}
+}
+
+func TestOnEvictHashes(t *testing.T) {
+	ctx := context.Background()
+	for _, opts := range [][]Option{nil, {Hex}} {
+		var (
+			clock   = &fakeClock{t: time.Unix(1000000, 0)}
+			evicted [][][]byte
+			db      = openTestDB(ctx, t, append(opts, Keep(time.Hour), Clock(clock.now), OnEvictHashes(func(hashes [][]byte) {
+				evicted = append(evicted, hashes)
+			}))...)
+		)
+		add := func(h []byte) {
+			t.Helper()
+			if err := db.Add(ctx, h); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		add([]byte{0, 1})
+		add([]byte{0xff})
+		clock.advance(30 * time.Minute)
+		add([]byte("kept"))
+		if len(evicted) != 0 {
+			t.Fatalf("got evictions %x with nothing expired, want none", evicted)
+		}
+
+		clock.advance(45 * time.Minute)
+		add([]byte("new"))
+		if len(evicted) != 1 {
+			t.Fatalf("got %d evictions, want 1", len(evicted))
+		}
+		got := evicted[0]
+		sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i], got[j]) < 0 })
+		if want := [][]byte{{0, 1}, {0xff}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got evicted hashes %x, want %x", got, want)
+		}
+	}
+}
+
+func TestKeepShort(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(ctx, t, Keep(time.Millisecond), Clock(clock.now))
+	)
+	if err := db.AddWithLabels(ctx, []byte("a"), "x"); err != nil {
+		t.Fatal(err)
+	}
+	// Last-access times are in whole seconds.
+	clock.advance(time.Second + time.Millisecond)
+	if err := db.Add(ctx, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(ctx, t, db); got["a"] || !got["b"] {
+		t.Fatalf("got entries %v, want only b", got)
+	}
+
+	var n int
+	if err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM labels`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("got %d labels after evicting the only labeled entry, want 0", n)
+	}
+
+	// Re-adding a without labels does not bring back its label x.
+	if err := db.Add(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteByLabel(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if !has(ctx, t, db, "a") {
+		t.Error("label of an evicted entry deleted its replacement")
+	}
+}
+
+func BenchmarkAddMany(b *testing.B) {
+	ctx := context.Background()
+	hashes := make([][]byte, 1000)
+	for i := range hashes {
+		hashes[i] = []byte(fmt.Sprintf("hash%d", i))
+	}
+
+	b.Run("Add", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(ctx, b)
+			b.StartTimer()
+			for _, h := range hashes {
+				if err := db.Add(ctx, h); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("AddMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(ctx, b)
+			b.StartTimer()
+			if err := db.AddMany(ctx, hashes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEvict(b *testing.B) {
+	var (
+		ctx    = context.Background()
+		db     = openTestDB(ctx, b)
+		hashes = make([][]byte, 100000)
+	)
+	for i := range hashes {
+		hashes[i] = []byte(fmt.Sprintf("hash%d", i))
+	}
+	if err := db.AddMany(ctx, hashes); err != nil {
+		b.Fatal(err)
+	}
+
+	// Each eviction finds nothing to delete,
+	// so only the search for expired entries is measured.
+	evict := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.evictCount(ctx, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("indexed", evict)
+
+	if _, err := db.db.ExecContext(ctx, db.sql(`DROP INDEX {hashes}_unix_secs`)); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("unindexed", evict)
+}
+
+func TestCheckAndReserve(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		clock = &fakeClock{t: time.Unix(1000000, 0)}
+		db    = openTestDB(ctx, t, Keep(time.Second), ReservationTimeout(time.Hour), Clock(clock.now))
+	)
+	reserve := func(h string, want bool) {
+		t.Helper()
+		ok, err := db.CheckAndReserve(ctx, []byte(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("got reserved %v for %s, want %v", ok, h, want)
+		}
+	}
+	release := func(h string) {
+		t.Helper()
+		if err := db.Release(ctx, []byte(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := func() int {
+		t.Helper()
+		var n int
+		if err := db.db.QueryRowContext(ctx, db.sql(`SELECT COUNT(*) FROM {hashes}`)).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	reserve("a", true)
+	reserve("a", false)
+
+	// A reservation is not an entry.
+	if has(ctx, t, db, "a") {
+		t.Error("reserved hash found")
+	}
+	if got := entries(ctx, t, db); len(got) != 0 {
+		t.Errorf("got entries %v, want none", got)
+	}
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 0 {
+		t.Errorf("got %d entries in stats, want 0", stats.Entries)
+	}
+
+	// Releasing frees it.
+	release("a")
+	reserve("a", true)
+
+	// Adding completes it,
+	// after which it cannot be reserved or released.
+	if err = db.Add(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	reserve("a", false)
+	release("a")
+	if !has(ctx, t, db, "a") {
+		t.Error("added hash not found")
+	}
+
+	// Eviction leaves reservations alone,
+	// even ones older than Keep.
+	reserve("b", true)
+	clock.advance(2 * time.Second)
+	if err = db.Add(ctx, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(ctx, t, db); got["a"] || !got["c"] {
+		t.Errorf("got entries %v, want only c", got)
+	}
+	reserve("b", false)
+
+	// A reservation lasts until the timeout.
+	clock.advance(time.Hour - 2*time.Second)
+	reserve("b", false)
+
+	// After that it is stale,
+	// so it can be taken over,
+	// and other stale reservations are cleared.
+	reserve("d", true)
+	clock.advance(time.Hour + time.Second)
+	if n := rows(); n != 3 {
+		t.Fatalf("got %d rows, want 3 (b, c, and d)", n)
+	}
+	reserve("b", true)
+	if n := rows(); n != 2 {
+		t.Errorf("got %d rows after clearing stale reservations, want 2 (b and c)", n)
+	}
+}
+
+func TestCheckAndReserveConcurrent(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "test.db")
+		wg   sync.WaitGroup
+		won  int64
+	)
+	for i := 0; i < 8; i++ {
+		db, err := Open(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.CheckAndReserve(ctx, []byte("h"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				atomic.AddInt64(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("got %d reservations, want 1", won)
+	}
+}
+
+func TestAddStatus(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "test.db")
+	)
+
+	// A database from before the status column existed.
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const q = `CREATE TABLE hashes (hash BLOB NOT NULL PRIMARY KEY, unix_secs INT NOT NULL); INSERT INTO hashes (hash, unix_secs) VALUES (x'6f6c64', 1)`
+	if _, err = sdb.ExecContext(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	if err = sdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !has(ctx, t, db, "old") {
+		t.Error("existing entry not found after adding the status column")
+	}
+	if ok, err := db.CheckAndReserve(ctx, []byte("old")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("reserved an existing entry")
+	}
+	if ok, err := db.CheckAndReserve(ctx, []byte("new")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("could not reserve a new hash")
+	}
+}
@@ -0,0 +1,100 @@
+package mghash
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// submoduleCommits reports the commits checked out in the git submodules at or beneath path,
+// keyed by the path of each submodule.
+// A submodule that has not been checked out is reported with the commit its superproject records.
+// The result is empty if there are no submodules there
+// (including when the repository has none at all).
+// Git runs in the directory containing path,
+// which must be in a git working tree.
+func submoduleCommits(ctx context.Context, path string) (map[string]string, error) {
+	path = filepath.Clean(path)
+	parent := filepath.Dir(path)
+
+	cmd := exec.CommandContext(ctx, "git", "-C", parent, "ls-files", "--stage", "--", filepath.Base(path))
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "running git ls-files in %s", parent)
+	}
+
+	// Each line of output looks like:
+	//   <mode> <object> <stage>\t<path>
+	// Submodules have mode 160000.
+	// Paths are relative to parent.
+	result := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "160000" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			continue
+		}
+		sub := filepath.Join(parent, filepath.FromSlash(line[tab+1:]))
+		commit, err := checkedOutCommit(ctx, sub)
+		if err != nil {
+			return nil, err
+		}
+		if commit == "" {
+			commit = fields[1]
+		}
+		result[sub] = commit
+	}
+	return result, errors.Wrap(sc.Err(), "scanning git ls-files output")
+}
+
+// checkedOutCommit reports the commit checked out in the submodule at path,
+// or the empty string if it is not checked out.
+func checkedOutCommit(ctx context.Context, path string) (string, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+
+	// In a submodule that is not checked out,
+	// git would find the superproject instead.
+	cmd := exec.CommandContext(ctx, "git", "-C", path, "rev-parse", "--show-toplevel", "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "running git rev-parse in %s", path)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return "", fmt.Errorf("unexpected git rev-parse output in %s: %q", path, out)
+	}
+	same, err := samePath(lines[0], path)
+	if err != nil || !same {
+		return "", err
+	}
+	return lines[1], nil
+}
+
+// samePath tells whether a and b name the same directory.
+func samePath(a, b string) (bool, error) {
+	for _, p := range []*string{&a, &b} {
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return false, errors.Wrapf(err, "getting absolute path of %s", *p)
+		}
+		if *p, err = filepath.EvalSymlinks(abs); err != nil {
+			return false, errors.Wrapf(err, "resolving %s", abs)
+		}
+	}
+	return a == b, nil
+}
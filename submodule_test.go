@@ -0,0 +1,93 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		lib   = filepath.Join(dir, "lib")
+		super = filepath.Join(dir, "super")
+	)
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	writeFile(t, filepath.Join(lib, "x"), "1")
+	git(lib, "init", "-q")
+	git(lib, "add", "x")
+	git(lib, "commit", "-q", "-m", "one")
+	first := git(lib, "rev-parse", "HEAD")
+	writeFile(t, filepath.Join(lib, "y"), "2")
+	git(lib, "add", "y")
+	git(lib, "commit", "-q", "-m", "two")
+
+	writeFile(t, filepath.Join(super, "README"), "super")
+	git(super, "init", "-q")
+	git(super, "submodule", "add", "-q", lib, "deps/a")
+	git(super, "submodule", "add", "-q", lib, "deps/b")
+	git(super, "add", ".")
+	git(super, "commit", "-q", "-m", "super")
+
+	var (
+		a     = filepath.Join(super, "deps", "a")
+		deps  = filepath.Join(super, "deps")
+		ruleA = JRule{Submodules: []string{a}, Command: []string{"true"}}
+		ruleD = JRule{Submodules: []string{deps}, Command: []string{"true"}}
+		none  = JRule{Submodules: []string{filepath.Join(super, "README")}, Command: []string{"true"}}
+	)
+
+	beforeA := contentHash(ctx, t, ruleA)
+	beforeD := contentHash(ctx, t, ruleD)
+	beforeNone := contentHash(ctx, t, none)
+
+	// Check out a different commit in b without recording it in the superproject.
+	git(filepath.Join(deps, "b"), "checkout", "-q", first)
+
+	if h := contentHash(ctx, t, ruleA); !bytes.Equal(h, beforeA) {
+		t.Error("content hash changed for an unchanged submodule")
+	}
+	if h := contentHash(ctx, t, ruleD); bytes.Equal(h, beforeD) {
+		t.Error("content hash unchanged after checking out a new commit in a submodule beneath a directory")
+	}
+	if h := contentHash(ctx, t, none); !bytes.Equal(h, beforeNone) {
+		t.Error("content hash changed for a path with no submodules")
+	}
+
+	// Likewise for a.
+	git(a, "checkout", "-q", first)
+	if h := contentHash(ctx, t, ruleA); bytes.Equal(h, beforeA) {
+		t.Error("content hash unchanged after checking out a new commit in a submodule")
+	}
+
+	commits, err := submoduleCommits(ctx, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{a: first, filepath.Join(deps, "b"): first}
+	if len(commits) != len(want) {
+		t.Fatalf("got %v, want %v", commits, want)
+	}
+	for path, commit := range want {
+		if commits[path] != commit {
+			t.Errorf("got commit %q for %s, want %q", commits[path], path, commit)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package mghash
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// createTemp creates a temporary file to be renamed to path when complete.
+// It is in dir if that is not empty,
+// and otherwise in the directory of path,
+// so that the rename does not cross filesystems.
+// Its permissions are those os.Create would give path
+// with the usual umask of 022.
+func createTemp(dir, path string) (*os.File, error) {
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating temp file for %s", path)
+	}
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrapf(err, "setting permissions of temp file for %s", path)
+	}
+	return f, nil
+}
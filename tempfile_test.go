@@ -0,0 +1,143 @@
+package mghash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTempDir(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		dir     = t.TempDir()
+		out     = filepath.Join(dir, "out", "stdout")
+		tempDir = filepath.Join(dir, "tmp")
+		list    = filepath.Join(dir, "list")
+	)
+	for _, d := range []string{filepath.Dir(out), tempDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unusable OS temp dir stands in for one on another filesystem,
+	// where a temp file could not be renamed into place.
+	t.Setenv("TMPDIR", filepath.Join(dir, "nonexistent"))
+
+	// listDir reports the entries of dir other than the output file.
+	listDir := func(dir string) []string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, e := range entries {
+			if e.Name() != filepath.Base(out) {
+				result = append(result, e.Name())
+			}
+		}
+		return result
+	}
+
+	cases := []struct {
+		desc    string
+		tempDir string
+		inDir   string // where the temp file should be while the command runs
+	}{
+		{desc: "default", inDir: filepath.Dir(out)},
+		{desc: "TempDir", tempDir: tempDir, inDir: tempDir},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			rule := JRule{
+				Targets:    []string{list},
+				Command:    []string{"sh", "-c", "ls -a " + c.inDir + " > " + list + "; echo output"},
+				StdoutFile: out,
+				TempDir:    c.tempDir,
+			}
+			if err := rule.Run(ctx); err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, out, "output\n")
+			listing, err := os.ReadFile(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(listing), ".stdout.tmp") {
+				t.Errorf("no temp file in %s while the command ran; got:\n%s", c.inDir, listing)
+			}
+
+			// No temp files are left behind.
+			for _, d := range []string{filepath.Dir(out), tempDir} {
+				if got := listDir(d); len(got) > 0 {
+					t.Errorf("got %v left in %s, want nothing", got, d)
+				}
+			}
+		})
+	}
+
+	// TempDir is not part of the rule's hashes.
+	var (
+		a = JRule{Command: []string{"gen"}, StdoutFile: out}
+		b = JRule{Command: []string{"gen"}, StdoutFile: out, TempDir: tempDir}
+	)
+	if string(a.RuleHash()) != string(b.RuleHash()) {
+		t.Error("rule hash depends on TempDir")
+	}
+
+	bad := JRule{Command: []string{"true"}, StdoutFile: out, TempDir: filepath.Join(dir, "nonexistent")}
+	if err := bad.Run(ctx); err == nil {
+		t.Error("no error with a nonexistent TempDir")
+	}
+}
+
+func TestFnTempDir(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		dir    = t.TempDir()
+		src    = filepath.Join(dir, "src")
+		target = filepath.Join(dir, "target")
+		runs   = filepath.Join(dir, "runs")
+		rule   = JRule{Sources: []string{src}, Targets: []string{target}, Command: []string{"sh", "-c", "cp " + src + " " + target + " && echo ran >> " + runs}}
+	)
+	writeFile(t, src, "x")
+	store, err := NewDirStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Fn{DB: NewMemDB(), Rule: rule, Artifacts: store}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// With an unusable OS temp dir,
+	// restoring a target still works.
+	t.Setenv("TMPDIR", filepath.Join(dir, "nonexistent"))
+	restore := func(tempDir string) error {
+		t.Helper()
+		if err := os.Remove(target); err != nil {
+			t.Fatal(err)
+		}
+		return (&Fn{DB: NewMemDB(), Rule: rule, Artifacts: store, TempDir: tempDir}).Run(ctx)
+	}
+	if err = restore(""); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, target, "x")
+	checkFile(t, runs, "ran\n")
+
+	// A TempDir is used if given.
+	if err = restore(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("no error restoring with a nonexistent TempDir")
+	}
+	if err = os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = restore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, target, "x")
+	checkFile(t, runs, "ran\n")
+}
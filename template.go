@@ -0,0 +1,105 @@
+package mghash
+
+import (
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// fileList is a list of files that formats as its elements separated by spaces,
+// for use in command templates.
+type fileList []string
+
+func (l fileList) String() string {
+	return strings.Join(l, " ")
+}
+
+// expandCommand expands the templates in jr.Command,
+// if jr.Template is set.
+// See JRule.
+func (jr JRule) expandCommand() ([]string, error) {
+	if !jr.Template {
+		return jr.Command, nil
+	}
+
+	sources, err := jr.sources()
+	if err != nil {
+		return nil, err
+	}
+	for i, src := range sources {
+		sources[i] = jr.dirRelative(jr.localSource(src))
+	}
+	// Not jr.targets(), which includes jr.StdoutFile and jr.StderrFile.
+	targets, err := expandGlobs(jr.Targets, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, target := range targets {
+		targets[i] = jr.dirRelative(target)
+	}
+
+	data := struct {
+		Sources, Targets fileList
+		Source, Target   string
+	}{
+		Sources: sources,
+		Targets: targets,
+	}
+	if len(sources) > 0 {
+		data.Source = sources[0]
+	}
+	if len(targets) > 0 {
+		data.Target = targets[0]
+	}
+
+	result := make([]string, 0, len(jr.Command))
+	for _, arg := range jr.Command {
+		switch strings.TrimSpace(arg) {
+		case "{{.Sources}}":
+			result = append(result, sources...)
+			continue
+		case "{{.Targets}}":
+			result = append(result, targets...)
+			continue
+		}
+		if !strings.Contains(arg, "{{") {
+			result = append(result, arg)
+			continue
+		}
+		tmpl, err := template.New("").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing command template %q", arg)
+		}
+		buf := new(strings.Builder)
+		if err = tmpl.Execute(buf, data); err != nil {
+			return nil, errors.Wrapf(err, "expanding command template %q", arg)
+		}
+		result = append(result, buf.String())
+	}
+	return result, nil
+}
+
+// dirRelative converts path,
+// which is relative to the current directory,
+// to one relative to jr.Dir,
+// where jr's command runs.
+// Absolute paths and URLs are unchanged.
+func (jr JRule) dirRelative(path string) string {
+	if jr.Dir == "" || filepath.IsAbs(path) || isURL(path) {
+		return path
+	}
+	dir, err := filepath.Abs(jr.Dir)
+	if err != nil {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return rel
+	}
+	return abs
+}
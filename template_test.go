@@ -0,0 +1,104 @@
+package mghash
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandCommand(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.c", "b.c", "c.h"} {
+		writeFile(t, filepath.Join(dir, name), name)
+	}
+	var (
+		ac      = filepath.Join(dir, "a.c")
+		bc      = filepath.Join(dir, "b.c")
+		sources = []string{ac, bc}
+		targets = []string{"x", "y"}
+	)
+
+	cases := []struct {
+		sources, targets []string
+		dir              string
+		command          []string
+		noTemplate       bool
+		want             []string
+		wantErr          bool
+	}{{
+		command: []string{"cc", "-o", "x", "a.c"},
+		want:    []string{"cc", "-o", "x", "a.c"},
+	}, {
+		sources:    sources,
+		command:    []string{"echo", "{{.Sources}}"},
+		noTemplate: true,
+		want:       []string{"echo", "{{.Sources}}"},
+	}, {
+		sources: sources,
+		targets: targets,
+		command: []string{"cc", "-o", "{{.Target}}", "{{.Sources}}"},
+		want:    []string{"cc", "-o", "x", ac, bc},
+	}, {
+		sources: sources,
+		targets: targets,
+		command: []string{"ls", " {{.Targets}} ", "-DS={{.Sources}}", "{{.Source}}"},
+		want:    []string{"ls", "x", "y", "-DS=" + ac + " " + bc, ac},
+	}, {
+		sources: []string{filepath.Join(dir, "*.c")},
+		command: []string{"cat", "{{.Sources}}"},
+		want:    []string{"cat", ac, bc},
+	}, {
+		command: []string{"echo", "[{{.Source}}]", "{{.Sources}}"},
+		want:    []string{"echo", "[]"},
+	}, {
+		// Relative paths are relative to Dir.
+		sources: []string{"src/a.c", "shared/b.c", ac},
+		targets: []string{"out/x"},
+		dir:     "src",
+		command: []string{"cc", "-o", "{{.Target}}", "{{.Sources}}"},
+		want:    []string{"cc", "-o", filepath.Join("..", "out", "x"), "a.c", filepath.Join("..", "shared", "b.c"), ac},
+	}, {
+		sources: []string{"a.c"},
+		targets: []string{"x"},
+		dir:     dir,
+		command: []string{"cc", "-o", "{{.Target}}", "{{.Source}}"},
+		want:    []string{"cc", "-o", relTo(t, dir, "x"), relTo(t, dir, "a.c")},
+	}, {
+		command: []string{"{{.Nope}}"},
+		wantErr: true,
+	}, {
+		command: []string{"{{.Source"},
+		wantErr: true,
+	}}
+	for i, c := range cases {
+		rule := JRule{Sources: c.sources, Targets: c.targets, Dir: c.dir, Command: c.command, Template: !c.noTemplate}
+		got, err := rule.argv()
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("case %d: no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("case %d: got %q, want %q", i, got, c.want)
+		}
+	}
+}
+
+// relTo converts path from relative to the current directory
+// to relative to dir.
+func relTo(t *testing.T, dir, path string) string {
+	t.Helper()
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
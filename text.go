@@ -0,0 +1,85 @@
+package mghash
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// textNormalizer is an io.Writer that converts CRLF line endings to LF
+// before passing data along to w.
+// If ignoreFinalNewline is true,
+// a single newline at the very end of the data is dropped.
+// Callers must call Close to flush any pending bytes.
+type textNormalizer struct {
+	w                  io.Writer
+	ignoreFinalNewline bool
+
+	pendingCR, pendingNL bool
+}
+
+func (t *textNormalizer) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+2)
+	for _, b := range p {
+		if t.pendingCR {
+			t.pendingCR = false
+			if b != '\n' {
+				out = t.emit(out, '\r')
+			}
+		}
+		if b == '\r' {
+			t.pendingCR = true
+			continue
+		}
+		out = t.emit(out, b)
+	}
+	if _, err := t.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *textNormalizer) emit(out []byte, b byte) []byte {
+	if t.ignoreFinalNewline {
+		if t.pendingNL {
+			out = append(out, '\n')
+			t.pendingNL = false
+		}
+		if b == '\n' {
+			t.pendingNL = true
+			return out
+		}
+	}
+	return append(out, b)
+}
+
+// Close flushes a pending CR, if any.
+// A pending final newline is discarded.
+func (t *textNormalizer) Close() error {
+	if !t.pendingCR {
+		return nil
+	}
+	t.pendingCR = false
+	_, err := t.w.Write(t.emit(nil, '\r'))
+	return err
+}
+
+// textSniffLen is how much of a file looksLikeText examines.
+const textSniffLen = 8000
+
+// looksLikeText reports whether f appears to contain text,
+// meaning there is no NUL byte in its first textSniffLen bytes.
+// It leaves f positioned at its beginning.
+func looksLikeText(f *os.File) (bool, error) {
+	buf := make([]byte, textSniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, errors.Wrap(err, "reading")
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "seeking")
+	}
+	return bytes.IndexByte(buf[:n], 0) < 0, nil
+}
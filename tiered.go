@@ -0,0 +1,188 @@
+package mghash
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// TieredDB is a DB made of other DBs, tried in order,
+// such as a fast local one in front of a slower shared one.
+//
+// A TieredDB is a Labeler, a Reserver, and a Statser,
+// forwarding to its tiers that implement those interfaces
+// (see the methods for details).
+type TieredDB struct {
+	tiers []DB
+
+	// Which tiers Add writes to.
+	// If nil, all of them.
+	writable []bool
+}
+
+var (
+	_ BatchAdder = &TieredDB{}
+	_ Labeler    = &TieredDB{}
+	_ Reserver   = &TieredDB{}
+	_ Statser    = &TieredDB{}
+)
+
+// TieredOpt is the type of an option that can be passed to NewTieredDB.
+type TieredOpt func(*TieredDB)
+
+// WriteTiers is a TieredOpt that limits the tiers that a TieredDB adds entries to,
+// identified by their positions in the list passed to NewTieredDB.
+// By default a TieredDB adds entries to all its tiers.
+func WriteTiers(indexes ...int) TieredOpt {
+	return func(db *TieredDB) {
+		db.writable = make([]bool, len(db.tiers))
+		for _, i := range indexes {
+			if i >= 0 && i < len(db.tiers) {
+				db.writable[i] = true
+			}
+		}
+	}
+}
+
+// NewTieredDB produces a TieredDB consulting tiers in the given order.
+func NewTieredDB(tiers []DB, opts ...TieredOpt) *TieredDB {
+	db := &TieredDB{tiers: tiers}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// Has implements DB.Has.
+// It consults each tier in turn until one has the entry,
+// then adds the entry to the writable tiers before that one,
+// so that the next lookup is faster.
+func (db *TieredDB) Has(ctx context.Context, h []byte) (bool, error) {
+	for i, tier := range db.tiers {
+		has, err := tier.Has(ctx, h)
+		if err != nil {
+			return false, errors.Wrapf(err, "checking tier %d", i)
+		}
+		if !has {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if !db.isWritable(j) {
+				continue
+			}
+			if err = db.tiers[j].Add(ctx, h); err != nil {
+				return false, errors.Wrapf(err, "back-filling tier %d", j)
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Add implements DB.Add.
+// It adds the entry to each writable tier.
+func (db *TieredDB) Add(ctx context.Context, h []byte) error {
+	for i, tier := range db.tiers {
+		if !db.isWritable(i) {
+			continue
+		}
+		if err := tier.Add(ctx, h); err != nil {
+			return errors.Wrapf(err, "adding to tier %d", i)
+		}
+	}
+	return nil
+}
+
+// AddMany implements BatchAdder.
+// It adds the entries to each writable tier.
+func (db *TieredDB) AddMany(ctx context.Context, hashes [][]byte) error {
+	for i, tier := range db.tiers {
+		if !db.isWritable(i) {
+			continue
+		}
+		if err := AddMany(ctx, tier, hashes); err != nil {
+			return errors.Wrapf(err, "adding to tier %d", i)
+		}
+	}
+	return nil
+}
+
+// AddWithLabels implements Labeler.
+// It adds the entry to each writable tier,
+// with labels for the tiers that are Labelers.
+func (db *TieredDB) AddWithLabels(ctx context.Context, h []byte, labels ...string) error {
+	for i, tier := range db.tiers {
+		if !db.isWritable(i) {
+			continue
+		}
+		var err error
+		if l, ok := tier.(Labeler); ok {
+			err = l.AddWithLabels(ctx, h, labels...)
+		} else {
+			err = tier.Add(ctx, h)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "adding to tier %d", i)
+		}
+	}
+	return nil
+}
+
+// CheckAndReserve implements Reserver.
+// It reserves h in the last tier that is a Reserver,
+// normally the slow shared one,
+// after checking that no tier has h.
+// If no tier is a Reserver,
+// it only checks that no tier has h.
+func (db *TieredDB) CheckAndReserve(ctx context.Context, h []byte) (bool, error) {
+	has, err := db.Has(ctx, h)
+	if err != nil || has {
+		return false, err
+	}
+	i, r := db.reserver()
+	if r == nil {
+		return true, nil
+	}
+	ok, err := r.CheckAndReserve(ctx, h)
+	return ok, errors.Wrapf(err, "reserving in tier %d", i)
+}
+
+// Release implements Reserver.
+// It releases a reservation made with CheckAndReserve.
+func (db *TieredDB) Release(ctx context.Context, h []byte) error {
+	i, r := db.reserver()
+	if r == nil {
+		return nil
+	}
+	return errors.Wrapf(r.Release(ctx, h), "releasing in tier %d", i)
+}
+
+// reserver returns the last tier that is a Reserver, and its position,
+// or nil if there is none.
+func (db *TieredDB) reserver() (int, Reserver) {
+	for i := len(db.tiers) - 1; i >= 0; i-- {
+		if r, ok := db.tiers[i].(Reserver); ok {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+// Stats implements Statser.
+// It reports the stats of the last tier that is a Statser,
+// normally the slow shared one,
+// which holds the most entries.
+// It is an error if no tier is a Statser.
+func (db *TieredDB) Stats(ctx context.Context) (Stats, error) {
+	for i := len(db.tiers) - 1; i >= 0; i-- {
+		if s, ok := db.tiers[i].(Statser); ok {
+			stats, err := s.Stats(ctx)
+			return stats, errors.Wrapf(err, "getting stats of tier %d", i)
+		}
+	}
+	return Stats{}, errors.New("no tier reports stats")
+}
+
+func (db *TieredDB) isWritable(i int) bool {
+	return db.writable == nil || db.writable[i]
+}
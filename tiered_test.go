@@ -0,0 +1,130 @@
+package mghash
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTieredOptional(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		fast   = NewMemDB()
+		slow   = newFullDB()
+		tiered = NewTieredDB([]DB{fast, slow})
+		rule   = newTestRule("rule", "v1")
+	)
+
+	// Fn's labels reach the tier that is a Labeler,
+	// and the entry reaches both tiers.
+	if err := (&Fn{DB: tiered, Rule: rule, Labels: []string{"label"}}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h, err := rule.ContentHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := slow.labels[string(h)]; !reflect.DeepEqual(got, []string{"label"}) {
+		t.Errorf("got labels %q in the slow tier, want [label]", got)
+	}
+	if ok, err := fast.Has(ctx, h); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("entry not added to the fast tier")
+	}
+
+	// Reservations are made in the slow tier.
+	ok, err := tiered.CheckAndReserve(ctx, []byte("h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !slow.reserved["h"] {
+		t.Errorf("got reserved %v, slow tier reservations %v; want h reserved in the slow tier", ok, slow.reserved)
+	}
+	if ok, err = tiered.CheckAndReserve(ctx, []byte("h")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("reserved h twice")
+	}
+	if err = tiered.Release(ctx, []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	if slow.reserved["h"] {
+		t.Error("reservation not released")
+	}
+
+	// An entry in any tier cannot be reserved.
+	if err = fast.Add(ctx, []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = tiered.CheckAndReserve(ctx, []byte("f")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("reserved an entry present in the fast tier")
+	}
+
+	// With no Statser tier, Stats is an error.
+	if _, err = tiered.Stats(ctx); err == nil {
+		t.Error("no error for stats without a Statser tier")
+	}
+	withStats := NewTieredDB([]DB{fast, Namespaced(slow, []byte("ns"))})
+	if err = withStats.Add(ctx, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := withStats.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 {
+		t.Errorf("got %d entries, want 1", stats.Entries)
+	}
+}
+
+func TestWriteTiers(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		a, b, c = NewMemDB(), NewMemDB(), newFullDB()
+		tiered  = NewTieredDB([]DB{a, b, c}, WriteTiers(0, 2, 3, -1))
+	)
+	check := func(h string, want ...bool) {
+		t.Helper()
+		for i, tier := range []DB{a, b, c} {
+			ok, err := tier.Has(ctx, []byte(h))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want[i] {
+				t.Errorf("got Has %v for %s in tier %d, want %v", ok, h, i, want[i])
+			}
+		}
+	}
+
+	// Each way of adding writes only to tiers 0 and 2.
+	if err := tiered.Add(ctx, []byte("add")); err != nil {
+		t.Fatal(err)
+	}
+	check("add", true, false, true)
+	if err := tiered.AddMany(ctx, [][]byte{[]byte("many1"), []byte("many2")}); err != nil {
+		t.Fatal(err)
+	}
+	check("many1", true, false, true)
+	check("many2", true, false, true)
+	if err := tiered.AddWithLabels(ctx, []byte("labeled"), "label"); err != nil {
+		t.Fatal(err)
+	}
+	check("labeled", true, false, true)
+	if got := c.labels["labeled"]; !reflect.DeepEqual(got, []string{"label"}) {
+		t.Errorf("got labels %q in tier 2, want [label]", got)
+	}
+
+	// So does back-filling after a hit in a later tier.
+	if err := c.Add(ctx, []byte("slow")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tiered.Has(ctx, []byte("slow")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("entry in tier 2 not found")
+	}
+	check("slow", true, false, true)
+}
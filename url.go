@@ -0,0 +1,201 @@
+package mghash
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isURL tells whether a source is an HTTP or HTTPS URL
+// rather than a file.
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// urlFetcher fetches and hashes URL sources.
+// See JRule.HTTPClient and JRule.DownloadDir.
+type urlFetcher struct {
+	client *http.Client
+
+	// If set, downloads are kept here
+	// and refreshed with conditional requests.
+	dir string
+
+	// The hash algorithm, or nil for SHA256.
+	algo *HashAlgo
+}
+
+// hash fetches url and hashes its content.
+// A 404 or 410 response produces an error wrapping fs.ErrNotExist,
+// so that the resource is treated like a missing file.
+func (u urlFetcher) hash(ctx context.Context, url string) ([]byte, error) {
+	if u.dir == "" {
+		resp, err := u.get(ctx, url, "")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		hasher := u.algo.newHash()
+		if _, err = io.Copy(hasher, resp.Body); err != nil {
+			return nil, errors.Wrapf(err, "reading %s", url)
+		}
+		return hasher.Sum(nil), nil
+	}
+
+	path, err := u.download(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening download of %s", url)
+	}
+	defer f.Close()
+
+	hasher := u.algo.newHash()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return nil, errors.Wrapf(err, "hashing download of %s", url)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// download brings the copy of url in u.dir up to date,
+// returning its path.
+// If there is an earlier copy with an ETag,
+// a conditional request is made,
+// so an unchanged resource is not transferred again.
+func (u urlFetcher) download(ctx context.Context, url string) (string, error) {
+	var (
+		path     = downloadPath(u.dir, url)
+		etagPath = path + ".etag"
+		etag     string
+	)
+	if _, err := os.Stat(path); err == nil {
+		if b, err := os.ReadFile(etagPath); err == nil {
+			etag = string(b)
+		}
+	}
+	resp, err := u.get(ctx, url, etag)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return path, nil
+	}
+
+	if err = os.MkdirAll(u.dir, 0755); err != nil {
+		return "", errors.Wrapf(err, "creating %s", u.dir)
+	}
+	tmp, err := os.CreateTemp(u.dir, "tmp")
+	if err != nil {
+		return "", errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return "", errors.Wrapf(err, "downloading %s", url)
+	}
+	if err = tmp.Close(); err != nil {
+		return "", errors.Wrapf(err, "closing download of %s", url)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", errors.Wrapf(err, "renaming download of %s", url)
+	}
+	if etag = resp.Header.Get("ETag"); etag != "" {
+		err = os.WriteFile(etagPath, []byte(etag), 0644)
+	} else {
+		err = os.Remove(etagPath)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", errors.Wrapf(err, "recording ETag of %s", url)
+	}
+	return path, nil
+}
+
+// get requests url,
+// conditionally on etag if it is not empty.
+// The response status is 200 or (with etag) 304.
+func (u urlFetcher) get(ctx context.Context, url, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating request for %s", url)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	client := u.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s", url)
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, errors.Wrapf(fs.ErrNotExist, "fetching %s: %s", url, resp.Status)
+	}
+	return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+}
+
+// downloadPath is the path in dir for the download of url.
+func downloadPath(dir, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// fetcher returns the urlFetcher for jr's URL sources.
+func (jr JRule) fetcher() urlFetcher {
+	return urlFetcher{
+		client: jr.HTTPClient,
+		dir:    jr.DownloadDir,
+		algo:   jr.algo(),
+	}
+}
+
+// localSource returns the path to use for src in jr's command:
+// the download of src if it is a URL and jr.DownloadDir is set,
+// and otherwise src itself.
+func (jr JRule) localSource(src string) string {
+	if jr.DownloadDir != "" && isURL(src) {
+		return downloadPath(jr.DownloadDir, src)
+	}
+	return src
+}
+
+// download brings the downloads of jr's URL sources up to date,
+// if jr.DownloadDir is set.
+func (jr JRule) download(ctx context.Context, sources []string) error {
+	if jr.DownloadDir == "" {
+		return nil
+	}
+	u := jr.fetcher()
+	for _, src := range sources {
+		if !isURL(src) {
+			continue
+		}
+		if _, err := u.download(ctx, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDownloadTempDir(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	// Downloads are written beside their final location,
+	// not in the OS temp dir, which may be on another filesystem.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "nonexistent"))
+
+	u := urlFetcher{dir: filepath.Join(t.TempDir(), "downloads")}
+	path, err := u.download(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, "content")
+}
+
+func TestDownloadETag(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		content = "v1"
+		full    int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		etag := `"` + content + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	u := urlFetcher{dir: t.TempDir()}
+	for i := 0; i < 2; i++ {
+		path, err := u.download(ctx, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, path, "v1")
+	}
+	if full != 1 {
+		t.Errorf("got %d full transfers of an unchanged resource, want 1", full)
+	}
+
+	content = "v2"
+	path, err := u.download(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, "v2")
+	if full != 2 {
+		t.Errorf("got %d full transfers after a change, want 2", full)
+	}
+}
+
+func TestURLStatus(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var status int
+		fmt.Sscan(req.URL.Path[1:], &status)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		url          string
+		wantNotExist bool
+	}{
+		{url: srv.URL + "/404", wantNotExist: true},
+		{url: srv.URL + "/410", wantNotExist: true},
+		{url: srv.URL + "/403"},
+		{url: srv.URL + "/500"},
+		{url: closed.URL},
+	}
+	for _, tc := range cases {
+		t.Run(tc.url, func(t *testing.T) {
+			for _, u := range []urlFetcher{{}, {dir: t.TempDir()}} {
+				_, err := u.hash(ctx, tc.url)
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if got := errors.Is(err, fs.ErrNotExist); got != tc.wantNotExist {
+					t.Errorf("got fs.ErrNotExist %v (error %v), want %v", got, err, tc.wantNotExist)
+				}
+			}
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	var calls int
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			req = req.Clone(req.Context())
+			req.Header.Set("Authorization", "token")
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+
+	rule := JRule{Sources: []string{srv.URL}, Command: []string{"true"}}
+	if _, err := rule.ContentHash(ctx); err == nil {
+		t.Error("no error fetching without the custom client")
+	}
+
+	rule.HTTPClient = client
+	h1 := contentHash(ctx, t, rule)
+	if calls != 1 {
+		t.Errorf("got %d calls through the custom client, want 1", calls)
+	}
+
+	// The client does not affect the hashes.
+	other := rule
+	other.HTTPClient = &http.Client{Transport: client.Transport}
+	if h2 := contentHash(ctx, t, other); !bytes.Equal(h1, h2) {
+		t.Error("content hash changed with a different HTTPClient")
+	}
+	if !bytes.Equal(rule.RuleHash(), other.RuleHash()) {
+		t.Error("rule hash changed with a different HTTPClient")
+	}
+}
+
+func TestDownloadLocalSource(t *testing.T) {
+	ctx := context.Background()
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	var (
+		dir      = t.TempDir()
+		download = filepath.Join(dir, "downloads")
+		target   = filepath.Join(dir, "target")
+		rule     = JRule{
+			Sources:     []string{srv.URL + "/data"},
+			Targets:     []string{target},
+			Command:     []string{"cp", "{{.Source}}", "{{.Target}}"},
+			Template:    true,
+			DownloadDir: download,
+		}
+	)
+
+	// The command gets the path of the download, not the URL.
+	if got, want := rule.localSource(rule.Sources[0]), downloadPath(download, rule.Sources[0]); got != want {
+		t.Errorf("got local source %s, want %s", got, want)
+	}
+	if err := rule.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, target, "content")
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	// Without DownloadDir, the URL is used as is.
+	rule.DownloadDir = ""
+	if got := rule.localSource(rule.Sources[0]); got != rule.Sources[0] {
+		t.Errorf("got local source %s, want the URL", got)
+	}
+}
@@ -0,0 +1,81 @@
+package mghash
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// interpolate replaces each ${NAME} in s with the value lookup gives NAME.
+// A $$ produces a literal $.
+// A $ followed by anything else is left alone.
+// It is an error for lookup to have no value for a NAME.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		switch {
+		case strings.HasPrefix(s, "$$"):
+			b.WriteByte('$')
+			s = s[2:]
+
+		case strings.HasPrefix(s, "${"):
+			j := strings.IndexByte(s, '}')
+			if j < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			name := s[2:j]
+			val, ok := lookup(name)
+			if !ok {
+				return "", fmt.Errorf("undefined variable %s", name)
+			}
+			b.WriteString(val)
+			s = s[j+1:]
+
+		default:
+			b.WriteByte('$')
+			s = s[1:]
+		}
+	}
+}
+
+// varLookup produces a lookup function for interpolate
+// that consults vars first and then the environment.
+func varLookup(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if val, ok := vars[name]; ok {
+			return val, true
+		}
+		return os.LookupEnv(name)
+	}
+}
+
+// interpolate applies interpolate to jr's Sources, Targets, Command, and Dir.
+func (jr *JRule) interpolate(lookup func(string) (string, bool)) error {
+	all := func(strs []string) error {
+		for i, s := range strs {
+			var err error
+			if strs[i], err = interpolate(s, lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, strs := range [][]string{jr.Sources, jr.Targets, jr.Command} {
+		if err := all(strs); err != nil {
+			return err
+		}
+	}
+	var err error
+	jr.Dir, err = interpolate(jr.Dir, lookup)
+	return err
+}
@@ -0,0 +1,179 @@
+package mghash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// verify implements JRule.Verify:
+// it saves copies of the targets, runs the command,
+// compares the results with the saved copies,
+// and restores the targets from them.
+// If restoring fails,
+// the copies are kept
+// and the error says where they are.
+func (jr JRule) verify(ctx context.Context) error {
+	var (
+		want = make(map[string][]byte)
+		got  = make(map[string][]byte)
+	)
+	fh, err := jr.fileHasher()
+	if err != nil {
+		return err
+	}
+	before, err := jr.targets()
+	if err != nil {
+		return err
+	}
+	if err = fh.fill(ctx, before, want); err != nil {
+		return errors.Wrap(err, "hashing targets")
+	}
+
+	backup, err := os.MkdirTemp("", "mghash-verify")
+	if err != nil {
+		return errors.Wrap(err, "creating backup dir")
+	}
+	for i, target := range before {
+		if want[target] == nil {
+			continue
+		}
+		if err = copyTree(target, filepath.Join(backup, strconv.Itoa(i))); err != nil {
+			// Nothing has been touched yet.
+			os.RemoveAll(backup)
+			return errors.Wrapf(err, "backing up %s", target)
+		}
+	}
+
+	runErr := jr.run(ctx)
+
+	// Glob patterns in the targets may match different files now.
+	after, err := jr.targets()
+	if runErr == nil {
+		runErr = err
+	}
+	if runErr == nil {
+		if runErr = fh.fill(ctx, after, got); runErr != nil {
+			runErr = errors.Wrap(runErr, "hashing regenerated targets")
+		}
+	}
+
+	if err = restoreTargets(before, after, want, backup); err != nil {
+		// The backup may hold the only copy of some targets.
+		return errors.Wrapf(err, "restoring targets of %s (the originals are in %s)", jr, backup)
+	}
+	if err = os.RemoveAll(backup); err != nil {
+		return errors.Wrapf(err, "removing backup dir %s", backup)
+	}
+
+	if runErr != nil {
+		return runErr
+	}
+
+	var (
+		stale []string
+		seen  = make(map[string]bool)
+	)
+	for _, target := range append(before, after...) {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		if !bytes.Equal(want[target], got[target]) {
+			stale = append(stale, target)
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return fmt.Errorf("%s: stale target(s): %s", jr, strings.Join(stale, " "))
+	}
+	return nil
+}
+
+// restoreTargets removes the regenerated targets in after
+// and restores those in before from the copies in backup,
+// where saved says which of them existed.
+// It continues past errors,
+// so as to restore as many targets as possible.
+func restoreTargets(before, after []string, saved map[string][]byte, backup string) error {
+	var errs multiErr
+	for _, target := range after {
+		if err := os.RemoveAll(target); err != nil {
+			errs = append(errs, errors.Wrapf(err, "removing regenerated %s", target))
+		}
+	}
+	for i, target := range before {
+		if err := os.RemoveAll(target); err != nil {
+			errs = append(errs, errors.Wrapf(err, "removing regenerated %s", target))
+			continue
+		}
+		if saved[target] == nil {
+			continue
+		}
+		// The command may have removed the target's directory.
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			errs = append(errs, errors.Wrapf(err, "creating directory for %s", target))
+			continue
+		}
+		if err := copyTree(filepath.Join(backup, strconv.Itoa(i)), target); err != nil {
+			errs = append(errs, errors.Wrapf(err, "restoring %s", target))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// copyTree copies the file or directory tree at src to dst,
+// preserving permissions and modification times.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrapf(err, "computing relative path of %s", path)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return errors.Wrapf(err, "getting info for %s", path)
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if err = copyFile(path, target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", src)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", dst)
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "copying %s to %s", src, dst)
+	}
+	return errors.Wrapf(out.Close(), "closing %s", dst)
+}
@@ -0,0 +1,72 @@
+package mghash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		out  = filepath.Join(dir, "out")
+		rule = JRule{Targets: []string{out}, Command: []string{"sh", "-c", "echo new > " + out}, Verify: true}
+	)
+
+	// A stale committed target fails verification and is left as it was.
+	writeFile(t, out, "old\n")
+	if err := rule.Run(ctx); err == nil {
+		t.Error("no error for a stale target")
+	}
+	checkFile(t, out, "old\n")
+
+	writeFile(t, out, "new\n")
+	if err := rule.Run(ctx); err != nil {
+		t.Errorf("error for an up-to-date target: %s", err)
+	}
+
+	// A target that should exist but doesn't is stale too,
+	// and is not left behind.
+	missing := filepath.Join(dir, "missing")
+	rule = JRule{Targets: []string{missing}, Command: []string{"touch", missing}, Verify: true}
+	if err := rule.Run(ctx); err == nil {
+		t.Error("no error for a missing target")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("got error %v for the missing target after verifying, want nonexistence", err)
+	}
+}
+
+func TestVerifyRestoreFailure(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+		sub = filepath.Join(dir, "sub")
+		out = filepath.Join(sub, "out")
+	)
+	writeFile(t, out, "original\n")
+
+	// The command replaces the target's directory with a file,
+	// so the target cannot be restored.
+	rule := JRule{
+		Targets:             []string{out},
+		Command:             []string{"sh", "-c", "rm -r " + sub + " && echo x > " + sub},
+		AllowMissingTargets: true,
+		Verify:              true,
+	}
+	err := rule.Run(ctx)
+	if err == nil {
+		t.Fatal("no error when restoring fails")
+	}
+	m := regexp.MustCompile(`the originals are in (\S+)\)`).FindStringSubmatch(err.Error())
+	if m == nil {
+		t.Fatalf("got error %q, want one naming the backup", err)
+	}
+	backup := m[1]
+	defer os.RemoveAll(backup)
+
+	checkFile(t, filepath.Join(backup, "0"), "original\n")
+}
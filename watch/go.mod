@@ -0,0 +1,15 @@
+module github.com/bobg/mghash/watch
+
+go 1.18
+
+require (
+	github.com/bobg/mghash v0.0.0-20261015012648-7aceef6ab7e0
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/magefile/mage v1.13.0
+	github.com/pkg/errors v0.9.1
+)
+
+require (
+	github.com/gibson042/canonicaljson-go v1.0.3 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -0,0 +1,260 @@
+// Package watch rebuilds mghash rules when their sources change.
+// It is a separate module from mghash
+// so that only programs using it depend on fsnotify.
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/magefile/mage/mg"
+	"github.com/pkg/errors"
+
+	"github.com/bobg/mghash"
+)
+
+// debounce is how long Watch waits after a change
+// for further changes before rebuilding.
+const debounce = 100 * time.Millisecond
+
+// Watch watches the sources of the given rules for changes
+// until ctx is canceled.
+// After each burst of changes,
+// it runs the affected rules (see mghash.Affected) in dependency order,
+// each with an mghash.Fn using db,
+// so that rules whose content hashes are unchanged are skipped.
+// A failing rule is logged and does not stop the watch,
+// and neither does an error from the underlying file watcher.
+//
+// Changes to the rules' declared targets are ignored,
+// so that Watch does not react to its own rebuilds.
+// (Rules depending on a rebuilt target are rebuilt in the same pass.)
+//
+// Watch watches the directory containing each source file,
+// rather than the file itself,
+// so that editors replacing a file on save are noticed.
+// Sources that are directories are watched recursively.
+// The set of watched directories is fixed when Watch starts,
+// apart from new subdirectories of directory sources.
+func Watch(ctx context.Context, db mghash.DB, rules []mghash.JRule) error {
+	sorted, err := mghash.Sorted(rules)
+	if err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "creating watcher")
+	}
+	defer w.Close()
+
+	dirs, err := watchDirs(ctx, rules)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err = w.Add(dir); err != nil {
+			return errors.Wrapf(err, "watching %s", dir)
+		}
+	}
+
+	var (
+		targets = targetsRule(rules)
+		changed = make(map[string]bool)
+		fire    <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Warning: watching: %s", err)
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			path := filepath.Clean(ev.Name)
+			if isSource(targets, path) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 && isSource(rules, path) {
+				// Could be a new subdirectory of a directory source.
+				if err = addTree(w, path); err != nil {
+					log.Printf("Warning: %s", err)
+				}
+			}
+			changed[path] = true
+			fire = time.After(debounce)
+
+		case <-fire:
+			fire = nil
+			paths := make([]string, 0, len(changed))
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			changed = make(map[string]bool)
+
+			if verbose() {
+				log.Printf("Changed: %s", strings.Join(paths, " "))
+			}
+			if err = rebuild(ctx, db, sorted, paths); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rebuild runs the rules affected by changes to paths,
+// in the order of sorted (see mghash.Sorted).
+// Rule failures are logged, not returned.
+func rebuild(ctx context.Context, db mghash.DB, sorted []mghash.JRule, paths []string) error {
+	for _, rule := range mghash.Affected(sorted, paths...) {
+		// Fn.Run is called directly rather than via mg.Deps,
+		// which would run each Fn at most once per process.
+		f := &mghash.Fn{DB: db, Rule: rule}
+		if err := f.Run(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("%s: %s", rule, err)
+		}
+	}
+	return nil
+}
+
+// watchDirs returns the directories to watch for changes to the sources of rules.
+func watchDirs(ctx context.Context, rules []mghash.JRule) ([]string, error) {
+	dirs := make(map[string]bool)
+	for _, rule := range rules {
+		for _, src := range rule.Sources {
+			// Files matching a pattern may be created later.
+			if dir := filepath.Dir(src); isGlob(src) && !isGlob(dir) {
+				dirs[dir] = true
+			}
+		}
+		sources, err := rule.SourceFiles(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing sources of %s", rule)
+		}
+		for _, src := range sources {
+			if isURL(src) {
+				// Remote sources cannot be watched.
+				continue
+			}
+			info, err := os.Stat(src)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Perhaps a glob pattern, or a file yet to be created.
+				dirs[filepath.Dir(src)] = true
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "statting %s", src)
+			}
+			if !info.IsDir() {
+				dirs[filepath.Dir(src)] = true
+				continue
+			}
+			err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					dirs[path] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "walking %s", src)
+			}
+		}
+	}
+
+	var result []string
+	for dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			result = append(result, dir)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// targetsRule returns a one-element list of rules
+// whose sources are the declared targets of rules
+// (including StdoutFile and StderrFile),
+// so that isSource tells whether a path is one of those targets.
+func targetsRule(rules []mghash.JRule) []mghash.JRule {
+	var targets []string
+	for _, rule := range rules {
+		targets = append(targets, rule.Targets...)
+		for _, file := range []string{rule.StdoutFile, rule.StderrFile} {
+			if file != "" {
+				targets = append(targets, file)
+			}
+		}
+	}
+	return []mghash.JRule{{Sources: targets}}
+}
+
+// addTree watches path and the directories beneath it,
+// if it is a directory.
+func addTree(w *fsnotify.Watcher, path string) error {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "watching %s", path)
+}
+
+// isSource tells whether path is a source of any of rules.
+func isSource(rules []mghash.JRule, path string) bool {
+	return len(mghash.Affected(rules, path)) > 0
+}
+
+// isGlob tells whether path contains glob metacharacters,
+// as in mghash.
+func isGlob(path string) bool {
+	return !isURL(path) && strings.ContainsAny(path, "*?[")
+}
+
+// isURL tells whether a source is an HTTP or HTTPS URL,
+// as in mghash.
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// verbose tells whether to log verbosely,
+// as in mghash:
+// the MAGEFILE_VERBOSE environment variable takes precedence over the config file.
+func verbose() bool {
+	if _, ok := os.LookupEnv(mg.VerboseEnv); ok {
+		return mg.Verbose()
+	}
+	c, err := mghash.LoadConfig()
+	return err == nil && c.Verbose
+}
@@ -0,0 +1,129 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bobg/mghash"
+)
+
+// hasCountingDB is a DB counting calls to Has.
+type hasCountingDB struct {
+	mghash.DB
+	n int64
+}
+
+func (db *hasCountingDB) Has(ctx context.Context, h []byte) (bool, error) {
+	atomic.AddInt64(&db.n, 1)
+	return db.DB.Has(ctx, h)
+}
+
+func TestWatch(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		shared = filepath.Join(dir, "shared")
+		other  = filepath.Join(dir, "other")
+		mid    = filepath.Join(dir, "mid")
+		logs   = filepath.Join(dir, "log")
+		gen    = filepath.Join(dir, "gen")
+		rules  = []mghash.JRule{{
+			Sources: []string{mid},
+			Targets: []string{filepath.Join(dir, "final")},
+			Command: []string{"sh", "-c", "cp " + mid + " " + filepath.Join(dir, "final") + " && echo final >> " + logs},
+		}, {
+			Sources: []string{shared},
+			Targets: []string{mid},
+			Command: []string{"sh", "-c", "cp " + shared + " " + mid + " && echo mid >> " + logs},
+		}, {
+			Sources: []string{other},
+			Targets: []string{filepath.Join(dir, "other.out")},
+			Command: []string{"sh", "-c", "echo other >> " + logs},
+		}, {
+			// A target in a source directory,
+			// different after every run.
+			Sources: []string{gen},
+			Targets: []string{filepath.Join(gen, "out")},
+			Command: []string{"sh", "-c", "date +%N >> " + filepath.Join(gen, "out") + " && echo gen >> " + logs},
+		}}
+	)
+	writeFile(t, shared, "1")
+	writeFile(t, other, "other")
+	writeFile(t, filepath.Join(gen, "in"), "in")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error)
+	db := &hasCountingDB{DB: mghash.NewMemDB()}
+	go func() { errs <- Watch(ctx, db, rules) }()
+
+	// There is no signal that watching has begun.
+	time.Sleep(200 * time.Millisecond)
+
+	waitForLog := func(want string) {
+		t.Helper()
+		var got []byte
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			var err error
+			got, err = os.ReadFile(logs)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(got) == want {
+				// Wait a while longer for unwanted rebuilds,
+				// or even checks.
+				n := atomic.LoadInt64(&db.n)
+				time.Sleep(4 * debounce)
+				if got, err = os.ReadFile(logs); err != nil {
+					t.Fatal(err)
+				}
+				if atomic.LoadInt64(&db.n) != n {
+					t.Error("rules checked again after rebuilding")
+				}
+				break
+			}
+		}
+		if string(got) != want {
+			t.Fatalf("got log %q, want %q", got, want)
+		}
+	}
+
+	// The dependents of a changed source are rebuilt in order,
+	// and nothing else.
+	writeFile(t, shared, "2")
+	waitForLog("mid\nfinal\n")
+	checkFile(t, filepath.Join(dir, "final"), "2")
+
+	// A rule's own targets do not trigger another check.
+	writeFile(t, filepath.Join(gen, "in"), "changed")
+	waitForLog("mid\nfinal\ngen\n")
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got error %v from Watch, want %v", err, context.Canceled)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q in %s, want %q", got, filepath.Base(path), want)
+	}
+}